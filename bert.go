@@ -0,0 +1,184 @@
+package m17
+
+import (
+	"fmt"
+	"log"
+	"math/bits"
+)
+
+const (
+	// Number of PRBS9 bits carried in each BERT frame
+	BERTBitsPerFrame = 197
+	// The receiver is synced after predicting this many bits in a row
+	bertSyncBits = 18
+	// The receiver resyncs if more than bertLossErrors of the last 64 bits
+	// are errors
+	bertLossErrors = 16
+)
+
+// PRBS9 generates the x^9 + x^5 + 1 pseudorandom bit sequence carried by
+// BERT frames.
+type PRBS9 struct {
+	state uint16
+}
+
+// NewPRBS9 creates a PRBS9 starting from the state used by the spec.
+func NewPRBS9() *PRBS9 {
+	return &PRBS9{state: 1}
+}
+
+// predict returns the next bit without advancing the sequence
+func (p *PRBS9) predict() byte {
+	return byte((p.state>>8)^(p.state>>4)) & 1
+}
+
+// shift advances the sequence with bit
+func (p *PRBS9) shift(bit byte) {
+	p.state = (p.state<<1 | uint16(bit)) & 0x1FF
+}
+
+// Next returns the next bit of the sequence.
+func (p *PRBS9) Next() byte {
+	bit := p.predict()
+	p.shift(bit)
+	return bit
+}
+
+// BERTEncoder generates the symbols for a BERT transmission: a BERT preamble,
+// frames carrying a continuous PRBS9 sequence and an EOT marker.
+type BERTEncoder struct {
+	prbs *PRBS9
+}
+
+// NewBERTEncoder creates a BERTEncoder.
+func NewBERTEncoder() *BERTEncoder {
+	return &BERTEncoder{prbs: NewPRBS9()}
+}
+
+// Start generates the preamble that begins a BERT transmission.
+func (e *BERTEncoder) Start() []Symbol {
+	return AppendPreamble(nil, bertPreamble)
+}
+
+// NextFrame generates a BERT frame carrying the next BERTBitsPerFrame bits of
+// the sequence.
+func (e *BERTEncoder) NextFrame() ([]Symbol, error) {
+	data := make([]byte, (BERTBitsPerFrame+7)/8)
+	for i := range BERTBitsPerFrame {
+		data[i/8] |= e.prbs.Next() << (7 - i%8)
+	}
+	b, err := ConvolutionalEncode(data, StreamPuncturePattern, (BERTBitsPerFrame-1)%8)
+	if err != nil {
+		return nil, fmt.Errorf("unable to encode BERT frame: %w", err)
+	}
+	// The punctured code is one bit longer than the payload, so the last
+	// flushing bit is dropped
+	encodedBits := NewBits(b)
+	rfBits := InterleaveBits(encodedBits)
+	rfBits = RandomizeBits(rfBits)
+	syms := AppendSyncword(nil, BERTSync)
+	return AppendBits(syms, rfBits), nil
+}
+
+// End generates the EOT marker that ends a transmission.
+func (e *BERTEncoder) End() []Symbol {
+	return AppendEOT(nil)
+}
+
+// Encode generates a complete BERT transmission of frames frames.
+func (e *BERTEncoder) Encode(frames int) ([]Symbol, error) {
+	out := e.Start()
+	for i := range frames {
+		syms, err := e.NextFrame()
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode frame %d: %w", i, err)
+		}
+		out = append(out, syms...)
+	}
+	return append(out, e.End()...), nil
+}
+
+// BERTStats are the running totals for a BERT reception.
+type BERTStats struct {
+	// Frames received
+	Frames int
+	// Bits checked and bit errors while the receiver was synced
+	Bits   int
+	Errors int
+	Synced bool
+}
+
+// BER returns the bit error rate.
+func (s BERTStats) BER() float64 {
+	if s.Bits == 0 {
+		return 0
+	}
+	return float64(s.Errors) / float64(s.Bits)
+}
+
+func (s BERTStats) String() string {
+	return fmt.Sprintf("frames: %d, bits: %d, errors: %d, BER: %.2e, synced: %v", s.Frames, s.Bits, s.Errors, s.BER(), s.Synced)
+}
+
+// BERTReceiver checks the PRBS9 sequence in received BERT frames. It syncs to
+// the sequence from the received bits, so it can start at any point and
+// recover after lost frames.
+type BERTReceiver struct {
+	prbs  PRBS9
+	stats BERTStats
+	// bits predicted in a row while syncing
+	syncCnt int
+	// error bitmap of the last 64 bits, while synced
+	history uint64
+}
+
+// Stats returns the totals so far.
+func (r *BERTReceiver) Stats() BERTStats {
+	return r.stats
+}
+
+// Reset clears the totals and sync state.
+func (r *BERTReceiver) Reset() {
+	*r = BERTReceiver{}
+}
+
+// AddBit checks a received bit against the sequence.
+func (r *BERTReceiver) AddBit(bit byte) {
+	bit &= 1
+	expected := r.prbs.predict()
+	if !r.stats.Synced {
+		// Load the received bits into the generator until it predicts them.
+		// An all zero state would predict silence.
+		if bit == expected && r.prbs.state != 0 {
+			r.syncCnt++
+		} else {
+			r.syncCnt = 0
+		}
+		r.prbs.shift(bit)
+		if r.syncCnt >= bertSyncBits {
+			r.stats.Synced = true
+			r.history = 0
+		}
+		return
+	}
+	r.prbs.shift(expected)
+	r.stats.Bits++
+	r.history <<= 1
+	if bit != expected {
+		r.stats.Errors++
+		r.history |= 1
+	}
+	if bits.OnesCount64(r.history) > bertLossErrors {
+		log.Printf("[DEBUG] BERT lost sync after %d bits", r.stats.Bits)
+		r.stats.Synced = false
+		r.syncCnt = 0
+	}
+}
+
+// AddFrame checks the bits of a decoded BERT frame, packed MSB first.
+func (r *BERTReceiver) AddFrame(data []byte) {
+	r.stats.Frames++
+	for i := range BERTBitsPerFrame {
+		r.AddBit(data[i/8] >> (7 - i%8))
+	}
+}
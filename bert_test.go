@@ -0,0 +1,117 @@
+package m17
+
+import (
+	"testing"
+)
+
+func TestPRBS9(t *testing.T) {
+	p := NewPRBS9()
+	first := make([]byte, 511)
+	for i := range first {
+		first[i] = p.Next()
+	}
+	// The sequence repeats every 2^9-1 bits
+	for i := range first {
+		if got := p.Next(); got != first[i] {
+			t.Fatalf("bit %d of second period = %d, want %d", i, got, first[i])
+		}
+	}
+	ones := 0
+	for _, b := range first {
+		ones += int(b)
+	}
+	if ones != 256 {
+		t.Errorf("ones in one period = %d, want 256", ones)
+	}
+}
+
+func TestBERTReceiver(t *testing.T) {
+	tests := []struct {
+		name       string
+		skip       int
+		errorEvery int
+		wantErrors int
+	}{
+		{"clean", 0, 0, 0},
+		{"late start", 100, 0, 0},
+		{"errors", 0, 100, 20},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewPRBS9()
+			for range tt.skip {
+				p.Next()
+			}
+			var r BERTReceiver
+			for i := range 2000 {
+				bit := p.Next()
+				if tt.errorEvery != 0 && i%tt.errorEvery == tt.errorEvery-1 {
+					bit ^= 1
+				}
+				r.AddBit(bit)
+			}
+			s := r.Stats()
+			if !s.Synced {
+				t.Fatalf("BERTReceiver not synced")
+			}
+			// Syncing takes 9 bits to load the generator, then bertSyncBits
+			if s.Bits < 2000-9-2*bertSyncBits || s.Bits > 2000-bertSyncBits || s.Errors != tt.wantErrors {
+				t.Errorf("BERTReceiver stats = %s, want %d errors", s, tt.wantErrors)
+			}
+		})
+	}
+}
+
+func TestBERTReceiver_LosesSync(t *testing.T) {
+	var r BERTReceiver
+	p := NewPRBS9()
+	for range 100 {
+		r.AddBit(p.Next())
+	}
+	// Silence doesn't look like the sequence
+	for range 100 {
+		r.AddBit(0)
+	}
+	if r.Stats().Synced {
+		t.Errorf("BERTReceiver synced to silence")
+	}
+	// Resync, picking up where the sequence has got to
+	for range 1000 {
+		p.Next()
+	}
+	errors := r.Stats().Errors
+	for range 100 {
+		r.AddBit(p.Next())
+	}
+	if s := r.Stats(); !s.Synced || s.Errors != errors {
+		t.Errorf("BERTReceiver after resync = %s, want %d errors", s, errors)
+	}
+}
+
+func TestBERTEncoder_Decoder(t *testing.T) {
+	syms, err := NewBERTEncoder().Encode(10)
+	if err != nil {
+		t.Fatalf("BERTEncoder.Encode() error = %v", err)
+	}
+	var got []BERTStats
+	d := NewDecoder(nil)
+	d.DecodeSymbols(&DummyModem{In: symbolReader(t, syms)}, func(e Event) {
+		switch e := e.(type) {
+		case BERTEvent:
+			got = append(got, e.Stats)
+		case EOTEvent:
+			if e.SyncType != BERTSync {
+				t.Errorf("EOTEvent type = %x, want %x", e.SyncType, BERTSync)
+			}
+		default:
+			t.Errorf("unexpected event %#v", e)
+		}
+	})
+	if len(got) != 10 {
+		t.Fatalf("got %d BERTEvents, want 10", len(got))
+	}
+	last := got[len(got)-1]
+	if !last.Synced || last.Frames != 10 || last.Bits < 10*BERTBitsPerFrame-9-2*bertSyncBits || last.Errors != 0 {
+		t.Errorf("BERT stats = %s", last)
+	}
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"encoding/binary"
+	"encoding/hex"
 	"errors"
 	"flag"
 	"fmt"
@@ -8,6 +10,8 @@ import (
 	"log/slog"
 	"os"
 	"os/signal"
+	"strings"
+	"sync"
 	"syscall"
 
 	"github.com/hashicorp/logutils"
@@ -39,6 +43,10 @@ type config struct {
 	boot0Pin        int
 	symbolsIn       *os.File
 	symbolsOut      *os.File
+	keys            *m17.KeyStore
+	signers         *m17.SignerRegistry
+	rfVersion       m17.LSFVersion
+	networkVersion  m17.LSFVersion
 }
 
 func loadConfig(iniFile string, inFile string, outFile string) (config, error) {
@@ -67,6 +75,9 @@ func loadConfig(iniFile string, inFile string, outFile string) (config, error) {
 	nRSTPin, nRSTPinErr := cfg.Section("Modem").Key("NRSTPin").Int()
 	paEnablePin, paEnablePinErr := cfg.Section("Modem").Key("PAEnablePin").Int()
 	boot0Pin, boot0PinErr := cfg.Section("Modem").Key("Boot0Pin").Int()
+	scramblerSeed, scramblerSeedErr := cfg.Section("Encryption").Key("ScramblerSeed").Uint64()
+	rfVersion, rfVersionErr := m17.ParseLSFVersion(cfg.Section("LSF").Key("RFVersion").String())
+	networkVersion, networkVersionErr := m17.ParseLSFVersion(cfg.Section("LSF").Key("NetworkVersion").String())
 
 	_, callsignErr := m17.EncodeCallsign(callsign)
 	// TODO: Lots of these validations are CC1200 specific
@@ -96,6 +107,74 @@ func loadConfig(iniFile string, inFile string, outFile string) (config, error) {
 	if reflectorModule == " " {
 		reflectorModule = ""
 	}
+	var keys *m17.KeyStore
+	if cfg.Section("Encryption").Key("ScramblerSeed").String() == "" {
+		scramblerSeedErr = nil
+	} else if scramblerSeedErr == nil {
+		if scramblerSeed > 0xFFFFFF {
+			scramblerSeedErr = fmt.Errorf("configured ScramblerSeed %#x out of range (1 to 0xFFFFFF)", scramblerSeed)
+		} else {
+			// The seed length in bytes selects the scrambler LFSR length
+			seed := binary.BigEndian.AppendUint32(nil, uint32(scramblerSeed))
+			seed = seed[3-m17.ScramblerSubtype(uint32(scramblerSeed)):]
+			keys = m17.NewKeyStore()
+			scramblerSeedErr = keys.SetDefaultKey(seed)
+		}
+	}
+	// AESKey is the default AES key, and Key.<callsign> the key for a callsign
+	var aesKeysErr error
+	for _, k := range cfg.Section("Encryption").Keys() {
+		var callsign string
+		switch {
+		case k.Name() == "AESKey":
+		case strings.HasPrefix(k.Name(), "Key."):
+			callsign = strings.TrimPrefix(k.Name(), "Key.")
+		default:
+			continue
+		}
+		if k.String() == "" {
+			continue
+		}
+		key, err := hex.DecodeString(k.String())
+		if err != nil {
+			aesKeysErr = errors.Join(aesKeysErr, fmt.Errorf("configured %s is not hex: %w", k.Name(), err))
+			continue
+		}
+		if _, err := m17.AESSubtype(key); err != nil {
+			aesKeysErr = errors.Join(aesKeysErr, fmt.Errorf("configured %s: %w", k.Name(), err))
+			continue
+		}
+		if keys == nil {
+			keys = m17.NewKeyStore()
+		}
+		if callsign != "" {
+			err = keys.AddCallsignKey(callsign, key)
+		} else if cfg.Section("Encryption").Key("ScramblerSeed").String() != "" {
+			err = errors.New("ScramblerSeed is also set, so only one can be the default key")
+		} else {
+			err = keys.SetDefaultKey(key)
+		}
+		if err != nil {
+			aesKeysErr = errors.Join(aesKeysErr, fmt.Errorf("configured %s: %w", k.Name(), err))
+		}
+	}
+	var signers *m17.SignerRegistry
+	var signersErr error
+	for _, k := range cfg.Section("SigningKeys").Keys() {
+		if signers == nil {
+			signers = m17.NewSignerRegistry()
+		}
+		b, err := hex.DecodeString(k.String())
+		if err != nil {
+			signersErr = errors.Join(signersErr, fmt.Errorf("configured signing key for %s is not hex: %w", k.Name(), err))
+			continue
+		}
+		key, err := m17.ParseSigningPublicKey(b)
+		if err == nil {
+			err = signers.Add(k.Name(), key)
+		}
+		signersErr = errors.Join(signersErr, err)
+	}
 	var logLevelErr error
 	if logLevel != "ERROR" && logLevel != "INFO" && logLevel != "DEBUG" {
 		logLevelErr = fmt.Errorf("configured Log Level must be one of ERROR, INFO or DEBUG")
@@ -144,6 +223,11 @@ func loadConfig(iniFile string, inFile string, outFile string) (config, error) {
 		reflectorAddrErr,
 		reflectorModuleErr,
 		// reflectorPortErr,
+		scramblerSeedErr,
+		aesKeysErr,
+		signersErr,
+		rfVersionErr,
+		networkVersionErr,
 		logLevelErr,
 		symbolsInErr,
 		symbolsOutErr,
@@ -173,15 +257,24 @@ func loadConfig(iniFile string, inFile string, outFile string) (config, error) {
 		symbolsIn:       symbolsIn,
 		symbolsOut:      symbolsOut,
 		dashboardLogger: dashboardLogger,
+		keys:            keys,
+		signers:         signers,
+		rfVersion:       rfVersion,
+		networkVersion:  networkVersion,
 	}, err
 }
 
 var (
-	inArg      *string = flag.String("in", "", "M17 symbol input (default stdin)")
-	outArg     *string = flag.String("out", "", "M17 symbol output (default stdout)")
-	configFile *string = flag.String("config", "./gateway.ini", "Configuration file")
-	reset      *bool   = flag.Bool("reset", false, "Reset modem and exit")
-	helpArg    *bool   = flag.Bool("h", false, "Print arguments")
+	inArg      *string  = flag.String("in", "", "M17 input (default stdin): float32 symbols (.sym, .flt), baseband samples in a .wav, .s16, .s8 (CC1200) or .f32 file, or SDR IQ samples in a .cu8, .cs8, .cs16 or .cf32 file")
+	outArg     *string  = flag.String("out", "", "M17 output (default stdout), in the same formats as -in, with IQ samples FM modulated for an SDR to transmit")
+	floatArg   *bool    = flag.Bool("float", false, "Write 32 bit float samples to a .wav -out rather than 16 bit PCM")
+	rateArg    *int     = flag.Int("rate", 0, "Sample rate of -in and -out, if they carry samples rather than symbols (default 48000 for .wav and .s16, required for .f32 and IQ)")
+	devArg     *float64 = flag.Float64("deviation", 2400, "FM deviation in Hz of the outer symbols in IQ written to -out")
+	configFile *string  = flag.String("config", "./gateway.ini", "Configuration file")
+	reset      *bool    = flag.Bool("reset", false, "Reset modem and exit")
+	bertArg    *string  = flag.String("bert", "", "BERT mode instead of gateway: tx to transmit BERT frames, rx to receive them and report the bit error rate")
+	bertFrames *int     = flag.Int("bert-frames", 1500, "Number of 40 ms frames to transmit in BERT tx mode")
+	helpArg    *bool    = flag.Bool("h", false, "Print arguments")
 )
 
 func main() {
@@ -193,6 +286,9 @@ func main() {
 		flag.Usage()
 		return
 	}
+	if *bertArg != "" && *bertArg != "tx" && *bertArg != "rx" {
+		log.Fatalf("Bad -bert mode %s, must be tx or rx", *bertArg)
+	}
 	cfg, err := loadConfig(*configFile, *inArg, *outArg)
 	if err != nil {
 		log.Fatalf("Bad configuration: %v", err)
@@ -208,10 +304,12 @@ func main() {
 	var g *Gateway
 	var modem m17.Modem
 	if cfg.modemPort != "" {
-		modem, err = m17.NewCC1200Modem(cfg.modemPort, cfg.nRSTPin, cfg.paEnablePin, cfg.boot0Pin, cfg.modemSpeed)
+		cc1200, err := m17.NewCC1200Modem(cfg.modemPort, cfg.nRSTPin, cfg.paEnablePin, cfg.boot0Pin, cfg.modemSpeed)
 		if err != nil {
 			log.Fatalf("Error connecting to modem: %v", err)
 		}
+		cc1200.Keys = cfg.keys
+		modem = cc1200
 		modem.SetRXFreq(cfg.rxFrequency)
 		modem.SetTXFreq(cfg.txFrequency)
 		modem.SetTXPower(cfg.power)
@@ -219,9 +317,21 @@ func main() {
 		modem.SetAFC(cfg.afc)
 		log.Printf("[INFO] Connected to modem on %s", cfg.modemPort)
 	} else {
+		// Formats come from the file extensions. A WAV header on stdin is
+		// detected anyway.
+		inFormat, _ := m17.FormatForName(*inArg)
+		outFormat, _ := m17.FormatForName(*outArg)
+		if *floatArg && outFormat == m17.FormatWAV {
+			outFormat = m17.FormatWAVFloat
+		}
 		m := m17.DummyModem{
-			In:  cfg.symbolsIn,
-			Out: cfg.symbolsOut,
+			In:         cfg.symbolsIn,
+			Out:        cfg.symbolsOut,
+			Keys:       cfg.keys,
+			InFormat:   inFormat,
+			OutFormat:  outFormat,
+			SampleRate: *rateArg,
+			Deviation:  *devArg,
 		}
 
 		modem = &m
@@ -237,6 +347,21 @@ func main() {
 		os.Exit(0)
 	}
 
+	switch *bertArg {
+	case "tx":
+		log.Printf("[INFO] Transmitting %d BERT frames", *bertFrames)
+		err = modem.TransmitBERT(*bertFrames)
+		if err != nil {
+			log.Printf("[ERROR] Error transmitting BERT: %v", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	case "rx":
+		modem.StartRX()
+		runBERTReceiver(modem)
+		os.Exit(0)
+	}
+
 	log.Printf("[DEBUG] Creating gateway cfg: %#v, modem %#v", cfg, modem)
 	g, err = NewGateway(cfg, modem)
 	if err != nil {
@@ -246,6 +371,41 @@ func main() {
 	g.Run()
 }
 
+// runBERTReceiver decodes BERT frames from modem, reporting the running bit
+// error rate once a second, until interrupted or the input ends.
+func runBERTReceiver(modem m17.Modem) {
+	var mu sync.Mutex
+	var last m17.BERTStats
+	d := m17.NewDecoder(nil)
+	done := make(chan struct{})
+	go func() {
+		err := d.DecodeSymbols(modem, func(e m17.Event) {
+			b, ok := e.(m17.BERTEvent)
+			if !ok {
+				return
+			}
+			mu.Lock()
+			last = b.Stats
+			mu.Unlock()
+			// 25 frames per second
+			if b.Stats.Frames%25 == 0 {
+				log.Printf("[INFO] BERT %s, sync correlation: %.2f, level: %.2f, frequency offset: %+.0f Hz, Viterbi error: %.1f", b.Stats, b.SyncCorrelation, b.Level, b.FrequencyOffset, b.ViterbiError)
+			}
+		})
+		log.Printf("[DEBUG] BERT receiver stopped: %v", err)
+		close(done)
+	}()
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case <-signalChan:
+	case <-done:
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	log.Printf("[INFO] BERT final %s", last)
+}
+
 func setupLogging(c config) {
 	var err error
 	minLogLevel := c.logLevel
@@ -280,9 +440,12 @@ type Gateway struct {
 	in              *os.File
 	out             *os.File
 	relay           *m17.Relay
+	streams         *m17.StreamForwarder
 	duplex          bool
 	done            bool
 	dashboardLogger *slog.Logger
+	signers         *m17.SignerRegistry
+	rfVersion       m17.LSFVersion
 }
 
 func NewGateway(cfg config, modem m17.Modem) (*Gateway, error) {
@@ -296,6 +459,8 @@ func NewGateway(cfg config, modem m17.Modem) (*Gateway, error) {
 		modem:           modem,
 		duplex:          cfg.duplex,
 		dashboardLogger: cfg.dashboardLogger,
+		signers:         cfg.signers,
+		rfVersion:       cfg.rfVersion,
 	}
 
 	log.Printf("[DEBUG] Connecting to %s:%d, module %s", g.Server, g.Port, g.Module)
@@ -303,6 +468,8 @@ func NewGateway(cfg config, modem m17.Modem) (*Gateway, error) {
 	if err != nil {
 		return nil, fmt.Errorf("error creating relay: %v", err)
 	}
+	g.relay.LSFVersion = cfg.networkVersion
+	g.streams = m17.NewStreamForwarder(g.relay.SendStream)
 	err = g.relay.Connect()
 	if err != nil {
 		return nil, fmt.Errorf("error connecting to %s:%d %s: %v", g.Server, g.Port, g.Module, err)
@@ -315,29 +482,44 @@ func NewGateway(cfg config, modem m17.Modem) (*Gateway, error) {
 
 func (g Gateway) TransmitPacket(p m17.Packet) error {
 	// log.Printf("[DEBUG] received packet from relay: %#v", p)
+	p.LSF = p.LSF.ToVersion(g.rfVersion)
 	return g.modem.TransmitPacket(p)
 }
 
 func (g Gateway) TransmitVoiceStream(sd m17.StreamDatagram) error {
 	// log.Printf("[DEBUG] received voice stream data from relay: %#v", sd)
+	sd.LSF = sd.LSF.ToVersion(g.rfVersion)
 	return g.modem.TransmitVoiceStream(sd)
 }
 
-func (g *Gateway) SendToNetwork(lsf *m17.LSF, payload []byte, sid, fn uint16) error {
+// HandleEvent forwards traffic received over RF to the network.
+func (g *Gateway) HandleEvent(e m17.Event) {
 	var err error
-	if lsf == nil {
-		return fmt.Errorf("nil lsf in SendToNetwork")
-	}
-	// log.Printf("[DEBUG] SendToNetwork lsf: %v, payload: % x, sid: %x, fn: %d", lsf, payload, sid, fn)
-	if lsf.LSFType() == m17.LSFTypePacket {
-		p := m17.NewPacketFromBytes(append(lsf.ToBytes(), payload...))
+	switch e := e.(type) {
+	case m17.LSFEvent:
+		if e.CRCValid && !e.FromLICH {
+			log.Printf("[INFO] RF signal from %s: frequency offset %+.0f Hz, deviation %.0f Hz", e.LSF.Src.Callsign(), e.FrequencyOffset, e.Deviation())
+		}
+		err = g.streams.HandleEvent(e)
+	case m17.StreamFrameEvent, m17.StreamEndEvent:
+		// log.Printf("[DEBUG] send stream frame to reflector/relay: %#v", e)
+		err = g.streams.HandleEvent(e)
+	case m17.PacketEvent:
+		p := m17.NewPacketFromBytes(append(e.LSF.ToBytes(), e.Payload...))
 		log.Printf("[DEBUG] send packet to reflector/relay: %v", p)
 		err = g.relay.SendPacket(p)
-	} else { // m17.LSFTypeStream
-		err = g.relay.SendStream(*lsf, sid, fn, payload)
+	case m17.PacketCRCErrorEvent:
+		log.Printf("[INFO] Dropping packet from %s with bad CRC", e.LSF.Src.Callsign())
+	case m17.SyncLostEvent:
+		log.Printf("[DEBUG] RF sync lost, type: %x", e.SyncType)
+		err = g.streams.HandleEvent(e)
+	case m17.EOTEvent:
+		log.Printf("[DEBUG] RF end of transmission, type: %x", e.SyncType)
+		err = g.streams.HandleEvent(e)
+	}
+	if err != nil {
+		log.Printf("[ERROR] Error sending to network: %v", err)
 	}
-	// TODO: Handle error?
-	return err
 }
 
 func (g *Gateway) Run() {
@@ -348,8 +530,12 @@ func (g *Gateway) Run() {
 		// When Handle exits, we're done
 		<-signalChan
 	}()
+	// No Keys, so encrypted RF traffic reaches the network still encrypted,
+	// matching its LSF
 	d := m17.NewDecoder(g.dashboardLogger)
-	go d.DecodeSymbols(g.modem, g.SendToNetwork)
+	d.Signers = g.signers
+	d.LSFVersion = g.rfVersion
+	go d.DecodeSymbols(g.modem, g.HandleEvent)
 	// Run until we're terminated then clean up
 	log.Print("[DEBUG] client: Waiting for close signal")
 	// wait for a close signal then clean up
@@ -367,6 +553,9 @@ func (g *Gateway) Run() {
 func (g *Gateway) Close() {
 	log.Print("[DEBUG] Gateway.Close()")
 	g.done = true
+	if g.streams != nil {
+		g.streams.Close()
+	}
 	g.relay.Close()
 	if g.modem != nil {
 		g.modem.Close()
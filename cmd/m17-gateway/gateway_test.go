@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/icza/gog"
+	"github.com/jancona/m17"
+)
+
+const testConfig = `[General]
+Callsign=N0CALL
+
+[Radio]
+RXFrequency=435000000
+TXFrequency=435000000
+Power=5.5
+AFC=false
+FrequencyCorr=0
+Duplex=false
+
+[Reflector]
+Address=ref.m17.link
+Module=P
+
+[LSF]
+RFVersion=auto
+NetworkVersion=auto
+
+[Log]
+Level=INFO
+
+[Modem]
+Speed=460800
+NRSTPin=21
+PAEnablePin=18
+Boot0Pin=20
+
+[Encryption]
+`
+
+func TestLoadConfig_Encryption(t *testing.T) {
+	aes128 := "000102030405060708090a0b0c0d0e0f"
+	aes256 := strings.Repeat("f0", 32)
+	tests := []struct {
+		name       string
+		encryption string
+		// keys wanted for traffic from each callsign
+		want    map[string]string
+		wantErr bool
+	}{
+		{"none", "", nil, false},
+		{"scrambler", "ScramblerSeed=0x1234", map[string]string{"N0CALL": "1234"}, false},
+		{"AES", "AESKey=" + aes128, map[string]string{"N0CALL": aes128, "N1CALL": aes128}, false},
+		{"empty AES", "AESKey=", nil, false},
+		{"callsign", "Key.N1CALL=" + aes256, map[string]string{"N0CALL": "", "N1CALL": aes256}, false},
+		{"callsign and default", "AESKey=" + aes128 + "\nKey.n1call=" + aes256, map[string]string{"N0CALL": aes128, "N1CALL": aes256}, false},
+		{"short AES", "AESKey=" + aes128[2:], nil, true},
+		{"long callsign key", "Key.N1CALL=" + aes256 + "00", nil, true},
+		{"not hex", "AESKey=" + strings.Repeat("x", 32), nil, true},
+		{"bad callsign", "Key.N0-CALL=" + aes128, nil, true},
+		{"AES and scrambler", "ScramblerSeed=0x1234\nAESKey=" + aes128, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			iniFile := filepath.Join(t.TempDir(), "gateway.ini")
+			err := os.WriteFile(iniFile, []byte(testConfig+tt.encryption+"\n"), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cfg, err := loadConfig(iniFile, "", "")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("loadConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if (cfg.keys != nil) != (tt.want != nil) {
+				t.Fatalf("loadConfig() keys = %v, want keys %v", cfg.keys, tt.want)
+			}
+			for src, want := range tt.want {
+				lsf := gog.Must(m17.NewLSF("@ALL", src, m17.LSFTypeStream, m17.LSFDataTypeVoice, m17.LSFEncryptionTypeNone, 0, 0))
+				if got := cfg.keys.Key(&lsf); !bytes.Equal(got, gog.Must(hex.DecodeString(want))) {
+					t.Errorf("key for %s = %x, want %s", src, got, want)
+				}
+			}
+		})
+	}
+}
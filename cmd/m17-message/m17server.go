@@ -207,7 +207,11 @@ func (s *m17Server) handleM17(p m17.Packet) error {
 		msg = string(p.Payload[0 : len(p.Payload)-1])
 	}
 	if p.Type == m17.PacketTypeSMS && (dst == s.callsign || dst == m17.DestinationAll || dst[0:1] == "#") {
-		fmt.Printf("%s %s>%s: %s\n", time.Now().Format(time.DateTime), src, dst, msg)
+		if g, ok := p.LSF.GNSS(); ok && g.PositionValid {
+			fmt.Printf("%s %s [%s]>%s: %s\n", time.Now().Format(time.DateTime), src, g, dst, msg)
+		} else {
+			fmt.Printf("%s %s>%s: %s\n", time.Now().Format(time.DateTime), src, dst, msg)
+		}
 		chName := src
 		if strings.HasPrefix(dst, "@") || strings.HasPrefix(dst, "#") {
 			chName = dst
@@ -216,7 +220,7 @@ func (s *m17Server) handleM17(p m17.Packet) error {
 			serverID:       s.ID,
 			channelName:    chName,
 			content:        msg,
-			sourceCallsign: src,
+			sourceCallsign: p.LSF.Originator(),
 		}
 		for _, h := range m17Handlers {
 			h(ev)
@@ -73,6 +73,19 @@ func handleM17(p m17.Packet) error {
 	if len(p.Payload) > 0 {
 		msg = string(p.Payload[0 : len(p.Payload)-1])
 	}
+	if _, via, ok := p.LSF.ExtendedCallsign(); ok {
+		// Show who really sent traffic relayed through a reflector
+		if orig := p.LSF.Originator(); orig != src {
+			src = orig + " (" + src + ")"
+		}
+		if via != (m17.EncodedCallsign{}) {
+			src += " via " + via.Callsign()
+		}
+	}
+	if g, ok := p.LSF.GNSS(); ok && g.PositionValid {
+		// Show where mobile stations are
+		src += " [" + g.String() + "]"
+	}
 	if p.Type == m17.PacketTypeSMS && (dst == *callsignArg || dst == m17.DestinationAll || dst[0:1] == "#") {
 		fmt.Printf("\n%s %s>%s: %s\n> ", time.Now().Format(time.DateTime), src, dst, msg)
 	}
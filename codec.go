@@ -71,14 +71,34 @@ func (b *Bit) Set(by byte) {
 	*b = by != 0
 }
 
-type Bits [BitsPerPayload]Bit
+// Bits holds the bits of a frame payload, packed 8 to a byte, most
+// significant bit first.
+type Bits [BitsPerPayload / 8]byte
 
 func NewBits(bs *[]Bit) *Bits {
 	var bits Bits
-	copy(bits[:], *bs)
+	for i, b := range (*bs)[:min(len(*bs), BitsPerPayload)] {
+		if b {
+			bits[i/8] |= 0x80 >> (i % 8)
+		}
+	}
 	return &bits
 }
 
+// Get returns bit i.
+func (b *Bits) Get(i int) Bit {
+	return b[i/8]&(0x80>>(i%8)) != 0
+}
+
+// Set sets bit i to v.
+func (b *Bits) Set(i int, v Bit) {
+	if v {
+		b[i/8] |= 0x80 >> (i % 8)
+	} else {
+		b[i/8] &^= 0x80 >> (i % 8)
+	}
+}
+
 type PuncturePattern []Bit
 
 var LSFPuncturePattern = PuncturePattern{
@@ -96,46 +116,6 @@ var StreamPuncturePattern = PuncturePattern{true, true, true, true, true, true,
 
 var PacketPuncturePattern = PuncturePattern{true, true, true, true, true, true, true, false}
 
-// Calculate distance between recent samples and sync patterns
-func syncDistance(symbols []Symbol, offset int) (float32, uint16, error) {
-	var lsf, pkt, stra, strb, str float64
-
-	for i, s := range symbols[offset : 16*5+offset] {
-		if i%5 == 0 {
-			v := float64(s)
-			lsf += (v - ExtLSFSyncSymbols[i/5]) * (v - ExtLSFSyncSymbols[i/5])
-			if i/5 < 8 {
-				pkt += (v - PacketSyncSymbols[i/5]) * (v - PacketSyncSymbols[i/5])
-			}
-			if i/5 > 7 {
-				stra += (v - StreamSyncSymbols[i/5-8]) * (v - StreamSyncSymbols[i/5-8])
-			}
-		}
-	}
-
-	for i, s := range symbols[960+offset : 960+16*5+offset] {
-		if i%5 == 0 {
-			v := float64(s)
-			if i/5 > 7 {
-				stra += (v - StreamSyncSymbols[i/5-8]) * (v - StreamSyncSymbols[i/5-8])
-			}
-		}
-	}
-	lsf = math.Sqrt(lsf)
-	pkt = math.Sqrt(pkt)
-	str = math.Sqrt(stra + strb)
-
-	switch min(lsf, pkt, str) {
-	case lsf:
-		return float32(lsf), LSFSync, nil
-	case pkt:
-		return float32(pkt), PacketSync, nil
-	// case str:
-	default:
-		return float32(str), StreamSync, nil
-	}
-}
-
 func EuclNorm(s1, s2 []Symbol, n int) float64 {
 	var ret float64
 
@@ -198,16 +178,22 @@ var interleaveSequence = [BitsPerPayload]uint16{
 func InterleaveBits(in *Bits) *Bits {
 	var out Bits
 	for i := 0; i < SymbolsPerPayload*2; i++ {
-		out[i] = in[interleaveSequence[i]]
+		if in.Get(int(interleaveSequence[i])) {
+			out[i/8] |= 0x80 >> (i % 8)
+		}
 	}
 	return &out
 }
 func DeinterleaveSoftBits(softBits []SoftBit) []SoftBit {
-	var dSoftBits []SoftBit
-	for i := range SymbolsPerPayload * 2 {
-		dSoftBits = append(dSoftBits, softBits[interleaveSequence[i]])
+	return deinterleaveSoftBits(make([]SoftBit, BitsPerPayload), softBits)
+}
+
+// Deinterleave softBits into dst, which must hold BitsPerPayload soft bits
+func deinterleaveSoftBits(dst, softBits []SoftBit) []SoftBit {
+	for i := range dst[:BitsPerPayload] {
+		dst[i] = softBits[interleaveSequence[i]]
 	}
-	return dSoftBits
+	return dst
 }
 
 var randomizeSeq = []byte{
@@ -219,11 +205,8 @@ var randomizeSeq = []byte{
 }
 
 func RandomizeBits(bits *Bits) *Bits {
-	for i := 0; i < len(bits); i++ {
-		if ((randomizeSeq[i/8] >> (7 - (i % 8))) & 1) != 0 {
-			// flip bit
-			bits[i] = !bits[i]
-		}
+	for i := range bits {
+		bits[i] ^= randomizeSeq[i]
 	}
 	return bits
 }
@@ -238,13 +221,8 @@ func DerandomizeSoftBits(softBits []SoftBit) []SoftBit {
 
 func AppendBits(out []Symbol, data *Bits) []Symbol {
 	for i := 0; i < SymbolsPerPayload; i++ { //40ms * 4800 - 8 (syncword)
-		d := 0
-		if data[2*i+1] {
-			d += 1
-		}
-		if data[2*i] {
-			d += 2
-		}
+		// dibits are packed 4 to a byte
+		d := data[i/4] >> (6 - 2*(i%4)) & 3
 		out = append(out, SymbolMap[d])
 	}
 	return out
@@ -313,18 +291,23 @@ func ConvolutionalEncode(in []byte, puncturePattern PuncturePattern, finalBit by
 	return &out, nil
 }
 
-func ConvolutionalEncodeStream(lichBits []Bit, sd StreamDatagram) (*[]Bit, error) {
-	frame, err := binary.Append(nil, binary.LittleEndian, sd.FrameNumber)
+// ConvolutionalEncodeStream encodes the frame number and payload of a stream frame
+// and appends the result to the already encoded LICH bits. The frame number is
+// sent low byte first, as the Decoder expects.
+func ConvolutionalEncodeStream(lichBits []Bit, fn uint16, payload [StreamPayloadLen]byte) (*[]Bit, error) {
+	frame, err := binary.Append(nil, binary.LittleEndian, fn)
 	if err != nil {
 		return nil, fmt.Errorf("append frame number: %w", err)
 	}
-	frame = append(frame, sd.Payload[:]...)
+	frame = append(frame, payload[:]...)
 	frameBits, err := ConvolutionalEncode(frame, StreamPuncturePattern, 7)
 	bits := append(lichBits, *frameBits...)
 
 	return &bits, err
 }
 
+// ViterbiDecoder decodes convolutionally encoded soft bits. Its buffers are
+// kept between calls, so a ViterbiDecoder that is reused doesn't allocate.
 type ViterbiDecoder struct {
 	history []uint16
 
@@ -332,21 +315,38 @@ type ViterbiDecoder struct {
 	currMetrics     []uint32
 	prevMetricsData []uint32
 	currMetricsData []uint32
+
+	// unpunctured soft bits and decoded output
+	softBits []SoftBit
+	out      []byte
 }
 
+// Init prepares the decoder for l soft bits.
 func (v *ViterbiDecoder) Init(l int) {
-	v.history = make([]uint16, l/2+l%2)
-	v.prevMetrics = make([]uint32, ConvolutionStates)
-	v.currMetrics = make([]uint32, ConvolutionStates)
-	v.prevMetricsData = make([]uint32, ConvolutionStates)
-	v.currMetricsData = make([]uint32, ConvolutionStates)
+	v.history = resize(v.history, l/2+l%2)
+	v.prevMetrics = resize(v.prevMetrics, ConvolutionStates)
+	v.currMetrics = resize(v.currMetrics, ConvolutionStates)
+	clear(v.prevMetrics)
+	clear(v.currMetrics)
+}
+
+// Return s with length n, reusing its storage if it's large enough
+func resize[T any](s []T, n int) []T {
+	if cap(s) < n {
+		return make([]T, n)
+	}
+	return s[:n]
 }
 
+// DecodePunctured decodes soft bits punctured with puncturePattern, returning
+// the decoded bytes and the path metric. The returned bytes are only valid
+// until the next call.
 func (v *ViterbiDecoder) DecodePunctured(puncturedSoftBits []SoftBit, puncturePattern PuncturePattern) ([]byte, float64) {
 	// log.Printf("[DEBUG] DecodePunctured len(puncturedSoftBits): %d, len(puncturePattern): %d", len(puncturedSoftBits), len(puncturePattern))
 	// log.Printf("[DEBUG] puncturedSoftBits: %#v, puncturePattern: %#v", puncturedSoftBits, puncturePattern)
 	// unpuncture input
-	var softBits = make([]SoftBit, 2*len(puncturedSoftBits))
+	v.softBits = resize(v.softBits, 2*len(puncturedSoftBits))
+	softBits := v.softBits
 
 	p := 0
 	u := 0
@@ -386,45 +386,39 @@ func (v *ViterbiDecoder) decode(softBits []SoftBit) ([]byte, uint32) {
 }
 
 func (v *ViterbiDecoder) decodeBit(sb0, sb1 SoftBit, pos int) {
+	prev, curr := v.prevMetrics[:ConvolutionStates], v.currMetrics[:ConvolutionStates]
+	var history uint16
 	for i := 0; i < ConvolutionStates/2; i++ {
 		metric := absDiff(costTable0[i], sb0) + absDiff(costTable1[i], sb1)
 		// log.Printf("[DEBUG] i: %d, sb0: %f, sb1: %f, metric: %f", i, sb0, sb1, metric)
 
-		m0 := v.prevMetrics[i] + metric
-		m1 := v.prevMetrics[i+ConvolutionStates/2] + (0x1FFFE - metric)
+		m0 := prev[i] + metric
+		m1 := prev[i+ConvolutionStates/2] + (0x1FFFE - metric)
 
-		m2 := v.prevMetrics[i] + (0x1FFFE - metric)
-		m3 := v.prevMetrics[i+ConvolutionStates/2] + metric
+		m2 := prev[i] + (0x1FFFE - metric)
+		m3 := prev[i+ConvolutionStates/2] + metric
 
 		i0 := 2 * i
 		i1 := i0 + 1
 
 		if m0 >= m1 {
-			v.history[pos] |= (1 << i0)
-			v.currMetrics[i0] = m1
+			history |= (1 << i0)
+			curr[i0] = m1
 		} else {
-			v.history[pos] &= ^(1 << i0)
-			v.currMetrics[i0] = m0
+			curr[i0] = m0
 		}
 
 		if m2 >= m3 {
-			v.history[pos] |= (1 << i1)
-			v.currMetrics[i1] = m3
+			history |= (1 << i1)
+			curr[i1] = m3
 		} else {
-			v.history[pos] &= ^(1 << i1)
-			v.currMetrics[i1] = m2
+			curr[i1] = m2
 		}
 	}
+	v.history[pos] = history
 
 	//swap
-	tmp := make([]uint32, ConvolutionStates)
-	for i := range ConvolutionStates {
-		tmp[i] = v.currMetrics[i]
-	}
-	for i := range ConvolutionStates {
-		v.currMetrics[i] = v.prevMetrics[i]
-		v.prevMetrics[i] = tmp[i]
-	}
+	v.prevMetrics, v.currMetrics = v.currMetrics, v.prevMetrics
 }
 
 func absDiff(v1, v2 SoftBit) uint32 {
@@ -437,7 +431,9 @@ func absDiff(v1, v2 SoftBit) uint32 {
 func (v *ViterbiDecoder) chainback(pos, l int) ([]byte, uint32) {
 	state := byte(0)
 	bitPos := l + 4
-	out := make([]byte, (l-1)/8+1)
+	v.out = resize(v.out, (l-1)/8+1)
+	out := v.out
+	clear(out)
 
 	for pos > 0 {
 		bitPos--
@@ -4,6 +4,8 @@ import (
 	"math"
 	"reflect"
 	"testing"
+
+	"github.com/icza/gog"
 )
 
 func Test_ConvolutionalEncode(t *testing.T) {
@@ -248,3 +250,53 @@ func TestViterbiDecoder_DecodePunctured(t *testing.T) {
 		})
 	}
 }
+
+func TestConvolutionalEncodeStream_FrameNumber(t *testing.T) {
+	bits := gog.Must(ConvolutionalEncodeStream(make([]Bit, 96), 0x8102, testPayloads(1)[0]))
+	softBits := make([]SoftBit, len(*bits)-96)
+	for i, b := range (*bits)[96:] {
+		if b {
+			softBits[i] = softTrue
+		}
+	}
+	var v ViterbiDecoder
+	frame, _ := v.DecodePunctured(softBits, StreamPuncturePattern)
+	// The frame number's low byte goes first, as the gateway has always sent it
+	if want := []byte{0x02, 0x81}; !reflect.DeepEqual(frame[1:3], want) {
+		t.Errorf("frame number bytes = % x, want % x", frame[1:3], want)
+	}
+}
+
+// streamFrameSoftBits returns the deinterleaved soft bits of a clean stream
+// frame
+func streamFrameSoftBits(b *testing.B) []SoftBit {
+	lsf := testStreamLSF(b)
+	syms := gog.Must(NewStreamEncoder(lsf).EncodeFrame(1, testPayloads(1)[0]))
+	return DeinterleaveSoftBits(DerandomizeSoftBits(calcSoftbits(syms[SymbolsPerSyncword:])))
+}
+
+func BenchmarkViterbiDecoder_DecodePunctured(b *testing.B) {
+	softBits := streamFrameSoftBits(b)[96:]
+	var v ViterbiDecoder
+	b.ReportAllocs()
+	for b.Loop() {
+		v.DecodePunctured(softBits, StreamPuncturePattern)
+	}
+}
+
+func BenchmarkDeinterleaveSoftBits(b *testing.B) {
+	softBits := streamFrameSoftBits(b)
+	b.ReportAllocs()
+	for b.Loop() {
+		DeinterleaveSoftBits(softBits)
+	}
+}
+
+func BenchmarkEncodeBits(b *testing.B) {
+	bits := gog.Must(ConvolutionalEncodeStream(make([]Bit, 96), 1, testPayloads(1)[0]))
+	out := make([]Symbol, 0, SymbolsPerPayload)
+	b.ReportAllocs()
+	for b.Loop() {
+		out = AppendBits(out[:0], RandomizeBits(InterleaveBits(NewBits(bits))))
+	}
+}
@@ -11,9 +11,9 @@ var m17CRCParams = crc16.Params{
 	Name: "M17",
 }
 
+var crcTable = crc16.MakeTable(m17CRCParams)
+
 // Calculate CRC value.
 func CRC(in []byte) uint16 {
-	table := crc16.MakeTable(m17CRCParams)
-
-	return crc16.Checksum(in, table)
+	return crc16.Checksum(in, crcTable)
 }
@@ -71,3 +71,11 @@ func TestCRC(t *testing.T) {
 		})
 	}
 }
+
+func BenchmarkCRC(b *testing.B) {
+	in := make([]byte, LSFLen)
+	b.ReportAllocs()
+	for b.Loop() {
+		CRC(in)
+	}
+}
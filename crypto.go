@@ -0,0 +1,223 @@
+package m17
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The AES nonce fills the LSF META field. The 16 byte CTR mode IV is the nonce
+// followed by the 15 bit frame number.
+const (
+	NonceLen = metaLen
+	ivLen    = aes.BlockSize
+)
+
+// M17 timestamps count seconds from 2020-01-01 00:00 UTC
+var nonceEpoch = time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// NewNonce creates an AES nonce from a 32 bit timestamp and 80 random bits.
+func NewNonce(t time.Time) ([NonceLen]byte, error) {
+	var nonce [NonceLen]byte
+	binary.BigEndian.PutUint32(nonce[:4], uint32(t.Sub(nonceEpoch)/time.Second))
+	_, err := rand.Read(nonce[4:])
+	if err != nil {
+		return nonce, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	return nonce, nil
+}
+
+// Nonce returns the AES nonce carried in the META field.
+func (l *LSF) Nonce() [NonceLen]byte {
+	return l.Meta
+}
+
+// SetNonce puts an AES nonce in the META field. The CRC must be recalculated afterward.
+func (l *LSF) SetNonce(nonce [NonceLen]byte) {
+	l.Meta = nonce
+}
+
+// AESSubtype returns the LSF encryption subtype that matches an AES key's length.
+func AESSubtype(key []byte) (LSFEncryptionSubtype, error) {
+	switch len(key) {
+	case 16:
+		return LSFEncryptionSubtypeAES128, nil
+	case 24:
+		return LSFEncryptionSubtypeAES192, nil
+	case 32:
+		return LSFEncryptionSubtypeAES256, nil
+	}
+	return 0, fmt.Errorf("AES key length %d must be 16, 24 or 32", len(key))
+}
+
+func aesCTR(key []byte, nonce [NonceLen]byte, fn uint16, in []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("create AES cipher: %w", err)
+	}
+	iv := make([]byte, ivLen)
+	copy(iv, nonce[:])
+	// The last frame flag is not part of the counter
+	binary.BigEndian.PutUint16(iv[NonceLen:], fn&frameNumberMask)
+	out := make([]byte, len(in))
+	cipher.NewCTR(block, iv).XORKeyStream(out, in)
+	return out, nil
+}
+
+// AESCryptStreamPayload encrypts or decrypts the payload of the stream frame
+// with frame number fn. CTR mode is symmetric, so the same operation does both.
+func AESCryptStreamPayload(key []byte, nonce [NonceLen]byte, fn uint16, payload [StreamPayloadLen]byte) ([StreamPayloadLen]byte, error) {
+	var ret [StreamPayloadLen]byte
+	out, err := aesCTR(key, nonce, fn, payload[:])
+	if err != nil {
+		return ret, err
+	}
+	copy(ret[:], out)
+	return ret, nil
+}
+
+// AESCryptPacketPayload encrypts or decrypts packet data. The counter starts at
+// zero and advances every 16 bytes.
+func AESCryptPacketPayload(key []byte, nonce [NonceLen]byte, data []byte) ([]byte, error) {
+	return aesCTR(key, nonce, 0, data)
+}
+
+// Encrypt the packet's data with AES. The packet type is left in the clear.
+// The LSF is updated to signal AES encryption and carry the nonce.
+func (p *Packet) Encrypt(key []byte, nonce [NonceLen]byte) error {
+	st, err := AESSubtype(key)
+	if err != nil {
+		return err
+	}
+	if p.LSF.EncryptionType() != LSFEncryptionTypeNone {
+		return fmt.Errorf("packet is already encrypted")
+	}
+	payload, err := AESCryptPacketPayload(key, nonce, p.Payload)
+	if err != nil {
+		return err
+	}
+	p.LSF.SetEncryption(LSFEncryptionTypeAES, st)
+	p.LSF.SetNonce(nonce)
+	p.LSF.CalcCRC()
+	p.Payload = payload
+	pb := p.PayloadBytes()
+	p.CRC = CRC(pb[:len(pb)-2])
+	return nil
+}
+
+// Decrypt the packet's data with AES. The LSF is left unchanged so it still
+// describes the packet as it was sent.
+func (p *Packet) Decrypt(key []byte) error {
+	if p.LSF.EncryptionType() != LSFEncryptionTypeAES {
+		return fmt.Errorf("packet is not AES encrypted")
+	}
+	st, err := AESSubtype(key)
+	if err != nil {
+		return err
+	}
+	if st != p.LSF.EncryptionSubtype() {
+		return fmt.Errorf("key length %d doesn't match encryption subtype %d", len(key), p.LSF.EncryptionSubtype())
+	}
+	payload, err := AESCryptPacketPayload(key, p.LSF.Nonce(), p.Payload)
+	if err != nil {
+		return err
+	}
+	p.Payload = payload
+	pb := p.PayloadBytes()
+	p.CRC = CRC(pb[:len(pb)-2])
+	return nil
+}
+
+// KeyStore holds encryption keys for callsigns and Channel Access Numbers.
+// A key is either a 16, 24 or 32 byte AES key or a 1, 2 or 3 byte big endian
+// scrambler seed. It is safe for concurrent use.
+type KeyStore struct {
+	mu        sync.RWMutex
+	callsigns map[string][]byte
+	cans      map[byte][]byte
+	def       []byte
+}
+
+func NewKeyStore() *KeyStore {
+	return &KeyStore{
+		callsigns: make(map[string][]byte),
+		cans:      make(map[byte][]byte),
+	}
+}
+
+// Keys of 1 to 3 bytes are scrambler seeds, longer ones are AES keys
+func validateKey(key []byte) error {
+	if len(key) <= 3 {
+		_, err := newScramblerFromKey(key)
+		return err
+	}
+	_, err := AESSubtype(key)
+	return err
+}
+
+// AddCallsignKey sets the key used for traffic to or from callsign.
+func (k *KeyStore) AddCallsignKey(callsign string, key []byte) error {
+	callsign = strings.ToUpper(callsign)
+	_, err := EncodeCallsign(callsign)
+	if err != nil {
+		return fmt.Errorf("bad callsign: %w", err)
+	}
+	err = validateKey(key)
+	if err != nil {
+		return err
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.callsigns[callsign] = append([]byte(nil), key...)
+	return nil
+}
+
+// AddCANKey sets the key used for traffic on a Channel Access Number.
+func (k *KeyStore) AddCANKey(can byte, key []byte) error {
+	if can > maxCAN {
+		return fmt.Errorf("CAN %d out of range (0-%d)", can, maxCAN)
+	}
+	err := validateKey(key)
+	if err != nil {
+		return err
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.cans[can] = append([]byte(nil), key...)
+	return nil
+}
+
+// SetDefaultKey sets the key used when no callsign or CAN key matches.
+func (k *KeyStore) SetDefaultKey(key []byte) error {
+	err := validateKey(key)
+	if err != nil {
+		return err
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.def = append([]byte(nil), key...)
+	return nil
+}
+
+// Key finds the key for a transmission. Keys for the source callsign are
+// preferred, followed by the destination callsign, the CAN and finally the
+// default key. It returns nil if there is no matching key.
+func (k *KeyStore) Key(lsf *LSF) []byte {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	if key, ok := k.callsigns[lsf.Src.Callsign()]; ok {
+		return key
+	}
+	if key, ok := k.callsigns[lsf.Dst.Callsign()]; ok {
+		return key
+	}
+	if key, ok := k.cans[lsf.CAN()]; ok {
+		return key
+	}
+	return k.def
+}
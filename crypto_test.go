@@ -0,0 +1,182 @@
+package m17
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/icza/gog"
+)
+
+var testNonce = [NonceLen]byte{0x0b, 0x2c, 0x7e, 0x80, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0a}
+
+func TestNewNonce(t *testing.T) {
+	n1, err := NewNonce(time.Date(2020, time.January, 1, 0, 1, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatalf("NewNonce() error = %v", err)
+	}
+	if !bytes.Equal(n1[:4], []byte{0, 0, 0, 60}) {
+		t.Errorf("NewNonce() timestamp = % x, want 00 00 00 3c", n1[:4])
+	}
+	n2, _ := NewNonce(time.Date(2020, time.January, 1, 0, 1, 0, 0, time.UTC))
+	if n1 == n2 {
+		t.Errorf("NewNonce() returned the same nonce twice")
+	}
+}
+
+func TestAESCryptStreamPayload(t *testing.T) {
+	tests := []struct {
+		name    string
+		keyLen  int
+		wantErr bool
+	}{
+		{"AES-128", 16, false},
+		{"AES-192", 24, false},
+		{"AES-256", 32, false},
+		{"bad key", 15, true},
+	}
+	payload := testPayloads(1)[0]
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key := bytes.Repeat([]byte{0x42}, tt.keyLen)
+			enc, err := AESCryptStreamPayload(key, testNonce, 5, payload)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("AESCryptStreamPayload() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if enc == payload {
+				t.Errorf("AESCryptStreamPayload() didn't change payload")
+			}
+			other, _ := AESCryptStreamPayload(key, testNonce, 6, payload)
+			if other == enc {
+				t.Errorf("AESCryptStreamPayload() same ciphertext for different frame numbers")
+			}
+			last, _ := AESCryptStreamPayload(key, testNonce, 5|LastFrameFlag, payload)
+			if last != enc {
+				t.Errorf("AESCryptStreamPayload() last frame flag changed the counter")
+			}
+			dec, _ := AESCryptStreamPayload(key, testNonce, 5, enc)
+			if dec != payload {
+				t.Errorf("AESCryptStreamPayload() round trip = % x, want % x", dec, payload)
+			}
+		})
+	}
+}
+
+func TestPacket_EncryptDecrypt(t *testing.T) {
+	key := bytes.Repeat([]byte{0x17}, 32)
+	msg := []byte("This message is long enough to need several AES blocks\x00")
+	p := gog.Must(NewPacket("N1ADJ", "N0CALL", PacketTypeSMS, msg))
+	err := p.Encrypt(key, testNonce)
+	if err != nil {
+		t.Fatalf("Packet.Encrypt() error = %v", err)
+	}
+	if p.LSF.EncryptionType() != LSFEncryptionTypeAES || p.LSF.EncryptionSubtype() != LSFEncryptionSubtypeAES256 {
+		t.Errorf("Packet.Encrypt() LSF type = %#v", p.LSF.Type)
+	}
+	if p.LSF.Nonce() != testNonce {
+		t.Errorf("Packet.Encrypt() nonce = % x, want % x", p.LSF.Nonce(), testNonce)
+	}
+	if !p.LSF.CheckCRC() || !p.CheckCRC() {
+		t.Errorf("Packet.Encrypt() bad CRC")
+	}
+	if bytes.Equal(p.Payload, msg) {
+		t.Errorf("Packet.Encrypt() didn't change payload")
+	}
+	if p.Encrypt(key, testNonce) == nil {
+		t.Errorf("Packet.Encrypt() encrypted twice")
+	}
+
+	// Send it over the air
+	received := NewPacketFromBytes(p.ToBytes())
+	if received.Decrypt(key[:16]) == nil {
+		t.Errorf("Packet.Decrypt() accepted key with wrong length")
+	}
+	err = received.Decrypt(key)
+	if err != nil {
+		t.Fatalf("Packet.Decrypt() error = %v", err)
+	}
+	if !bytes.Equal(received.Payload, msg) {
+		t.Errorf("Packet.Decrypt() = %q, want %q", received.Payload, msg)
+	}
+	if !received.CheckCRC() {
+		t.Errorf("Packet.Decrypt() bad CRC")
+	}
+}
+
+func TestKeyStore_Key(t *testing.T) {
+	srcKey := bytes.Repeat([]byte{1}, 16)
+	dstKey := bytes.Repeat([]byte{2}, 24)
+	k := NewKeyStore()
+	if k.AddCallsignKey("N0CALL", srcKey) != nil || k.AddCallsignKey("#club", dstKey) != nil {
+		t.Fatalf("KeyStore.AddCallsignKey() failed")
+	}
+	if k.AddCallsignKey("N1ADJ", []byte{1, 2, 3, 4, 5}) == nil {
+		t.Errorf("KeyStore.AddCallsignKey() accepted bad key")
+	}
+	if k.AddCANKey(16, srcKey) == nil {
+		t.Errorf("KeyStore.AddCANKey() accepted bad CAN")
+	}
+	tests := []struct {
+		name string
+		dst  string
+		src  string
+		want []byte
+	}{
+		{"source", "N1ADJ", "N0CALL", srcKey},
+		{"source before destination", "#CLUB", "N0CALL", srcKey},
+		{"destination", "#CLUB", "N1ADJ", dstKey},
+		{"none", "@ALL", "N1ADJ", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lsf := gog.Must(NewLSF(tt.dst, tt.src, LSFTypeStream, LSFDataTypeVoice, LSFEncryptionTypeNone, 0, 0))
+			if got := k.Key(&lsf); !bytes.Equal(got, tt.want) {
+				t.Errorf("KeyStore.Key() = % x, want % x", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStreamEncoder_AES(t *testing.T) {
+	key := bytes.Repeat([]byte{0x5a}, 16)
+	lsf := gog.Must(NewLSF("#CLUB", "N0CALL", LSFTypeStream, LSFDataTypeVoice, LSFEncryptionTypeNone, 0, 0))
+	e := NewStreamEncoder(lsf)
+	err := e.SetAESKey(key, testNonce)
+	if err != nil {
+		t.Fatalf("StreamEncoder.SetAESKey() error = %v", err)
+	}
+	payloads := testPayloads(8)
+	syms, err := e.Encode(payloads)
+	if err != nil {
+		t.Fatalf("StreamEncoder.Encode() error = %v", err)
+	}
+	for _, withKey := range []bool{false, true} {
+		d := NewDecoder(nil)
+		if withKey {
+			d.Keys = NewKeyStore()
+			d.Keys.AddCallsignKey("#CLUB", key)
+		}
+		var got [][]byte
+		d.DecodeSymbols(&DummyModem{In: symbolReader(t, syms)}, func(e Event) {
+			f, ok := e.(StreamFrameEvent)
+			if !ok {
+				return
+			}
+			if f.LSF.EncryptionType() != LSFEncryptionTypeAES || f.LSF.Nonce() != testNonce {
+				t.Errorf("decoded LSF %v", f.LSF)
+			}
+			got = append(got, bytes.Clone(f.Payload))
+		})
+		if len(got) == 0 {
+			t.Fatalf("no frames decoded")
+		}
+		for i := range got {
+			if bytes.Equal(got[i], payloads[i][:]) != withKey {
+				t.Errorf("frame %d with key %v payload = % x", i, withKey, got[i])
+			}
+		}
+	}
+}
@@ -1,11 +1,13 @@
 package m17
 
 import (
+	"bytes"
 	"encoding/binary"
 	"fmt"
 	"io"
 	"log"
 	"log/slog"
+	"math"
 	"math/rand"
 )
 
@@ -27,6 +29,21 @@ var (
 )
 
 type Decoder struct {
+	// Keys, if set, is used to decrypt encrypted payloads before they are passed on.
+	// Leave it nil when forwarding traffic to the network.
+	Keys *KeyStore
+	// Signers, if set, holds the keys used to verify signed streams.
+	Signers *SignerRegistry
+	// LSFVersion is the TYPE field layout of received LSFs. The default,
+	// LSFVersionAuto, detects it from each LSF.
+	LSFVersion LSFVersion
+	// SamplesPerSymbol is the rate of the input samples, which needn't be a
+	// whole number. Zero means 5, the rate of the CC1200 modem's 24 kHz.
+	SamplesPerSymbol float64
+	// SyncThresholds sets how closely syncwords must match to be detected.
+	// Zero fields take their values from DefaultSyncThresholds.
+	SyncThresholds SyncThresholds
+
 	syncedType uint16
 
 	lsf *LSF
@@ -34,6 +51,14 @@ type Decoder struct {
 	frameData  []byte //decoded frame data, 206 bits, plus 4 flushing bits
 	packetData []byte //whole packet data
 
+	// buffers reused for every frame
+	pld      [SymbolsPerPayload]Symbol
+	softBit  [BitsPerPayload]SoftBit
+	dSoftBit [BitsPerPayload]SoftBit
+	vd       ViterbiDecoder
+	// converts payload symbols to soft bits, so tests can compare mappings
+	softbits func(softBit []SoftBit, pld []Symbol) []SoftBit
+
 	timeoutCnt   int
 	gotLSF       bool
 	lastPacketFN int // last packet frame number received (-1 when idle)
@@ -43,12 +68,32 @@ type Decoder struct {
 	streamFN     uint16
 	lsfBytes     []byte
 	dashLog      *slog.Logger
+	// receives events during DecodeSymbols
+	handler func(Event)
+	// quality of the packet being received
+	packetQuality Quality
+	// received symbol level relative to nominal, zero until estimated, and
+	// offset in symbol units
+	level  float32
+	offset float32
+	// standard error of the offset estimate, from the noise in the first frame
+	offsetError float32
+
+	// scrambler for the current stream, created from Keys on the first frame
+	scrambler *Scrambler
+	// Text Data META being received and the last complete text
+	metaText MetaText
+	text     string
+	// digest and signature of the current stream
+	sig signatureReceiver
+	// totals for the current BERT reception
+	bert BERTReceiver
 }
 
 // 8 preamble symbols, 8 for the syncword, and 960 for the payload.
-// floor(sps/2)=2 extra samples for timing error correction
+// sps-1=4 extra samples for timing error correction
 // plus some extra so we can make larger reads
-const symbolBufSize = 8*5 + 2*(8*5+4800/25*5) + 2 + 256
+const symbolBufSize = 8*5 + 2*(8*5+4800/25*5) + 4 + 256
 
 func NewDecoder(dashLog *slog.Logger) *Decoder {
 	d := Decoder{
@@ -56,12 +101,26 @@ func NewDecoder(dashLog *slog.Logger) *Decoder {
 		lastStreamFN: -1,
 		lsfBytes:     make([]byte, 30),
 		dashLog:      dashLog,
+		softbits:     fillSoftbits,
 	}
 	return &d
 }
-func (d *Decoder) DecodeSymbols(in io.Reader, sendToNetwork func(lsf *LSF, payload []byte, sid, fn uint16) error) error {
+
+// DecodeSymbols decodes the symbols read from in, passing what it finds to
+// handler as Events, until in returns an error.
+func (d *Decoder) DecodeSymbols(in io.Reader, handler func(Event)) error {
 	var symbols []Symbol
 	var err error
+	d.handler = handler
+	sps := d.SamplesPerSymbol
+	if sps == 0 {
+		sps = decoderSamplesPerSymbol
+	}
+	in, err = newTimingReader(in, sps)
+	if err != nil {
+		return err
+	}
+	th := d.SyncThresholds.withDefaults()
 
 	for {
 		l := len(symbols)
@@ -79,58 +138,74 @@ func (d *Decoder) DecodeSymbols(in io.Reader, sendToNetwork func(lsf *LSF, paylo
 		}
 
 		// Looking for a sync burst
-		//calculate euclidean norm
-		dist, typ, err := syncDistance(symbols, 0)
-		if err == io.EOF {
-			return err
-		}
-		// if dist < 10 {
-		// 	log.Printf("[DEBUG] dist: %3.5f, typ: %x", dist, typ)
+		m := bestSync(symbols, d.correction(), d.level != 0)
+		// if m.corr > 0.5 {
+		// 	log.Printf("[DEBUG] corr: %1.3f, typ: %x", m.corr, m.typ)
 		// }
 		switch {
-		case typ == LSFSync && dist < 4.5 && d.syncedType == 0:
-			log.Printf("[DEBUG] Received LSFSync, distance: %f, type: %x", dist, typ)
+		case m.typ == LSFSync && m.corr >= th.LSF && d.syncedType == 0:
+			log.Printf("[DEBUG] Received LSFSync, correlation: %1.3f, level: %1.2f", m.corr, m.level)
 			var pld []Symbol
-			symbols, pld, _, err = d.extractPayload(dist, typ, symbols)
-			if err == io.EOF {
-				return err
-				// } else if err != nil {
-				// 	// Was logged in extractPayload
-			}
+			// A new transmission may have a different level
+			d.level = 0
+			symbols, pld, m = d.extractPayload(m, symbols)
 			d.gotLSF = false
-			d.lsf = decodeLSF(pld)
+			var vd float64
+			d.lsf, vd = d.decodeLSF(pld)
+			d.lsf.assumeVersion(d.LSFVersion)
+			// Some TYPE values are a stream in one layout and a packet in the
+			// other, so check which kind of frame follows
+			if nextSyncword(symbols, 40*5) == StreamSync {
+				d.lsf.assumeType(LSFTypeStream)
+			} else {
+				d.lsf.assumeType(LSFTypePacket)
+			}
+			d.scrambler = nil
 			log.Printf("[DEBUG] Received RF LSF: %s", d.lsf)
-			if d.lsf.CheckCRC() {
+			lsfEvent := LSFEvent{LSF: d.lsf, CRCValid: d.lsf.CheckCRC(), Quality: d.quality(m, vd)}
+			if lsfEvent.CRCValid {
+				if err := d.lsf.ValidateType(); err != nil {
+					log.Printf("[DEBUG] Received LSF with bad TYPE: %v", err)
+				}
 				d.gotLSF = true
 				d.timeoutCnt = 0
 				d.lastStreamFN = -1
 				d.lastPacketFN = -1
 
-				if d.lsf.Type[1]&byte(LSFTypeStream) == byte(LSFTypeStream) {
+				if d.lsf.LSFType() == LSFTypeStream {
 					d.syncedType = StreamSync
-					d.lichParts = 0x3F
+					// Keep collecting LICH chunks to follow changes to the META field
+					d.lichParts = 0
+					d.resetText()
+					d.sig.reset()
+					d.addText(d.lsf)
 					d.streamFN = 0
-					d.streamID = uint16(rand.Intn(0x10000))
-					sendToNetwork(d.lsf, nil, d.streamID, d.streamFN)
+					d.streamID = d.newStreamID()
+					lsfEvent.StreamID = d.streamID
+					d.emit(lsfEvent)
 					if d.dashLog != nil {
-						d.dashLog.Info("", "type", "RF", "subtype", "Voice Start", "src", d.lsf.Src.Callsign(), "dst", d.lsf.Dst.Callsign(), "can", d.lsf.CAN())
+						d.dashLog.Info("", d.lsf.dashAttrs("RF", "Voice Start")...)
 					}
 				} else { // packet mode
 					d.syncedType = PacketSync
 					d.packetData = make([]byte, 33*25)
+					d.packetQuality = Quality{SyncCorrelation: 1}
+					d.emit(lsfEvent)
 				}
 			} else {
 				log.Print("[DEBUG] Bad LSF CRC")
+				d.emit(lsfEvent)
 			}
 
-		case typ == PacketSync && dist < 5.0 && d.syncedType == PacketSync:
+		case m.typ == PacketSync && d.frameSync(m, symbols, th) && d.syncedType == PacketSync:
 			var pld []Symbol
-			log.Printf("[DEBUG] Received PacketSync, distance: %f, type: %x", dist, typ)
-			symbols, pld, _, err = d.extractPayload(dist, typ, symbols)
-			if err != nil {
-				return err
-			}
+			log.Printf("[DEBUG] Received PacketSync, correlation: %1.3f, level: %1.2f", m.corr, m.level)
+			symbols, pld, m = d.extractPayload(m, symbols)
 			pktFrame, e := d.decodePacketFrame(pld)
+			d.packetQuality.SyncCorrelation = min(d.packetQuality.SyncCorrelation, m.corr)
+			d.packetQuality.Level = d.level
+			d.packetQuality.FrequencyOffset = d.frequencyOffset()
+			d.packetQuality.ViterbiError += e
 			// log.Printf("[DEBUG] pktFrame: % x", pktFrame)
 			lastFrame := (pktFrame[25] >> 7) != 0
 
@@ -162,65 +237,110 @@ func (d *Decoder) DecodeSymbols(in io.Reader, sendToNetwork func(lsf *LSF, paylo
 				// fprintf(stderr, " \033[93mContent\033[39m\n");
 				if CRC(d.packetData) == 0 {
 					// log.Printf("[DEBUG] d.lsf: %v, d.packetData: %v", d.lsf, d.packetData)
-					sendToNetwork(d.lsf, d.packetData, 0, 0)
+					d.emit(PacketEvent{LSF: d.lsf, Payload: d.decryptPacket(d.packetData), Quality: d.packetQuality})
 					if d.dashLog != nil {
-						d.dashLog.Info("", "type", "RF", "subtype", "Packet", "src", d.lsf.Src.Callsign(), "dst", d.lsf.Dst.Callsign(), "can", d.lsf.CAN())
+						d.dashLog.Info("", d.lsf.dashAttrs("RF", "Packet")...)
 					}
 				} else {
-					log.Printf("[DEBUG] Bad CRC not forwarded: %x", CRC(d.packetData))
+					log.Printf("[DEBUG] Bad packet CRC: %x", CRC(d.packetData))
+					d.emit(PacketCRCErrorEvent{LSF: d.lsf, Payload: d.packetData, Quality: d.packetQuality})
 				}
 				// cleanup
 				d.resetPacket()
 			}
 
-		case typ == StreamSync && dist < 5.0:
+		case m.typ == StreamSync && d.frameSync(m, symbols, th):
 			var pld []Symbol
-			log.Printf("[DEBUG] Received StreamSync, distance: %f, type: %x", dist, typ)
-			symbols, pld, _, err = d.extractPayload(dist, typ, symbols)
-			if err != nil {
-				return err
-			}
+			log.Printf("[DEBUG] Received StreamSync, correlation: %1.3f, level: %1.2f", m.corr, m.level)
+			symbols, pld, m = d.extractPayload(m, symbols)
 			var lich []byte
 			var lichCnt byte
 			var vd float64
 			var fn uint16
 			d.frameData, lich, fn, lichCnt, vd = d.decodeStreamFrame(pld)
-			// log.Printf("[DEBUG] frameData: [% 2x], lich: %x, lichCnt: %d, fn: %x, FN: %d, vd: %1.1f", d.frameData, lich, lichCnt, fn, (fn>>8)|((fn&0xFF)<<8), vd)
+			// log.Printf("[DEBUG] frameData: [% 2x], lich: %x, lichCnt: %d, fn: %x, vd: %1.1f", d.frameData, lich, lichCnt, fn, vd)
 
 			if d.lastStreamFN != int(fn) {
-				if d.lichParts != 0x3F && lichCnt < 6 { //6 chunks = 0b111111
+				if lichCnt < 6 {
+					if d.gotLSF && lichCnt == 0 {
+						// The META field can change each superframe, so
+						// reconstruct whole superframes once we're synced
+						d.lichParts = 0
+					}
 					//reconstruct LSF chunk by chunk
 					copy(d.lsfBytes[lichCnt*5:lichCnt*5+5], lich)
 					d.lichParts |= (1 << lichCnt)
-					if d.lichParts == 0x3F && !d.gotLSF {
+					if d.lichParts == 0x3F { //6 chunks = 0b111111
+						d.lichParts = 0
 						lsfB := NewLSFFromBytes(d.lsfBytes)
+						lsfB.assumeVersion(d.LSFVersion)
+						lsfB.assumeType(LSFTypeStream)
 						if lsfB.CheckCRC() {
-							d.lsf = &lsfB
-							d.gotLSF = true
-							d.timeoutCnt = 0
-							d.streamID = uint16(rand.Intn(0x10000))
-							log.Printf("[DEBUG] Received stream LSF: %v", lsfB)
+							if !d.gotLSF {
+								d.lsf = &lsfB
+								d.scrambler = nil
+								d.gotLSF = true
+								d.syncedType = StreamSync
+								d.timeoutCnt = 0
+								d.streamID = d.newStreamID()
+								d.resetText()
+								d.sig.reset()
+								log.Printf("[DEBUG] Received stream LSF: %v", lsfB)
+								d.emit(LSFEvent{LSF: d.lsf, CRCValid: true, FromLICH: true, StreamID: d.streamID, Quality: d.quality(m, vd)})
+							}
+							d.addText(&lsfB)
 						} else {
 							log.Printf("[DEBUG] Stream LSF CRC error: %v", lsfB)
-							d.lichParts = 0
-							d.gotLSF = false
+							// The chunks may have come from two LSFs with different META
+							// fields. Keep the ones from this superframe and try again.
+							d.lichParts = 1<<(lichCnt+1) - 1
 						}
 					}
 				}
 				log.Printf("[DEBUG] Received stream frame: FN:%04X, LICH_CNT:%d, Viterbi error: %1.1f", fn, lichCnt, vd)
 				if d.gotLSF {
 					// log.Printf("[DEBUG] Sending stream frame")
-					// Not sure why we have to flip the bytes here
-					d.streamFN = (fn >> 8) | ((fn & 0xFF) << 8)
-					sendToNetwork(d.lsf, d.frameData, d.streamID, d.streamFN)
+					d.streamFN = fn
+					ev := StreamFrameEvent{
+						LSF:         d.lsf,
+						StreamID:    d.streamID,
+						FrameNumber: fn,
+						Payload:     d.frameData,
+						Signature:   d.lsf.Signed() && isSignatureFrame(fn),
+						LICHCount:   int(lichCnt),
+						Quality:     d.quality(m, vd),
+					}
+					if d.lsf.Signed() {
+						d.sig.addFrame(fn, d.frameData)
+					}
+					if !ev.Signature {
+						ev.Payload = d.decryptStreamFrame(d.frameData, fn)
+					}
+					d.emit(ev)
 					d.timeoutCnt = 0
-					// This doesn't work because the high bit is never set in actual frams received from my CS7000
-					if d.dashLog != nil && fn&0x8000 == 0x8000 {
-						d.dashLog.Info("", "type", "RF", "subtype", "Voice End", "src", d.lsf.Src.Callsign(), "dst", d.lsf.Dst.Callsign(), "can", d.lsf.CAN())
+					// Some radios, like the CS7000, never set the last frame flag, so EOT
+					// or a timeout ends those streams
+					if fn&LastFrameFlag == LastFrameFlag {
+						d.streamEnd()
 					}
 				}
 				d.lastStreamFN = int(fn)
 			}
+		case m.typ == BERTSync && d.frameSync(m, symbols, th):
+			var pld []Symbol
+			symbols, pld, m = d.extractPayload(m, symbols)
+			data, vd := d.decodeBERTFrame(pld)
+			d.syncedType = BERTSync
+			d.timeoutCnt = 0
+			d.bert.AddFrame(data)
+			stats := d.bert.Stats()
+			log.Printf("[DEBUG] Received BERT frame, Viterbi error: %1.1f, %s", vd, stats)
+			d.emit(BERTEvent{Stats: stats, Quality: d.quality(m, vd)})
+		case m.typ == EOTMarker && m.corr >= th.EOT:
+			log.Printf("[DEBUG] Received EOT, correlation: %1.3f, synced type: %x", m.corr, d.syncedType)
+			d.endOfTransmission()
+			// Skip most of the marker, so its repeating pattern isn't found again
+			symbols = symbols[(SymbolsPerFrame-2)*5:]
 		default:
 			// No one read anything, so advance one symbol
 			symbols = symbols[1:]
@@ -230,31 +350,47 @@ func (d *Decoder) DecodeSymbols(in io.Reader, sendToNetwork func(lsf *LSF, paylo
 		if d.syncedType != 0 {
 			d.timeoutCnt++
 			if d.timeoutCnt > 960*2 {
-				d.syncedType = 0
-				d.timeoutCnt = 0
-				d.lastStreamFN = -1
-				d.lastPacketFN = -1
-				d.lichParts = 0
-				d.gotLSF = false
-				d.resetPacket()
+				log.Printf("[DEBUG] Lost sync, type: %x", d.syncedType)
+				d.emit(SyncLostEvent{SyncType: d.syncedType})
+				d.reset()
 			}
 		}
 	}
 }
 
-func (d *Decoder) extractPayload(dist float32, typ uint16, symbols []Symbol) ([]Symbol, []Symbol, float32, error) {
-	offset := 0
-	for i := range 2 {
-		d, t, err := syncDistance(symbols, i+1)
-		if err == io.EOF {
-			log.Printf("extractPayload syncDistance EOF")
-			return nil, nil, 0, err
-		} else if err != nil {
-			// TODO: return error here?
-			log.Printf("extractPayload syncDistance failed: %v", err)
+// Report whether the frame syncword match m at the start of symbols is
+// accepted. A match confirmed by the syncword or EOT marker after the frame
+// needs th.Frame. Once the decoder is synced to that kind of frame, a match on
+// its own is accepted at th.LoneFrame, so the frame before a lost one or the
+// last one before a missed EOT marker isn't dropped. That may be a partial
+// match just before the real syncword, so it's only accepted if no better or
+// confirmed one starts within the sync window.
+func (d *Decoder) frameSync(m syncMatch, symbols []Symbol, th SyncThresholds) bool {
+	switch {
+	case m.corr >= th.Frame && m.next >= th.Frame:
+		return true
+	case m.corr < th.LoneFrame || m.typ != d.syncedType:
+		return false
+	}
+	for i := range syncWindow * decoderSamplesPerSymbol {
+		if c := syncCorrelation(symbols, i+1, d.correction(), d.level != 0); c.typ == m.typ && (c.corr > m.corr || c.corr >= th.Frame && c.next >= th.Frame) {
+			return false
 		}
-		if t == typ && d < dist {
-			dist = d
+	}
+	return true
+}
+
+// Extract the payload following a sync match, adjusting the timing to the
+// sample that best matches the syncword and correcting the payload symbols
+// for the received level and offset
+func (d *Decoder) extractPayload(m syncMatch, symbols []Symbol) ([]Symbol, []Symbol, syncMatch) {
+	// Timing recovery puts a symbol center on one of the next 5 samples
+	confirmed := m.next >= d.SyncThresholds.withDefaults().Frame
+	offset := 0
+	for i := range decoderSamplesPerSymbol - 1 {
+		c := syncCorrelation(symbols, i+1, d.correction(), d.level != 0)
+		if c.typ == m.typ && c.placement(confirmed) > m.placement(confirmed) {
+			m = c
 			offset = i + 1
 		}
 	}
@@ -262,24 +398,68 @@ func (d *Decoder) extractPayload(dist float32, typ uint16, symbols []Symbol) ([]
 	symbols = symbols[offset:]
 	// skip past sync
 	syncSize := 16
-	if typ == PacketSync {
+	if m.typ == PacketSync {
 		syncSize = 8
 	}
 	symbols = symbols[syncSize*5:]
-	pld := make([]Symbol, SymbolsPerPayload)
+	first := d.level == 0
+	if first {
+		d.level = m.level
+		d.offset = m.offset
+	} else {
+		d.level += levelAlpha * (m.level - d.level)
+		d.offset += offsetAlpha * (m.offset - d.offset)
+	}
+	pld := d.pld[:]
+	if first {
+		// A few syncword symbols give a rough offset, so refine it from
+		// where the payload symbols fall
+		for i := range pld {
+			pld[i] = (symbols[i*5] - Symbol(d.offset)) / Symbol(d.level)
+		}
+		_, variance := symbolStats(pld)
+		d.offset += float32(symbolOffset(pld, variance)) * d.level
+		d.offsetError = float32(math.Sqrt(variance/float64(len(pld)))) * d.level
+	}
+	c := d.correction()
 	for i := range pld {
-		pld[i] = symbols[i*5]
+		pld[i] = (symbols[i*5] - Symbol(c)) / Symbol(d.level)
 	}
 	// log.Printf("[DEBUG] pld: % .2f", pld)
 	// skip by most, but not all of the payload
 	// if we skip everything we miss the next packet for some reason.
 	symbols = symbols[(SymbolsPerPayload-offset-syncSize)*5:]
-	return symbols, pld, dist, nil
+	return symbols, pld, m
+}
+
+// Quality of a frame received with sync match m and Viterbi error vd
+func (d *Decoder) quality(m syncMatch, vd float64) Quality {
+	return Quality{
+		SyncCorrelation: m.corr,
+		Level:           d.level,
+		FrequencyOffset: d.frequencyOffset(),
+		ViterbiError:    vd,
+	}
+}
+
+// The offset subtracted from the samples. Correcting for an offset that noise
+// can't be told from costs more than it gains, so it's zero until the
+// estimate is significant.
+func (d *Decoder) correction() float32 {
+	if math.Abs(float64(d.offset)) <= offsetSignificance*float64(d.offsetError) {
+		return 0
+	}
+	return d.offset
+}
+
+// Carrier frequency offset in Hz, from the offset of the received symbols
+func (d *Decoder) frequencyOffset() float32 {
+	return d.offset * symbolDeviation
 }
 
-func decodeLSF(pld []Symbol) *LSF {
+func (d *Decoder) decodeLSF(pld []Symbol) (*LSF, float64) {
 	// log.Printf("[DEBUG] decodeLSF: len(pld): %d", len(pld))
-	softBit := calcSoftbits(pld)
+	softBit := d.softbits(d.softBit[:], pld)
 	// log.Printf("[DEBUG] softBit: %#v", softBit)
 
 	//derandomize
@@ -287,12 +467,11 @@ func decodeLSF(pld []Symbol) *LSF {
 	// log.Printf("[DEBUG] derandomized softBit: %#v", softBit)
 
 	//deinterleave
-	dSoftBit := DeinterleaveSoftBits(softBit)
+	dSoftBit := deinterleaveSoftBits(d.dSoftBit[:], softBit)
 	// log.Printf("[DEBUG] dSoftBit: %#v", dSoftBit)
 
 	//decode
-	vd := ViterbiDecoder{}
-	lsf, e := vd.DecodePunctured(dSoftBit, LSFPuncturePattern)
+	lsf, e := d.vd.DecodePunctured(dSoftBit, LSFPuncturePattern)
 
 	//shift the buffer 1 position left - get rid of the encoded flushing bits
 	// copy(lsf, lsf[1:])
@@ -313,14 +492,14 @@ func decodeLSF(pld []Symbol) *LSF {
 	}
 	log.Printf("[DEBUG] LSF Viterbi error: %1.1f", e/softTrue)
 	l := NewLSFFromBytes(lsf)
-	return &l
+	return &l, e / softTrue
 }
 
 func (d *Decoder) decodeStreamFrame(pld []Symbol) (frameData []byte, lich []byte, fn uint16, lichCnt byte, e float64) {
 	// log.Printf("[DEBUG] decodeStreamFrame: len(pld): %d", len(pld))
 	// log.Printf("[DEBUG] pld: [% 1.1f]", pld)
 
-	softBit := calcSoftbits(pld)
+	softBit := d.softbits(d.softBit[:], pld)
 	// log.Printf("[DEBUG] softBit: [% 04x]", softBit)
 
 	//derandomize
@@ -328,19 +507,21 @@ func (d *Decoder) decodeStreamFrame(pld []Symbol) (frameData []byte, lich []byte
 	// log.Printf("[DEBUG] derandomized softBit: [% 04x]", softBit)
 
 	//deinterleave
-	dSoftBit := DeinterleaveSoftBits(softBit)
+	dSoftBit := deinterleaveSoftBits(d.dSoftBit[:], softBit)
 	// log.Printf("[DEBUG] deinterleaved softBit: [% 04x]", dSoftBit)
 	lich = DecodeLICH(dSoftBit[:96])
 	lichCnt = lich[5] >> 5
 
 	//decode
-	vd := ViterbiDecoder{}
-	frameData, e = vd.DecodePunctured(dSoftBit[96:], StreamPuncturePattern)
+	frameData, e = d.vd.DecodePunctured(dSoftBit[96:], StreamPuncturePattern)
 
-	fn = (uint16(frameData[1]) << 8) | uint16(frameData[2])
+	// Low byte first, as ConvolutionalEncodeStream sends it
+	fn = uint16(frameData[1]) | (uint16(frameData[2]) << 8)
 
 	//shift 1+2 positions left - get rid of the encoded flushing bits and FN
-	frameData = frameData[1+2:]
+	//copy, since the Viterbi decoder's buffer is reused and the payload is
+	//passed on in an event
+	frameData = bytes.Clone(frameData[1+2:])
 
 	return frameData, lich, fn, lichCnt, e / softTrue
 }
@@ -349,7 +530,7 @@ func (d *Decoder) decodePacketFrame(pld []Symbol) ([]byte, float64) {
 	// log.Printf("[DEBUG] decodePacketFrame: len(pld): %d", len(pld))
 	// log.Printf("[DEBUG] pld: %#v", pld)
 
-	softBit := calcSoftbits(pld)
+	softBit := d.softbits(d.softBit[:], pld)
 	// log.Printf("[DEBUG] softBit: %#v", softBit)
 
 	//derandomize
@@ -357,48 +538,179 @@ func (d *Decoder) decodePacketFrame(pld []Symbol) ([]byte, float64) {
 	// log.Printf("[DEBUG] derandomized softBit: %#v", softBit)
 
 	//deinterleave
-	dSoftBit := DeinterleaveSoftBits(softBit)
+	dSoftBit := deinterleaveSoftBits(d.dSoftBit[:], softBit)
 	// log.Printf("[DEBUG] dSoftBit: %#v", dSoftBit)
 
 	//decode
-	vd := ViterbiDecoder{}
-	pkt, e := vd.DecodePunctured(dSoftBit, PacketPuncturePattern)
+	pkt, e := d.vd.DecodePunctured(dSoftBit, PacketPuncturePattern)
 	// log.Printf("[DEBUG] pkt: %#v", pkt)
 
 	return pkt[1:], e / softTrue
 }
 
-func calcSoftbits(pld []Symbol) []SoftBit {
-	if len(pld) > SymbolsPerPayload {
-		panic(fmt.Sprintf("pld contains %d symbols (>%d)", len(pld), SymbolsPerPayload))
+func (d *Decoder) decodeBERTFrame(pld []Symbol) ([]byte, float64) {
+	softBit := d.softbits(d.softBit[:], pld)
+	softBit = DerandomizeSoftBits(softBit)
+	dSoftBit := deinterleaveSoftBits(d.dSoftBit[:], softBit)
+	data, e := d.vd.DecodePunctured(dSoftBit, StreamPuncturePattern)
+	return data[1:], e / softTrue
+}
+
+// Return the AES or scrambler key for the current transmission, or nil if it
+// isn't encrypted with type et or there's no key for it
+func (d *Decoder) key(et LSFEncryptionType) []byte {
+	if d.Keys == nil || d.lsf == nil || d.lsf.EncryptionType() != et {
+		return nil
+	}
+	key := d.Keys.Key(d.lsf)
+	if key == nil {
+		log.Printf("[DEBUG] No key for encrypted transmission from %s", d.lsf.Src.Callsign())
+	}
+	return key
+}
+
+func (d *Decoder) decryptStreamFrame(frameData []byte, fn uint16) []byte {
+	var payload [StreamPayloadLen]byte
+	copy(payload[:], frameData)
+	switch d.lsf.EncryptionType() {
+	case LSFEncryptionTypeAES:
+		key := d.key(LSFEncryptionTypeAES)
+		if key == nil {
+			return frameData
+		}
+		payload, err := AESCryptStreamPayload(key, d.lsf.Nonce(), fn, payload)
+		if err != nil {
+			log.Printf("[ERROR] Failed to decrypt stream frame: %v", err)
+			return frameData
+		}
+		return payload[:]
+	case LSFEncryptionTypeScrambler:
+		if d.scrambler == nil {
+			key := d.key(LSFEncryptionTypeScrambler)
+			if key == nil {
+				return frameData
+			}
+			s, err := newScramblerFromKey(key)
+			if err != nil {
+				log.Printf("[ERROR] Failed to descramble stream frame: %v", err)
+				return frameData
+			}
+			if s.Subtype() != d.lsf.EncryptionSubtype() {
+				log.Printf("[ERROR] Scrambler seed length %d doesn't match encryption subtype %d", len(key), d.lsf.EncryptionSubtype())
+				return frameData
+			}
+			d.scrambler = s
+		}
+		payload = d.scrambler.CryptStreamPayload(fn, payload)
+		return payload[:]
+	}
+	return frameData
+}
+
+func (d *Decoder) decryptPacket(packetData []byte) []byte {
+	key := d.key(LSFEncryptionTypeAES)
+	if key == nil {
+		return packetData
+	}
+	p := NewPacketFromBytes(append(d.lsf.ToBytes(), packetData...))
+	p.LSF = *d.lsf
+	err := p.Decrypt(key)
+	if err != nil {
+		log.Printf("[ERROR] Failed to decrypt packet: %v", err)
+		return packetData
+	}
+	return p.PayloadBytes()
+}
+
+// Finish a stream, checking its signature if it's signed
+func (d *Decoder) streamEnd() {
+	ev := StreamEndEvent{LSF: d.lsf, StreamID: d.streamID, FrameNumber: d.streamFN}
+	var attrs []any
+	if d.lsf.Signed() {
+		result := d.sig.verify(d.lsf, d.Signers)
+		log.Printf("[INFO] Stream from %s signature: %s", d.lsf.Originator(), result)
+		ev.Signature = result
+		attrs = append(attrs, "signature", result.Status.String())
+		if result.Signer != "" {
+			attrs = append(attrs, "signer", result.Signer)
+		}
+	}
+	d.emit(ev)
+	if d.dashLog != nil {
+		d.dashLog.Info("", append(d.lsf.dashAttrs("RF", "Voice End"), attrs...)...)
 	}
-	softBit := make([]SoftBit, 2*SymbolsPerPayload) //raw frame soft bits
-
-	for i, sym := range pld {
-
-		//bit 0
-		if sym >= SymbolList[3] {
-			softBit[i*2+1] = softTrue
-		} else if sym >= SymbolList[2] {
-			softBit[i*2+1] = SoftBit(-softTrue/((SymbolList[3]-SymbolList[2])*SymbolList[2]) + sym*softTrue/(SymbolList[3]-SymbolList[2]))
-		} else if sym >= SymbolList[1] {
-			softBit[i*2+1] = softFalse
-		} else if sym >= SymbolList[0] {
-			softBit[i*2+1] = SoftBit(softTrue/((SymbolList[1]-SymbolList[0])*SymbolList[1]) - sym*softTrue/(SymbolList[1]-SymbolList[0]))
-		} else {
-			softBit[i*2+1] = softTrue
+	d.reset()
+}
+
+// Pick a random ID for a new stream. It's never zero and always differs from
+// the last one, so back to back streams can be told apart.
+func (d *Decoder) newStreamID() uint16 {
+	for {
+		id := uint16(rand.Intn(0x10000))
+		if id != 0 && id != d.streamID {
+			return id
 		}
+	}
+}
 
-		//bit 1
-		if sym >= SymbolList[2] {
-			softBit[i*2] = softFalse
-		} else if sym >= SymbolList[1] {
-			softBit[i*2] = SoftBit(softMaybe - (sym * softTrue / (SymbolList[2] - SymbolList[1])))
-		} else {
-			softBit[i*2] = softTrue
+// Close whatever is being received when an EOT marker arrives
+func (d *Decoder) endOfTransmission() {
+	typ := d.syncedType
+	switch typ {
+	case StreamSync:
+		if d.gotLSF {
+			d.streamEnd()
 		}
+	case PacketSync:
+		log.Printf("[DEBUG] EOT before end of packet, %d frames received", d.lastPacketFN+1)
 	}
-	return softBit
+	d.reset()
+	d.emit(EOTEvent{SyncType: typ})
+}
+
+// Return to looking for a new transmission
+func (d *Decoder) reset() {
+	d.syncedType = 0
+	d.timeoutCnt = 0
+	d.lastStreamFN = -1
+	d.lastPacketFN = -1
+	d.lichParts = 0
+	d.gotLSF = false
+	d.level = 0
+	d.offset = 0
+	d.offsetError = 0
+	d.resetText()
+	d.resetPacket()
+	if d.bert.Stats().Frames > 0 {
+		log.Printf("[INFO] BERT ended, %s", d.bert.Stats())
+		d.bert.Reset()
+	}
+}
+
+// Pass an event to the handler
+func (d *Decoder) emit(e Event) {
+	if d.handler != nil {
+		d.handler(e)
+	}
+}
+
+// Add a Text Data META block, reporting the text when it's complete
+func (d *Decoder) addText(lsf *LSF) {
+	text, ok := d.metaText.Add(lsf)
+	if !ok || text == d.text {
+		return
+	}
+	d.text = text
+	log.Printf("[INFO] Received text from %s: %s", lsf.Src.Callsign(), text)
+	d.emit(TextEvent{LSF: lsf, Text: text})
+	if d.dashLog != nil {
+		d.dashLog.Info("", append(lsf.dashAttrs("RF", "Text"), "text", text)...)
+	}
+}
+
+func (d *Decoder) resetText() {
+	d.metaText.Reset()
+	d.text = ""
 }
 
 func (d *Decoder) resetPacket() {
@@ -0,0 +1,122 @@
+package m17
+
+// Event is something the Decoder found in the received symbols. It is one of
+// the *Event types below, so handlers use a type switch to tell them apart.
+type Event interface {
+	event()
+}
+
+// Quality describes how cleanly a frame was received.
+type Quality struct {
+	// Normalized correlation between the received and expected syncword
+	// symbols, 1 for a perfect match
+	SyncCorrelation float32
+	// Received symbol level relative to nominal, estimated from the
+	// syncwords. Payload symbols are scaled by it before decoding.
+	Level float32
+	// Carrier frequency offset in Hz, positive when the signal is above
+	// the receive frequency, estimated from the syncwords and refined from
+	// the first frame's payload. Payload symbols are corrected for it before
+	// decoding.
+	FrequencyOffset float32
+	// Viterbi decoder path metric, roughly the number of bit errors corrected
+	ViterbiError float64
+}
+
+// Deviation returns the received deviation of the outer symbols in Hz.
+func (q Quality) Deviation() float32 {
+	return q.Level * 3 * symbolDeviation
+}
+
+// LSFEvent reports a received Link Setup Frame.
+type LSFEvent struct {
+	LSF *LSF
+	// The rest of the LSF can't be trusted if the CRC is bad
+	CRCValid bool
+	// Set if the LSF was rebuilt from the LICH chunks of stream frames
+	// because the LSF frame itself was missed
+	FromLICH bool
+	// Random ID for a stream, zero for packets
+	StreamID uint16
+	Quality
+}
+
+// StreamFrameEvent reports a received stream frame.
+type StreamFrameEvent struct {
+	LSF         *LSF
+	StreamID    uint16
+	FrameNumber uint16
+	// Payload, decrypted if the Decoder has the key
+	Payload []byte
+	// Set if the frame carries part of the signature of a signed stream
+	// rather than a payload
+	Signature bool
+	// Which of the 6 LSF chunks the frame's LICH carries
+	LICHCount int
+	Quality
+}
+
+// StreamEndEvent reports the last frame of a stream.
+type StreamEndEvent struct {
+	LSF         *LSF
+	StreamID    uint16
+	FrameNumber uint16
+	// Result of checking the signature, SignatureNone for unsigned streams
+	Signature SignatureResult
+}
+
+// TextEvent reports text sent in the META field of a stream, each time it's
+// received in full and has changed.
+type TextEvent struct {
+	LSF  *LSF
+	Text string
+}
+
+// PacketEvent reports a complete packet with a good CRC.
+type PacketEvent struct {
+	LSF *LSF
+	// Packet type, data and CRC, decrypted if the Decoder has the key
+	Payload []byte
+	// Worst sync correlation, latest level and total Viterbi error of the
+	// packet's frames
+	Quality
+}
+
+// PacketCRCErrorEvent reports a complete packet with a bad CRC.
+type PacketCRCErrorEvent struct {
+	LSF     *LSF
+	Payload []byte
+	Quality
+}
+
+// SyncLostEvent reports that nothing has been received for a while after a
+// stream, packet or BERT transmission.
+type SyncLostEvent struct {
+	// StreamSync, PacketSync or BERTSync
+	SyncType uint16
+}
+
+// EOTEvent reports an End of Transmission marker. Whatever was being received
+// has been closed, so a stream without a last frame gets a StreamEndEvent
+// first.
+type EOTEvent struct {
+	// StreamSync, PacketSync or BERTSync for the transmission that was in
+	// progress, or zero if it had already ended, as after a complete packet
+	SyncType uint16
+}
+
+// BERTEvent reports a received BERT frame and the running totals.
+type BERTEvent struct {
+	Stats BERTStats
+	Quality
+}
+
+func (LSFEvent) event()            {}
+func (StreamFrameEvent) event()    {}
+func (StreamEndEvent) event()      {}
+func (TextEvent) event()           {}
+func (PacketEvent) event()         {}
+func (PacketCRCErrorEvent) event() {}
+func (SyncLostEvent) event()       {}
+func (EOTEvent) event()            {}
+func (BERTEvent) event()           {}
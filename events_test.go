@@ -0,0 +1,175 @@
+package m17
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/icza/gog"
+)
+
+// decodeEvents decodes syms and returns the events
+func decodeEvents(t *testing.T, d *Decoder, syms []Symbol) []Event {
+	var events []Event
+	d.DecodeSymbols(&DummyModem{In: symbolReader(t, syms)}, func(e Event) {
+		events = append(events, e)
+	})
+	return events
+}
+
+func TestDecoder_StreamEvents(t *testing.T) {
+	lsf := testStreamLSF(t)
+	syms := gog.Must(NewStreamEncoder(lsf).Encode(testPayloads(8)))
+	events := decodeEvents(t, NewDecoder(nil), syms)
+	if len(events) < 2 {
+		t.Fatalf("got %d events", len(events))
+	}
+	first, ok := events[0].(LSFEvent)
+	if !ok || !first.CRCValid || first.FromLICH || first.StreamID == 0 {
+		t.Fatalf("first event = %#v, want stream LSFEvent", events[0])
+	}
+	if first.SyncCorrelation < 0.99 || first.ViterbiError > 1 {
+		t.Errorf("LSFEvent quality = %+v, want a clean signal", first.Quality)
+	}
+	frames := 0
+	var types []string
+	for _, e := range events[1:] {
+		switch e := e.(type) {
+		case StreamFrameEvent:
+			if e.StreamID != first.StreamID || e.LICHCount != frames%lichChunks || int(e.FrameNumber&frameNumberMask) != frames {
+				t.Errorf("frame %d event = %#v", frames, e)
+			}
+			if e.SyncCorrelation < 0.99 || e.ViterbiError > 1 {
+				t.Errorf("frame %d quality = %+v", frames, e.Quality)
+			}
+			frames++
+		case TextEvent:
+		case StreamEndEvent:
+			types = append(types, "end")
+			if e.StreamID != first.StreamID || e.FrameNumber != 7|LastFrameFlag {
+				t.Errorf("StreamEndEvent = %#v", e)
+			}
+		case EOTEvent:
+			types = append(types, "eot")
+			// The last frame already ended the stream
+			if e.SyncType != 0 {
+				t.Errorf("EOTEvent type = %x, want 0", e.SyncType)
+			}
+		default:
+			t.Errorf("unexpected event %#v", e)
+		}
+	}
+	if frames != 8 {
+		t.Errorf("got %d StreamFrameEvents, want 8", frames)
+	}
+	if !reflect.DeepEqual(types, []string{"end", "eot"}) {
+		t.Errorf("events = %v, want [end eot]", types)
+	}
+}
+
+func TestDecoder_EOTEndsStream(t *testing.T) {
+	// Some radios never set the last frame flag, so EOT ends the stream
+	lsf := testStreamLSF(t)
+	e := NewStreamEncoder(lsf)
+	syms := gog.Must(e.Start())
+	for _, p := range testPayloads(4) {
+		syms = append(syms, gog.Must(e.NextFrame(p, false))...)
+	}
+	syms = append(syms, e.End()...)
+	// A second transmission right after the first
+	syms = append(syms, gog.Must(NewStreamEncoder(lsf).Encode(testPayloads(2)))...)
+	var types []string
+	var frames int
+	for _, e := range decodeEvents(t, NewDecoder(nil), syms) {
+		switch e := e.(type) {
+		case LSFEvent:
+			types = append(types, "lsf")
+		case StreamFrameEvent:
+			frames++
+		case StreamEndEvent:
+			types = append(types, fmt.Sprintf("end %d", e.FrameNumber&frameNumberMask))
+		case EOTEvent:
+			types = append(types, fmt.Sprintf("eot %x", e.SyncType))
+		case SyncLostEvent:
+			types = append(types, "sync lost")
+		}
+	}
+	want := []string{"lsf", "end 3", "eot ff5d", "lsf", "end 1", "eot 0"}
+	if !reflect.DeepEqual(types, want) {
+		t.Errorf("events = %v, want %v", types, want)
+	}
+	if frames != 6 {
+		t.Errorf("got %d StreamFrameEvents, want 6", frames)
+	}
+}
+
+func TestDecoder_LateEntryEvent(t *testing.T) {
+	lsf := testStreamLSF(t)
+	syms := gog.Must(NewStreamEncoder(lsf).Encode(testPayloads(12)))
+	// Skip the preamble, LSF and first frame
+	events := decodeEvents(t, NewDecoder(nil), syms[3*SymbolsPerFrame:])
+	for _, e := range events {
+		if e, ok := e.(LSFEvent); ok {
+			if !e.FromLICH || !e.CRCValid || e.LSF.Src.Callsign() != "N0CALL" {
+				t.Errorf("LSFEvent = %#v, want one rebuilt from LICH", e)
+			}
+			return
+		}
+	}
+	t.Errorf("no LSFEvent")
+}
+
+func TestDecoder_PacketEvents(t *testing.T) {
+	tests := []struct {
+		name    string
+		corrupt bool
+	}{
+		{"good CRC", false},
+		{"bad CRC", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := gog.Must(NewPacket("N1ADJ", "N0CALL", PacketTypeSMS, []byte("Hello, packet events\x00")))
+			if tt.corrupt {
+				p.CRC ^= 0x1234
+			}
+			syms := gog.Must(p.Encode())
+			events := decodeEvents(t, NewDecoder(nil), syms)
+			var types []string
+			for _, e := range events {
+				switch e := e.(type) {
+				case LSFEvent:
+					types = append(types, "lsf")
+					if !e.CRCValid || e.LSF.LSFType() != LSFTypePacket {
+						t.Errorf("LSFEvent = %#v", e)
+					}
+				case PacketEvent:
+					types = append(types, "packet")
+					if !bytes.Equal(e.Payload, p.PayloadBytes()) {
+						t.Errorf("PacketEvent payload = % x, want % x", e.Payload, p.PayloadBytes())
+					}
+					if e.SyncCorrelation < 0.99 || e.ViterbiError > 1 {
+						t.Errorf("PacketEvent quality = %+v", e.Quality)
+					}
+				case PacketCRCErrorEvent:
+					types = append(types, "crc error")
+					if !bytes.Equal(e.Payload, p.PayloadBytes()) {
+						t.Errorf("PacketCRCErrorEvent payload = % x, want % x", e.Payload, p.PayloadBytes())
+					}
+				case EOTEvent:
+					types = append(types, "eot")
+				default:
+					t.Errorf("unexpected event %#v", e)
+				}
+			}
+			want := "packet"
+			if tt.corrupt {
+				want = "crc error"
+			}
+			if !reflect.DeepEqual(types, []string{"lsf", want, "eot"}) {
+				t.Errorf("events = %v, want [lsf %s eot]", types, want)
+			}
+		})
+	}
+}
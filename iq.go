@@ -0,0 +1,153 @@
+package m17
+
+import (
+	"fmt"
+	"math"
+)
+
+const (
+	// Lowest rate the channel is decimated to before FM demodulation. It's
+	// well above the channel filter's cutoff, so the resampler to the
+	// decoder's rate needs little filtering.
+	iqChannelRate = 48000
+	// Channel filter cutoff. An M17 signal is about ±5 kHz wide, and this
+	// leaves room for a couple of kHz of frequency offset.
+	iqChannelCutoff = 8000
+	// Width of the channel filter's transition band, which sets its length
+	iqChannelTransition = 4000
+)
+
+// FMDemodulator turns complex IQ samples of an M17 channel, such as those
+// recorded by an SDR tuned to it, into FM demodulated samples in symbol units.
+// It lowpass filters the channel, decimates it and applies a polar
+// discriminator. The output rate is given by OutputRate.
+type FMDemodulator struct {
+	taps    []float32
+	i, q    fir
+	decim   int
+	count   int
+	outRate int
+	// previous filtered sample, and the discriminator's gain from radians
+	// per sample to symbol units
+	last complex64
+	gain float32
+}
+
+// NewFMDemodulator creates an FMDemodulator for IQ samples at sampleRate.
+func NewFMDemodulator(sampleRate int) (*FMDemodulator, error) {
+	if sampleRate < 2*iqChannelCutoff {
+		return nil, fmt.Errorf("IQ sample rate must be at least %d, got %d", 2*iqChannelCutoff, sampleRate)
+	}
+	// Decimate by the largest factor that divides the rate exactly and
+	// leaves it at least iqChannelRate
+	decim := max(1, sampleRate/iqChannelRate)
+	for sampleRate%decim != 0 {
+		decim--
+	}
+	taps := lowpassTaps(float64(iqChannelCutoff)/float64(sampleRate), 4*sampleRate/iqChannelTransition+1)
+	outRate := sampleRate / decim
+	return &FMDemodulator{
+		taps:    taps,
+		i:       newFIR(taps),
+		q:       newFIR(taps),
+		decim:   decim,
+		outRate: outRate,
+		gain:    float32(float64(outRate) / (2 * math.Pi * symbolDeviation)),
+	}, nil
+}
+
+// OutputRate returns the rate of the demodulated samples.
+func (d *FMDemodulator) OutputRate() int {
+	return d.outRate
+}
+
+func (d *FMDemodulator) Process(out []float32, in []complex64) []float32 {
+	for _, sample := range in {
+		d.i.push(real(sample))
+		d.q.push(imag(sample))
+		d.count++
+		if d.count < d.decim {
+			continue
+		}
+		d.count = 0
+		// Only the samples kept after decimation are filtered
+		x := complex(d.i.output(d.taps), d.q.output(d.taps))
+		// The phase change since the last sample is the frequency
+		p := x * complex(real(d.last), -imag(d.last))
+		d.last = x
+		out = append(out, d.gain*float32(math.Atan2(float64(imag(p)), float64(real(p)))))
+	}
+	return out
+}
+
+// NewIQDemodulator returns a filter that turns IQ samples at sampleRate into
+// the 5 samples per symbol the Decoder reads, demodulating them with an
+// FMDemodulator and passing them through NewRXFilter.
+func NewIQDemodulator(sampleRate int) (Filter[complex64, float32], error) {
+	fm, err := NewFMDemodulator(sampleRate)
+	if err != nil {
+		return nil, err
+	}
+	rx, err := NewRXFilter(fm.OutputRate())
+	if err != nil {
+		return nil, err
+	}
+	return Chain(fm, rx), nil
+}
+
+// FMModulator turns symbols into complex baseband IQ samples of a 4FSK FM
+// signal, such as an SDR can transmit. The IQ samples have a magnitude of 1.
+type FMModulator struct {
+	shaper Filter[Symbol, float32]
+	// phase change per sample for each symbol unit
+	step    float64
+	phase   float64
+	samples []float32
+}
+
+// NewFMModulator creates an FMModulator producing IQ samples at sampleRate,
+// with the outer symbols at ±deviation Hz. A deviation of 0 means the
+// standard 2.4 kHz.
+func NewFMModulator(sampleRate int, deviation float64) (*FMModulator, error) {
+	if deviation == 0 {
+		deviation = 3 * symbolDeviation
+	}
+	if deviation < 0 || 2*deviation >= float64(sampleRate) {
+		return nil, fmt.Errorf("deviation must be positive and below half the sample rate, got %.0f Hz at %d Hz", deviation, sampleRate)
+	}
+	shaper, err := NewTXFilter(sampleRate)
+	if err != nil {
+		return nil, err
+	}
+	return &FMModulator{
+		shaper: shaper,
+		step:   2 * math.Pi * deviation / 3 / float64(sampleRate),
+	}, nil
+}
+
+func (m *FMModulator) Process(out []complex64, in []Symbol) []complex64 {
+	m.samples = m.shaper.Process(m.samples[:0], in)
+	for _, s := range m.samples {
+		m.phase = math.Mod(m.phase+m.step*float64(s), 2*math.Pi)
+		sin, cos := math.Sincos(m.phase)
+		out = append(out, complex(float32(cos), float32(sin)))
+	}
+	return out
+}
+
+// Blackman windowed sinc lowpass filter of n taps with unity gain at DC, with
+// cutoff in cycles per sample
+func lowpassTaps(cutoff float64, n int) []float32 {
+	h := make([]float64, n)
+	center := float64(n-1) / 2
+	var sum float64
+	for i := range h {
+		h[i] = sinc(2*cutoff*(float64(i)-center)) * blackman(i, n)
+		sum += h[i]
+	}
+	taps := make([]float32, n)
+	for i := range h {
+		taps[i] = float32(h[i] / sum)
+	}
+	return taps
+}
@@ -0,0 +1,265 @@
+package m17
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"math/cmplx"
+	"math/rand"
+	"testing"
+
+	"github.com/icza/gog"
+)
+
+func TestFMDemodulator(t *testing.T) {
+	tests := []struct {
+		rate     int
+		wantRate int
+	}{
+		{48000, 48000},
+		{240000, 48000},
+		{1024000, 51200},
+		{2400000, 48000},
+		{44100, 44100},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.rate), func(t *testing.T) {
+			d := gog.Must(NewFMDemodulator(tt.rate))
+			if d.OutputRate() != tt.wantRate {
+				t.Errorf("FMDemodulator.OutputRate() = %d, want %d", d.OutputRate(), tt.wantRate)
+			}
+			// A tone 1.6 kHz above the carrier is 2 symbol units
+			in := make([]complex64, tt.rate/10)
+			for i := range in {
+				in[i] = complex64(cmplx.Rect(0.5, 2*math.Pi*1600*float64(i)/float64(tt.rate)))
+			}
+			out := d.Process(nil, in)
+			if len(out) != len(in)*tt.wantRate/tt.rate {
+				t.Errorf("FMDemodulator.Process() returned %d samples, want %d", len(out), len(in)*tt.wantRate/tt.rate)
+			}
+			// Once the filter has settled
+			for i, v := range out[len(out)/2:] {
+				if math.Abs(float64(v)-2) > 1e-3 {
+					t.Fatalf("sample %d = %f, want 2", i, v)
+				}
+			}
+		})
+	}
+	if _, err := NewFMDemodulator(8000); err == nil {
+		t.Errorf("NewFMDemodulator(8000) succeeded")
+	}
+}
+
+func TestFMDemodulator_ChannelFilter(t *testing.T) {
+	const rate = 240000
+	d := gog.Must(NewFMDemodulator(rate))
+	// A strong signal 25 kHz away is filtered out, leaving the weaker one
+	// 800 Hz above the carrier
+	in := make([]complex64, rate/10)
+	for i := range in {
+		t := float64(i) / rate
+		in[i] = complex64(cmplx.Rect(0.1, 2*math.Pi*800*t) + cmplx.Rect(1, 2*math.Pi*25000*t))
+	}
+	out := d.Process(nil, in)
+	for i, v := range out[len(out)/2:] {
+		if math.Abs(float64(v)-1) > 0.01 {
+			t.Fatalf("sample %d = %f, want 1", i, v)
+		}
+	}
+}
+
+// fmModulate FM modulates symbols as an SDR would receive them at rate, with
+// the carrier offset by offset Hz and noise of standard deviation sigma added
+// to I and Q
+func fmModulate(syms []Symbol, rate int, offset float64, sigma float64, rnd *rand.Rand) []complex64 {
+	iq := gog.Must(NewFMModulator(rate, 0)).Process(nil, syms)
+	for i := range iq {
+		carrier := cmplx.Rect(0.5, 2*math.Pi*offset*float64(i)/float64(rate))
+		iq[i] = complex64(complex128(iq[i])*carrier + complex(rnd.NormFloat64()*sigma, rnd.NormFloat64()*sigma))
+	}
+	return iq
+}
+
+// encodeIQ encodes samples in an IQ format
+func encodeIQ(iq []complex64, format SampleFormat) []byte {
+	var b bytes.Buffer
+	gog.Must(NewSampleWriter(&b, format, 48000)).WriteIQ(iq)
+	return b.Bytes()
+}
+
+func TestDummyModem_IQ(t *testing.T) {
+	data := []byte("Hello from an SDR recording")
+	p := gog.Must(NewPacket("N1ADJ", "N0CALL", PacketTypeSMS, data))
+	syms := gog.Must(p.Encode())
+	// Follow the packet with silence to flush the decoder
+	syms = append(syms, make([]Symbol, symbolBufSize/decoderSamplesPerSymbol+SymbolsPerFrame)...)
+	tests := []struct {
+		format SampleFormat
+		rate   int
+		offset float64
+		sigma  float64
+	}{
+		{FormatCF32, 48000, 0, 0},
+		{FormatCF32, 96000, -1500, 0.05},
+		{FormatCS16, 240000, 1000, 0.1},
+		{FormatCU8, 1024000, 2000, 0.2},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s/%d/%+.0f", tt.format, tt.rate, tt.offset), func(t *testing.T) {
+			rnd := rand.New(rand.NewSource(1))
+			in := encodeIQ(fmModulate(syms, tt.rate, tt.offset, tt.sigma, rnd), tt.format)
+			rx := &DummyModem{In: io.NopCloser(bytes.NewReader(in)), InFormat: tt.format, SampleRate: tt.rate}
+			var got []byte
+			NewDecoder(nil).DecodeSymbols(rx, func(e Event) {
+				if e, ok := e.(PacketEvent); ok {
+					got = e.Payload
+				}
+			})
+			if !bytes.Equal(got, p.PayloadBytes()) {
+				t.Errorf("decoded packet %q, want %q", got, p.PayloadBytes())
+			}
+		})
+	}
+}
+
+func TestSampleReader_IQ(t *testing.T) {
+	iq := []complex64{0, complex(0.5, -0.5), complex(-1, 0.25)}
+	for _, format := range []SampleFormat{FormatCU8, FormatCS8, FormatCS16, FormatCF32} {
+		t.Run(format.String(), func(t *testing.T) {
+			r := gog.Must(NewSampleReader(bytes.NewReader(encodeIQ(iq, format)), format, 48000))
+			got := make([]complex64, 5)
+			n, err := r.ReadIQ(got)
+			if n != len(iq) || err != nil {
+				t.Fatalf("SampleReader.ReadIQ() = %d, %v, want %d", n, err, len(iq))
+			}
+			for i := range iq {
+				if cmplx.Abs(complex128(got[i]-iq[i])) > 1.0/128 {
+					t.Errorf("sample %d = %v, want %v", i, got[i], iq[i])
+				}
+			}
+			if _, err := r.ReadSamples(make([]float32, 1)); err == nil {
+				t.Errorf("SampleReader.ReadSamples() of IQ samples succeeded")
+			}
+			if err := gog.Must(NewSampleWriter(io.Discard, format, 48000)).WriteSamples(make([]float32, 1)); err == nil {
+				t.Errorf("SampleWriter.WriteSamples() of IQ samples succeeded")
+			}
+		})
+	}
+}
+
+func TestFMModulator(t *testing.T) {
+	tests := []struct {
+		rate      int
+		deviation float64
+		// frequency of a run of +1 symbols
+		want float64
+	}{
+		{48000, 0, 800},
+		{96000, 2400, 800},
+		{2000000, 0, 800},
+		{2400000, 0, 800},
+		{44100, 1800, 600},
+		{8000, 3000, 1000},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%d/%.0f", tt.rate, tt.deviation), func(t *testing.T) {
+			m := gog.Must(NewFMModulator(tt.rate, tt.deviation))
+			syms := make([]Symbol, SymbolRate/10)
+			for i := range syms {
+				syms[i] = 1
+			}
+			iq := m.Process(nil, syms)
+			if len(iq) != len(syms)*tt.rate/SymbolRate {
+				t.Fatalf("FMModulator.Process() returned %d samples, want %d", len(iq), len(syms)*tt.rate/SymbolRate)
+			}
+			// Once the pulse shaping filter has settled. RRC pulses don't sum
+			// to exactly a constant, so the frequency ripples a little about
+			// its mean.
+			var phase float64
+			for i := len(iq) / 2; i < len(iq); i++ {
+				if math.Abs(cmplx.Abs(complex128(iq[i]))-1) > 1e-5 {
+					t.Fatalf("sample %d has magnitude %f, want 1", i, cmplx.Abs(complex128(iq[i])))
+				}
+				phase += cmplx.Phase(complex128(iq[i] * complex(real(iq[i-1]), -imag(iq[i-1]))))
+			}
+			f := phase / float64(len(iq)-len(iq)/2) * float64(tt.rate) / (2 * math.Pi)
+			if math.Abs(f-tt.want) > 1 {
+				t.Errorf("mean frequency %.1f Hz, want %.1f Hz", f, tt.want)
+			}
+		})
+	}
+	for _, dev := range []float64{-100, 24000} {
+		if _, err := NewFMModulator(48000, dev); err == nil {
+			t.Errorf("NewFMModulator(48000, %.0f) succeeded", dev)
+		}
+	}
+}
+
+func BenchmarkFMModulator(b *testing.B) {
+	syms := make([]Symbol, SymbolRate)
+	for i := range syms {
+		syms[i] = SymbolList[i%4]
+	}
+	m := gog.Must(NewFMModulator(2400000, 0))
+	var iq []complex64
+	b.ReportAllocs()
+	for b.Loop() {
+		iq = m.Process(iq[:0], syms)
+	}
+}
+
+func TestDummyModem_IQOutput(t *testing.T) {
+	lsf := testStreamLSF(t)
+	payloads := testPayloads(3)
+	tests := []struct {
+		format    SampleFormat
+		rate      int
+		deviation float64
+	}{
+		{FormatCS8, 2000000, 0},
+		{FormatCS8, 2400000, 0},
+		{FormatCS16, 48000, 0},
+		{FormatCF32, 250000, 1800},
+		{FormatCU8, 1024000, 0},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s/%d/%.0f", tt.format, tt.rate, tt.deviation), func(t *testing.T) {
+			out := &nopWriteCloser{}
+			tx := DummyModem{Out: out, OutFormat: tt.format, SampleRate: tt.rate, Deviation: tt.deviation}
+			for i, pl := range payloads {
+				err := tx.TransmitVoiceStream(StreamDatagram{
+					StreamID:    1,
+					FrameNumber: uint16(i),
+					LastFrame:   i == len(payloads)-1,
+					LSF:         lsf,
+					Payload:     pl,
+				})
+				if err != nil {
+					t.Fatalf("DummyModem.TransmitVoiceStream() error = %v", err)
+				}
+			}
+			// Silence to flush the decoder
+			tx.writer.WriteIQ(make([]complex64, symbolBufSize*tt.rate/decoderSampleRate+1))
+			// LSF, 3 stream frames and EOT, with preambles
+			if want := 7 * tt.rate / 25; out.Len() < want*tx.writer.size {
+				t.Errorf("DummyModem.TransmitVoiceStream() wrote %d bytes, want at least %d", out.Len(), want*tx.writer.size)
+			}
+			rx := &DummyModem{In: io.NopCloser(&out.Buffer), InFormat: tt.format, SampleRate: tt.rate}
+			var got [][]byte
+			NewDecoder(nil).DecodeSymbols(rx, func(e Event) {
+				if e, ok := e.(StreamFrameEvent); ok {
+					got = append(got, e.Payload)
+				}
+			})
+			if len(got) != len(payloads) {
+				t.Fatalf("decoded %d stream frames, want %d", len(got), len(payloads))
+			}
+			for i := range payloads {
+				if !bytes.Equal(got[i], payloads[i][:]) {
+					t.Errorf("frame %d payload = %x, want %x", i, got[i], payloads[i])
+				}
+			}
+		})
+	}
+}
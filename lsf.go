@@ -35,6 +35,20 @@ const (
 	LSFEncryptionTypeOther
 )
 
+// Scrambler encryption subtypes give the LFSR length
+const (
+	LSFEncryptionSubtypeScrambler8 LSFEncryptionSubtype = iota
+	LSFEncryptionSubtypeScrambler16
+	LSFEncryptionSubtypeScrambler24
+)
+
+// AES encryption subtypes give the key length
+const (
+	LSFEncryptionSubtypeAES128 LSFEncryptionSubtype = iota
+	LSFEncryptionSubtypeAES192
+	LSFEncryptionSubtypeAES256
+)
+
 const (
 	LSFLen = 30
 	LSDLen = 28
@@ -56,13 +70,15 @@ type LSF struct {
 	Type [typeLen]byte
 	Meta [metaLen]byte
 	CRC  [CRCLen]byte
+	// Layout of the TYPE field, LSFVersionAuto to detect it
+	version LSFVersion
 }
 
 func NewEmptyLSF() LSF {
 	return LSF{}
 }
 
-func NewLSF(destCall, sourceCall string, t LSFType, dt LSFDataType, can byte) (LSF, error) {
+func NewLSF(destCall, sourceCall string, t LSFType, dt LSFDataType, et LSFEncryptionType, es LSFEncryptionSubtype, can byte) (LSF, error) {
 	var err error
 	lsf := NewEmptyLSF()
 	dst, err := EncodeCallsign(destCall)
@@ -75,12 +91,20 @@ func NewLSF(destCall, sourceCall string, t LSFType, dt LSFDataType, can byte) (L
 		return lsf, fmt.Errorf("bad src callsign: %w", err)
 	}
 	lsf.Src = *src
-	if t == 0 {
+	if t == LSFTypePacket {
 		// Data Type is only defined for stream mode
 		dt = 0
 	}
-	lsf.Type[0] = (can & 0x7)
-	lsf.Type[1] = (byte(t) & 0x1) | ((byte(dt) & 0x3) << 1)
+	err = lsf.SetTypeField(TypeField{
+		Type:              t,
+		DataType:          dt,
+		EncryptionType:    et,
+		EncryptionSubtype: es,
+		CAN:               can,
+	})
+	if err != nil {
+		return lsf, err
+	}
 	return lsf, nil
 }
 
@@ -144,19 +168,32 @@ func (l *LSF) CheckCRC() bool {
 	return CRC(a) == 0
 }
 
-func (l *LSF) LSFType() LSFType {
-	return LSFType(l.Type[1] & 0x1)
-}
-
-func (l *LSF) CAN() byte {
-	return (l.Type[1] >> 7) & 0xF
-}
-
 func (l LSF) String() string {
 	return fmt.Sprintf(`{
 	Dst: %s,
 	Src: %s,
-	Type: %#v,
+	Type: %s (v%d),
 	Meta: %#v,
-	CRC: %#v`, l.Dst.Callsign(), l.Src.Callsign(), l.Type, l.Meta, l.CRC)
+	CRC: %#v`, l.Dst.Callsign(), l.Src.Callsign(), l.TypeField(), l.Version(), l.Meta, l.CRC)
+}
+
+// dashAttrs returns the dashboard log attributes describing a transmission
+func (l *LSF) dashAttrs(typ, subtype string) []any {
+	attrs := []any{"type", typ, "subtype", subtype, "src", l.Src.Callsign(), "dst", l.Dst.Callsign(), "can", l.CAN(), "lsftype", l.TypeField().String()}
+	if _, field2, ok := l.ExtendedCallsign(); ok {
+		attrs = append(attrs, "originator", l.Originator())
+		if field2 != (EncodedCallsign{}) {
+			attrs = append(attrs, "via", field2.Callsign())
+		}
+	}
+	if g, ok := l.GNSS(); ok && g.PositionValid {
+		attrs = append(attrs, "lat", g.Latitude, "lon", g.Longitude)
+		if g.AltitudeValid {
+			attrs = append(attrs, "alt", g.Altitude)
+		}
+		if g.VelocityValid {
+			attrs = append(attrs, "speed", g.Speed, "bearing", g.Bearing)
+		}
+	}
+	return attrs
 }
@@ -1,6 +1,7 @@
 package m17
 
 import (
+	"bytes"
 	"encoding/binary"
 	"reflect"
 	"testing"
@@ -25,6 +26,7 @@ func TestNewLSFFromBytes(t *testing.T) {
 				[2]byte{0, 0},
 				[14]byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
 				[2]byte{0, 0},
+				LSFVersionAuto,
 			},
 		},
 		{"happy",
@@ -259,3 +261,225 @@ func TestNewPacketFromBytes(t *testing.T) {
 		})
 	}
 }
+
+func TestLSF_TypeField(t *testing.T) {
+	tests := []struct {
+		name    string
+		tf      TypeField
+		want    [2]byte
+		wantErr bool
+	}{
+		{"packet", TypeField{Type: LSFTypePacket, Meta: LSFMetaTypeText}, [2]byte{0x00, 0x00}, false},
+		{"voice stream", TypeField{Type: LSFTypeStream, DataType: LSFDataTypeVoice, Meta: LSFMetaTypeText}, [2]byte{0x00, 0x05}, false},
+		{"CAN", TypeField{Type: LSFTypeStream, DataType: LSFDataTypeVoice, Meta: LSFMetaTypeText, CAN: 0xF}, [2]byte{0x07, 0x85}, false},
+		{"CAN 1", TypeField{Type: LSFTypeStream, DataType: LSFDataTypeVoice, Meta: LSFMetaTypeText, CAN: 1}, [2]byte{0x00, 0x85}, false},
+		{"AES-256", TypeField{Type: LSFTypeStream, DataType: LSFDataTypeVoiceData, EncryptionType: LSFEncryptionTypeAES, EncryptionSubtype: LSFEncryptionSubtypeAES256}, [2]byte{0x00, 0x57}, false},
+		{"GNSS META", TypeField{Type: LSFTypeStream, DataType: LSFDataTypeData, Meta: LSFMetaTypeGNSS}, [2]byte{0x00, 0x23}, false},
+		{"signed", TypeField{Type: LSFTypeStream, DataType: LSFDataTypeVoice, Meta: LSFMetaTypeText, CAN: 2, Signed: true}, [2]byte{0x09, 0x05}, false},
+		{"no data type", TypeField{Type: LSFTypeStream}, [2]byte{}, true},
+		{"signed packet", TypeField{Type: LSFTypePacket, Signed: true}, [2]byte{}, true},
+		{"bad CAN", TypeField{Type: LSFTypeStream, DataType: LSFDataTypeVoice, CAN: 16}, [2]byte{}, true},
+		{"bad AES subtype", TypeField{Type: LSFTypeStream, DataType: LSFDataTypeVoice, EncryptionType: LSFEncryptionTypeAES, EncryptionSubtype: 3}, [2]byte{}, true},
+		{"bad scrambler subtype", TypeField{Type: LSFTypeStream, DataType: LSFDataTypeVoice, EncryptionType: LSFEncryptionTypeScrambler, EncryptionSubtype: 3}, [2]byte{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var l LSF
+			err := l.SetTypeField(tt.tf)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("LSF.SetTypeField() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if l.Type != tt.want {
+				t.Errorf("LSF.SetTypeField() Type = %#v, want %#v", l.Type, tt.want)
+			}
+			if got := l.TypeField(); got != tt.tf {
+				t.Errorf("LSF.TypeField() = %#v, want %#v", got, tt.tf)
+			}
+			if l.CAN() != tt.tf.CAN || l.Signed() != tt.tf.Signed || l.DataType() != tt.tf.DataType {
+				t.Errorf("LSF getters = %d, %v, %d", l.CAN(), l.Signed(), l.DataType())
+			}
+			if err := l.ValidateType(); err != nil {
+				t.Errorf("LSF.ValidateType() error = %v", err)
+			}
+		})
+	}
+}
+
+func TestLSF_TypeSetters(t *testing.T) {
+	l := gog.Must(NewLSF("N1ADJ", "N0CALL", LSFTypeStream, LSFDataTypeVoice, LSFEncryptionTypeNone, 0, 9))
+	if l.CAN() != 9 {
+		t.Errorf("NewLSF() CAN = %d, want 9", l.CAN())
+	}
+	if _, err := NewLSF("N1ADJ", "N0CALL", LSFTypeStream, LSFDataTypeVoice, LSFEncryptionTypeNone, 0, 16); err == nil {
+		t.Errorf("NewLSF() accepted CAN 16")
+	}
+	l.SetEncryption(LSFEncryptionTypeAES, LSFEncryptionSubtypeAES192)
+	l.SetSigned(true)
+	if err := l.SetCAN(3); err != nil {
+		t.Fatalf("LSF.SetCAN() error = %v", err)
+	}
+	if l.SetCAN(16) == nil {
+		t.Errorf("LSF.SetCAN() accepted 16")
+	}
+	want := TypeField{Type: LSFTypeStream, DataType: LSFDataTypeVoice, EncryptionType: LSFEncryptionTypeAES, EncryptionSubtype: LSFEncryptionSubtypeAES192, CAN: 3, Signed: true}
+	if got := l.TypeField(); got != want {
+		t.Errorf("LSF.TypeField() = %#v, want %#v", got, want)
+	}
+	if got := want.String(); got != "stream voice, AES-192, CAN 3, signed" {
+		t.Errorf("TypeField.String() = %q", got)
+	}
+	l.SetMetaType(LSFMetaTypeExtendedCallsign)
+	l.SetSigned(false)
+	if got := l.TypeField().String(); got != "stream voice, extended callsign META, CAN 3" {
+		t.Errorf("TypeField.String() = %q", got)
+	}
+	l.Type[0] |= 0x80
+	if l.ValidateType() == nil {
+		t.Errorf("LSF.ValidateType() accepted reserved bits")
+	}
+}
+
+func TestLSF_TypeFieldV2(t *testing.T) {
+	tests := []struct {
+		name string
+		tf   TypeField
+		want [2]byte
+	}{
+		{"packet", TypeField{Type: LSFTypePacket}, [2]byte{0x00, 0x0F}},
+		{"voice stream", TypeField{Type: LSFTypeStream, DataType: LSFDataTypeVoice}, [2]byte{0x00, 0x02}},
+		{"AES-256", TypeField{Type: LSFTypeStream, DataType: LSFDataTypeVoiceData, EncryptionType: LSFEncryptionTypeAES, EncryptionSubtype: LSFEncryptionSubtypeAES256}, [2]byte{0x00, 0x63}},
+		{"scrambler", TypeField{Type: LSFTypeStream, DataType: LSFDataTypeVoice, EncryptionType: LSFEncryptionTypeScrambler, EncryptionSubtype: LSFEncryptionSubtypeScrambler16}, [2]byte{0x00, 0x22}},
+		{"GNSS META", TypeField{Type: LSFTypeStream, DataType: LSFDataTypeData, Meta: LSFMetaTypeGNSS}, [2]byte{0x10, 0x01}},
+		{"signed", TypeField{Type: LSFTypeStream, DataType: LSFDataTypeVoice, Meta: LSFMetaTypeText, CAN: 2, Signed: true}, [2]byte{0x32, 0x82}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.tf.Encode(LSFVersion2); got != tt.want {
+				t.Errorf("TypeField.Encode() = %#v, want %#v", got, tt.want)
+			}
+			if got := DecodeTypeField(tt.want, LSFVersion2); got != tt.tf {
+				t.Errorf("DecodeTypeField() = %#v, want %#v", got, tt.tf)
+			}
+			l := LSF{Type: tt.want, version: LSFVersion2}
+			if err := l.ValidateType(); err != nil {
+				t.Errorf("LSF.ValidateType() error = %v", err)
+			}
+		})
+	}
+}
+
+func TestDetectLSFVersion(t *testing.T) {
+	tests := []struct {
+		typ  [2]byte
+		want LSFVersion
+	}{
+		{[2]byte{0x00, 0x05}, LSFVersion1},
+		{[2]byte{0x00, 0x00}, LSFVersion1},
+		{[2]byte{0x00, 0x57}, LSFVersion1},
+		{[2]byte{0x00, 0x02}, LSFVersion2},
+		{[2]byte{0x00, 0x0F}, LSFVersion2},
+		{[2]byte{0x10, 0x01}, LSFVersion2},
+		{[2]byte{0x32, 0x82}, LSFVersion2},
+	}
+	for _, tt := range tests {
+		if got := DetectLSFVersion(tt.typ); got != tt.want {
+			t.Errorf("DetectLSFVersion(%#v) = %d, want %d", tt.typ, got, tt.want)
+		}
+	}
+}
+
+func TestDetectLSFVersionFor(t *testing.T) {
+	tests := []struct {
+		typ  [2]byte
+		t    LSFType
+		want LSFVersion
+	}{
+		// v1 data packet or v2 voice stream
+		{[2]byte{0x00, 0x02}, LSFTypePacket, LSFVersion1},
+		{[2]byte{0x00, 0x02}, LSFTypeStream, LSFVersion2},
+		{[2]byte{0x00, 0x0F}, LSFTypePacket, LSFVersion2},
+		{[2]byte{0x00, 0x05}, LSFTypeStream, LSFVersion1},
+		// Streams in both layouts
+		{[2]byte{0x00, 0x03}, LSFTypeStream, LSFVersion1},
+	}
+	for _, tt := range tests {
+		if got := detectLSFVersionFor(tt.typ, tt.t); got != tt.want {
+			t.Errorf("detectLSFVersionFor(%#v, %d) = %d, want %d", tt.typ, tt.t, got, tt.want)
+		}
+	}
+}
+
+func TestDecoder_V1Packet(t *testing.T) {
+	p := gog.Must(NewPacket("N1ADJ", "N0CALL", PacketTypeSMS, []byte("Hello from v1\x00")))
+	// Older v1 firmware sends packets with the data type set, which is a
+	// voice stream in v2
+	p.LSF.Type = [2]byte{0x00, 0x02}
+	p.LSF.CalcCRC()
+	var got []byte
+	NewDecoder(nil).DecodeSymbols(&DummyModem{In: symbolReader(t, gog.Must(p.Encode()))}, func(e Event) {
+		switch e := e.(type) {
+		case LSFEvent:
+			if e.LSF.LSFType() != LSFTypePacket || e.LSF.Version() != LSFVersion1 {
+				t.Errorf("LSF %v, want a v1 packet", e.LSF)
+			}
+		case PacketEvent:
+			got = e.Payload
+		}
+	})
+	if !bytes.Equal(got, p.PayloadBytes()) {
+		t.Errorf("decoded packet % x, want % x", got, p.PayloadBytes())
+	}
+}
+
+func TestLSF_ToVersion(t *testing.T) {
+	l := gog.Must(NewLSF("N1ADJ", "N0CALL", LSFTypeStream, LSFDataTypeVoice, LSFEncryptionTypeNone, 0, 5))
+	l.SetGNSS(GNSS{PositionValid: true, Latitude: 43, Longitude: -70})
+	l.CalcCRC()
+	want := l.TypeField()
+
+	v2 := l.ToVersion(LSFVersion2)
+	if v2.Version() != LSFVersion2 || v2.Type != want.Encode(LSFVersion2) {
+		t.Errorf("LSF.ToVersion(2) Type = %#v", v2.Type)
+	}
+	if !v2.CheckCRC() {
+		t.Errorf("LSF.ToVersion(2) CRC is bad")
+	}
+	// Receivers detect the layout
+	received := NewLSFFromBytes(v2.ToBytes())
+	if got := received.TypeField(); got != want {
+		t.Errorf("received TypeField() = %#v, want %#v", got, want)
+	}
+	if _, ok := received.GNSS(); !ok {
+		t.Errorf("received LSF.GNSS() ok = false")
+	}
+	v1 := received.ToVersion(LSFVersion1)
+	if v1.Type != l.Type || !v1.CheckCRC() {
+		t.Errorf("LSF.ToVersion(1) Type = %#v, want %#v", v1.Type, l.Type)
+	}
+	if got := l.ToVersion(LSFVersionAuto); got != l {
+		t.Errorf("LSF.ToVersion(auto) changed the LSF")
+	}
+}
+
+func TestParseLSFVersion(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    LSFVersion
+		wantErr bool
+	}{
+		{"", LSFVersionAuto, false},
+		{"auto", LSFVersionAuto, false},
+		{"1", LSFVersion1, false},
+		{"2", LSFVersion2, false},
+		{"3", LSFVersionAuto, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseLSFVersion(tt.s)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ParseLSFVersion(%q) = %d, %v, want %d", tt.s, got, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,551 @@
+package m17
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// LSFVersion selects the TYPE field layout, which changed between versions of
+// the M17 spec.
+type LSFVersion byte
+
+const (
+	// Detect the layout from the TYPE field
+	LSFVersionAuto LSFVersion = iota
+	LSFVersion1
+	LSFVersion2
+)
+
+func ParseLSFVersion(s string) (LSFVersion, error) {
+	switch s {
+	case "", "auto":
+		return LSFVersionAuto, nil
+	case "1":
+		return LSFVersion1, nil
+	case "2":
+		return LSFVersion2, nil
+	}
+	return LSFVersionAuto, fmt.Errorf("bad LSF version %q, must be auto, 1 or 2", s)
+}
+
+// Spec v1 TYPE layout. From the least significant bit: packet/stream (1 bit),
+// data type (2), encryption type (2), encryption subtype or META type (2),
+// CAN (4), signed stream (1) and 4 reserved bits.
+const (
+	v1StreamMask   = 0x0001
+	v1DataShift    = 1
+	v1EncShift     = 3
+	v1SubtypeShift = 5
+	v1CANShift     = 7
+	v1SignedMask   = 0x0800
+	v1ReservedMask = 0xF000
+)
+
+// Spec v2 TYPE layout. From the least significant bit: payload (4 bits),
+// encryption (3), signed stream (1), CAN (4) and META type (4).
+const (
+	v2EncShift   = 4
+	v2SignedMask = 0x0080
+	v2CANShift   = 8
+	v2MetaShift  = 12
+)
+
+// Spec v2 payload values
+const (
+	v2PayloadData      = 0x1
+	v2PayloadVoice     = 0x2
+	v2PayloadVoiceData = 0x3
+	v2PayloadPacket    = 0xF
+)
+
+// Spec v2 encryption values. Scrambler and AES subtypes follow the base value.
+const (
+	v2EncNone      = 0
+	v2EncScrambler = 1
+	v2EncAES       = 4
+	v2EncReserved  = 7
+)
+
+// Spec v2 META values
+const (
+	v2MetaNone             = 0
+	v2MetaGNSS             = 1
+	v2MetaExtendedCallsign = 2
+	v2MetaText             = 3
+	v2MetaReserved         = 4
+)
+
+// Masks for TYPE subfields
+const (
+	typeTwoBitMask   = 0x3
+	typeThreeBitMask = 0x7
+	typeNibbleMask   = 0xF
+	maxCAN           = 0xF
+	typeCANMask      = maxCAN
+)
+
+// TypeField is a structured view of the LSF TYPE field, independent of the
+// spec version.
+type TypeField struct {
+	Type              LSFType
+	DataType          LSFDataType
+	EncryptionType    LSFEncryptionType
+	EncryptionSubtype LSFEncryptionSubtype
+	// What the META field holds. Only meaningful for unencrypted transmissions.
+	Meta LSFMetaType
+	// Channel Access Number, 0-15
+	CAN    byte
+	Signed bool
+}
+
+// DecodeTypeField decodes a TYPE field with the layout of spec version v. For
+// LSFVersionAuto the version is detected.
+func DecodeTypeField(typ [typeLen]byte, v LSFVersion) TypeField {
+	b := binary.BigEndian.Uint16(typ[:])
+	if v == LSFVersionAuto {
+		v = DetectLSFVersion(typ)
+	}
+	if v == LSFVersion2 {
+		return decodeTypeFieldV2(b)
+	}
+	return decodeTypeFieldV1(b)
+}
+
+// Encode encodes the TYPE field with the layout of spec version v. For
+// LSFVersionAuto the v1 layout is used.
+func (t TypeField) Encode(v LSFVersion) [typeLen]byte {
+	var b uint16
+	if v == LSFVersion2 {
+		b = t.encodeV2()
+	} else {
+		b = t.encodeV1()
+	}
+	var typ [typeLen]byte
+	binary.BigEndian.PutUint16(typ[:], b)
+	return typ
+}
+
+func decodeTypeFieldV1(b uint16) TypeField {
+	t := TypeField{
+		Type:           LSFType(b & v1StreamMask),
+		DataType:       LSFDataType((b >> v1DataShift) & typeTwoBitMask),
+		EncryptionType: LSFEncryptionType((b >> v1EncShift) & typeTwoBitMask),
+		CAN:            byte((b >> v1CANShift) & typeCANMask),
+		Signed:         b&v1SignedMask != 0,
+	}
+	sub := byte((b >> v1SubtypeShift) & typeTwoBitMask)
+	if t.EncryptionType == LSFEncryptionTypeNone {
+		// v1 has no way to say there's no META, so an empty one is text
+		t.Meta = [...]LSFMetaType{LSFMetaTypeText, LSFMetaTypeGNSS, LSFMetaTypeExtendedCallsign, LSFMetaTypeReserved}[sub]
+	} else {
+		t.EncryptionSubtype = LSFEncryptionSubtype(sub)
+	}
+	return t
+}
+
+func (t TypeField) encodeV1() uint16 {
+	b := uint16(t.Type)&v1StreamMask |
+		uint16(t.DataType&typeTwoBitMask)<<v1DataShift |
+		uint16(t.EncryptionType&typeTwoBitMask)<<v1EncShift |
+		uint16(t.CAN&typeCANMask)<<v1CANShift
+	sub := uint16(t.EncryptionSubtype & typeTwoBitMask)
+	if t.EncryptionType == LSFEncryptionTypeNone {
+		switch t.Meta {
+		case LSFMetaTypeGNSS:
+			sub = 1
+		case LSFMetaTypeExtendedCallsign:
+			sub = 2
+		case LSFMetaTypeReserved:
+			sub = 3
+		default:
+			sub = 0
+		}
+	}
+	b |= sub << v1SubtypeShift
+	if t.Signed {
+		b |= v1SignedMask
+	}
+	return b
+}
+
+func decodeTypeFieldV2(b uint16) TypeField {
+	var t TypeField
+	switch payload := b & typeNibbleMask; payload {
+	case v2PayloadPacket:
+		t.Type = LSFTypePacket
+	default:
+		t.Type = LSFTypeStream
+		t.DataType = LSFDataType(payload & typeTwoBitMask)
+	}
+	switch enc := (b >> v2EncShift) & typeThreeBitMask; {
+	case enc == v2EncNone:
+	case enc < v2EncAES:
+		t.EncryptionType = LSFEncryptionTypeScrambler
+		t.EncryptionSubtype = LSFEncryptionSubtype(enc - v2EncScrambler)
+	case enc < v2EncReserved:
+		t.EncryptionType = LSFEncryptionTypeAES
+		t.EncryptionSubtype = LSFEncryptionSubtype(enc - v2EncAES)
+	default:
+		t.EncryptionType = LSFEncryptionTypeOther
+	}
+	t.Signed = b&v2SignedMask != 0
+	t.CAN = byte((b >> v2CANShift) & typeCANMask)
+	switch (b >> v2MetaShift) & typeNibbleMask {
+	case v2MetaNone:
+		t.Meta = LSFMetaTypeNone
+	case v2MetaGNSS:
+		t.Meta = LSFMetaTypeGNSS
+	case v2MetaExtendedCallsign:
+		t.Meta = LSFMetaTypeExtendedCallsign
+	case v2MetaText:
+		t.Meta = LSFMetaTypeText
+	default:
+		t.Meta = LSFMetaTypeReserved
+	}
+	return t
+}
+
+func (t TypeField) encodeV2() uint16 {
+	var b uint16
+	if t.Type == LSFTypePacket {
+		b = v2PayloadPacket
+	} else {
+		b = uint16(t.DataType & typeTwoBitMask)
+	}
+	switch t.EncryptionType {
+	case LSFEncryptionTypeScrambler:
+		b |= (v2EncScrambler + uint16(t.EncryptionSubtype&typeTwoBitMask)) << v2EncShift
+	case LSFEncryptionTypeAES:
+		b |= (v2EncAES + uint16(t.EncryptionSubtype&typeTwoBitMask)) << v2EncShift
+	case LSFEncryptionTypeOther:
+		b |= v2EncReserved << v2EncShift
+	}
+	if t.Signed {
+		b |= v2SignedMask
+	}
+	b |= uint16(t.CAN&typeCANMask) << v2CANShift
+	var meta uint16
+	switch t.Meta {
+	case LSFMetaTypeGNSS:
+		meta = v2MetaGNSS
+	case LSFMetaTypeExtendedCallsign:
+		meta = v2MetaExtendedCallsign
+	case LSFMetaTypeText:
+		meta = v2MetaText
+	case LSFMetaTypeReserved:
+		meta = v2MetaReserved
+	}
+	if t.EncryptionType == LSFEncryptionTypeNone {
+		b |= meta << v2MetaShift
+	}
+	return b
+}
+
+// Check for values the v1 layout doesn't allow
+func validateTypeV1(b uint16) error {
+	if b&v1ReservedMask != 0 {
+		return fmt.Errorf("reserved TYPE bits set: %#04x", b)
+	}
+	return decodeTypeFieldV1(b).Validate()
+}
+
+// Check for values the v2 layout doesn't allow
+func validateTypeV2(b uint16) error {
+	switch payload := b & typeNibbleMask; payload {
+	case v2PayloadData, v2PayloadVoice, v2PayloadVoiceData, v2PayloadPacket:
+	default:
+		return fmt.Errorf("reserved payload type %d", payload)
+	}
+	if (b>>v2EncShift)&typeThreeBitMask == v2EncReserved {
+		return fmt.Errorf("reserved encryption type")
+	}
+	if meta := (b >> v2MetaShift) & typeNibbleMask; meta >= v2MetaReserved {
+		return fmt.Errorf("reserved META type %d", meta)
+	}
+	return decodeTypeFieldV2(b).Validate()
+}
+
+// DetectLSFVersion guesses which spec version's layout a TYPE field uses. Some
+// values are valid in both. Those are decoded as v1, except that a v2 packet
+// is preferred to the rarely used v1 scrambled voice+data stream.
+func DetectLSFVersion(typ [typeLen]byte) LSFVersion {
+	b := binary.BigEndian.Uint16(typ[:])
+	v1 := validateTypeV1(b) == nil
+	if v1 && decodeTypeFieldV1(b).Type == LSFTypePacket && (b>>v1DataShift)&typeTwoBitMask != 0 {
+		// v1 only defines the data type for streams
+		v1 = false
+	}
+	v2 := validateTypeV2(b) == nil
+	switch {
+	case v2 && !v1:
+		return LSFVersion2
+	case v2 && b&typeNibbleMask == v2PayloadPacket:
+		return LSFVersion2
+	}
+	return LSFVersion1
+}
+
+// detectLSFVersionFor is DetectLSFVersion for the TYPE field of an LSF known to
+// be for a stream or a packet, which settles values that are a stream in one
+// layout and a packet in the other, like 0x0002.
+func detectLSFVersionFor(typ [typeLen]byte, t LSFType) LSFVersion {
+	b := binary.BigEndian.Uint16(typ[:])
+	v1 := validateTypeV1(b) == nil && decodeTypeFieldV1(b).Type == t
+	v2 := validateTypeV2(b) == nil && decodeTypeFieldV2(b).Type == t
+	switch {
+	case v1 && !v2:
+		return LSFVersion1
+	case v2 && !v1:
+		return LSFVersion2
+	}
+	return DetectLSFVersion(typ)
+}
+
+// MetaType returns the type of data in the META field. It is only meaningful
+// when EncryptionType is LSFEncryptionTypeNone.
+func (t TypeField) MetaType() LSFMetaType {
+	return t.Meta
+}
+
+// Validate checks that the fields have values the spec allows.
+func (t TypeField) Validate() error {
+	if t.Type > LSFTypeStream {
+		return fmt.Errorf("bad LSF type %d", t.Type)
+	}
+	if t.DataType > LSFDataTypeVoiceData {
+		return fmt.Errorf("bad data type %d", t.DataType)
+	}
+	if t.Type == LSFTypeStream && t.DataType == LSFDataTypeReserved {
+		return fmt.Errorf("stream must have a data type")
+	}
+	if t.Type == LSFTypePacket && t.Signed {
+		return fmt.Errorf("only streams can be signed")
+	}
+	if t.EncryptionType > LSFEncryptionTypeOther {
+		return fmt.Errorf("bad encryption type %d", t.EncryptionType)
+	}
+	switch t.EncryptionType {
+	case LSFEncryptionTypeNone:
+		if t.Meta > LSFMetaTypeReserved {
+			return fmt.Errorf("bad META type %d", t.Meta)
+		}
+	case LSFEncryptionTypeScrambler:
+		if t.EncryptionSubtype > LSFEncryptionSubtypeScrambler24 {
+			return fmt.Errorf("bad scrambler subtype %d", t.EncryptionSubtype)
+		}
+	case LSFEncryptionTypeAES:
+		if t.EncryptionSubtype > LSFEncryptionSubtypeAES256 {
+			return fmt.Errorf("bad AES subtype %d", t.EncryptionSubtype)
+		}
+	}
+	if t.CAN > maxCAN {
+		return fmt.Errorf("CAN %d out of range (0-%d)", t.CAN, maxCAN)
+	}
+	return nil
+}
+
+func (t TypeField) String() string {
+	var s string
+	if t.Type == LSFTypeStream {
+		s = "stream"
+		switch t.DataType {
+		case LSFDataTypeData:
+			s += " data"
+		case LSFDataTypeVoice:
+			s += " voice"
+		case LSFDataTypeVoiceData:
+			s += " voice+data"
+		default:
+			s += " reserved"
+		}
+	} else {
+		s = "packet"
+	}
+	switch t.EncryptionType {
+	case LSFEncryptionTypeNone:
+		switch t.Meta {
+		case LSFMetaTypeNone:
+		case LSFMetaTypeText:
+			s += ", text META"
+		case LSFMetaTypeGNSS:
+			s += ", GNSS META"
+		case LSFMetaTypeExtendedCallsign:
+			s += ", extended callsign META"
+		default:
+			s += ", reserved META"
+		}
+	case LSFEncryptionTypeScrambler:
+		s += fmt.Sprintf(", scrambler-%d", 8*(t.EncryptionSubtype+1))
+	case LSFEncryptionTypeAES:
+		s += fmt.Sprintf(", AES-%d", 128+64*int(t.EncryptionSubtype))
+	default:
+		s += ", other encryption"
+	}
+	s += fmt.Sprintf(", CAN %d", t.CAN)
+	if t.Signed {
+		s += ", signed"
+	}
+	return s
+}
+
+// Version returns the spec version of the TYPE field layout, detecting it if
+// it isn't known.
+func (l *LSF) Version() LSFVersion {
+	if l.version == LSFVersionAuto {
+		return DetectLSFVersion(l.Type)
+	}
+	return l.version
+}
+
+// SetVersion converts the TYPE field to the layout of spec version v. The
+// CRC must be recalculated afterward.
+func (l *LSF) SetVersion(v LSFVersion) error {
+	if v != LSFVersion1 && v != LSFVersion2 {
+		return fmt.Errorf("can't convert LSF to version %d", v)
+	}
+	t := l.TypeField()
+	l.version = v
+	l.Type = t.Encode(v)
+	return nil
+}
+
+// ToVersion returns a copy of the LSF with the TYPE field converted to the
+// layout of spec version v and the CRC recalculated. LSFVersionAuto returns
+// the LSF unchanged.
+func (l LSF) ToVersion(v LSFVersion) LSF {
+	if v == LSFVersionAuto || v == l.Version() {
+		return l
+	}
+	l.SetVersion(v)
+	l.CalcCRC()
+	return l
+}
+
+// Use the layout of version v, if known, instead of detecting it
+func (l *LSF) assumeVersion(v LSFVersion) {
+	if v != LSFVersionAuto {
+		l.version = v
+	}
+}
+
+// assumeType settles the version of an LSF using auto detection when it's
+// known to be for a stream or a packet
+func (l *LSF) assumeType(t LSFType) {
+	if l.version == LSFVersionAuto {
+		l.version = detectLSFVersionFor(l.Type, t)
+	}
+}
+
+// TypeField returns a structured view of the TYPE field.
+func (l *LSF) TypeField() TypeField {
+	return DecodeTypeField(l.Type, l.Version())
+}
+
+// SetTypeField validates t and stores it in the TYPE field. The CRC must be
+// recalculated afterward.
+func (l *LSF) SetTypeField(t TypeField) error {
+	err := t.Validate()
+	if err != nil {
+		return err
+	}
+	l.setTypeField(t, l.Version())
+	return nil
+}
+
+// ValidateType checks the TYPE field, including values that are reserved in
+// its layout.
+func (l *LSF) ValidateType() error {
+	b := binary.BigEndian.Uint16(l.Type[:])
+	if l.Version() == LSFVersion2 {
+		return validateTypeV2(b)
+	}
+	return validateTypeV1(b)
+}
+
+// Change the TYPE field with f, keeping its layout
+func (l *LSF) updateTypeField(f func(t *TypeField)) {
+	v := l.Version()
+	t := DecodeTypeField(l.Type, v)
+	f(&t)
+	l.setTypeField(t, v)
+}
+
+// Store t with the layout of version v. The version is remembered if it
+// can't be detected from the result.
+func (l *LSF) setTypeField(t TypeField, v LSFVersion) {
+	l.Type = t.Encode(v)
+	if l.version != LSFVersionAuto || DetectLSFVersion(l.Type) != v {
+		l.version = v
+	}
+}
+
+func (l *LSF) LSFType() LSFType {
+	return l.TypeField().Type
+}
+
+func (l *LSF) DataType() LSFDataType {
+	return l.TypeField().DataType
+}
+
+func (l *LSF) EncryptionType() LSFEncryptionType {
+	return l.TypeField().EncryptionType
+}
+
+func (l *LSF) EncryptionSubtype() LSFEncryptionSubtype {
+	return l.TypeField().EncryptionSubtype
+}
+
+// Set the encryption type and subtype. The CRC must be recalculated afterward.
+func (l *LSF) SetEncryption(et LSFEncryptionType, st LSFEncryptionSubtype) {
+	l.updateTypeField(func(t *TypeField) {
+		t.EncryptionType = et
+		t.EncryptionSubtype = st
+		if et == LSFEncryptionTypeNone {
+			t.EncryptionSubtype = 0
+		}
+	})
+}
+
+// MetaType returns the type of data in the META field. It is only meaningful
+// when EncryptionType is LSFEncryptionTypeNone.
+func (l *LSF) MetaType() LSFMetaType {
+	return l.TypeField().Meta
+}
+
+// SetMetaType sets the META type, which also marks the transmission as
+// unencrypted. The CRC must be recalculated afterward.
+func (l *LSF) SetMetaType(m LSFMetaType) {
+	l.updateTypeField(func(t *TypeField) {
+		t.EncryptionType = LSFEncryptionTypeNone
+		t.EncryptionSubtype = 0
+		t.Meta = m
+	})
+}
+
+// CAN returns the Channel Access Number.
+func (l *LSF) CAN() byte {
+	return l.TypeField().CAN
+}
+
+// SetCAN sets the Channel Access Number. The CRC must be recalculated afterward.
+func (l *LSF) SetCAN(can byte) error {
+	if can > maxCAN {
+		return fmt.Errorf("CAN %d out of range (0-%d)", can, maxCAN)
+	}
+	l.updateTypeField(func(t *TypeField) {
+		t.CAN = can
+	})
+	return nil
+}
+
+// Signed reports whether the stream carries a digital signature.
+func (l *LSF) Signed() bool {
+	return l.TypeField().Signed
+}
+
+// SetSigned sets the signed stream flag. The CRC must be recalculated afterward.
+func (l *LSF) SetSigned(signed bool) {
+	l.updateTypeField(func(t *TypeField) {
+		t.Signed = signed
+	})
+}
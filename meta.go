@@ -0,0 +1,286 @@
+package m17
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/bits"
+	"strings"
+)
+
+// LSFMetaType says what the META field holds when the stream is not encrypted.
+type LSFMetaType byte
+
+const (
+	// Only spec v2 can say the META field is unused
+	LSFMetaTypeNone LSFMetaType = iota
+	LSFMetaTypeText
+	LSFMetaTypeGNSS
+	LSFMetaTypeExtendedCallsign
+	LSFMetaTypeReserved
+)
+
+// SetExtendedCallsign puts Extended Callsign Data in the META field and sets
+// the META type to match. Field 1 holds the callsign of the station that
+// originated the traffic and field 2 the reflector it passed through. An empty
+// field 2 is left as zeros. The CRC must be recalculated afterward.
+func (l *LSF) SetExtendedCallsign(field1, field2 EncodedCallsign) {
+	l.Meta = [metaLen]byte{}
+	copy(l.Meta[:EncodedCallsignLen], field1[:])
+	copy(l.Meta[EncodedCallsignLen:], field2[:])
+	l.SetMetaType(LSFMetaTypeExtendedCallsign)
+}
+
+// ExtendedCallsign returns the callsign fields of the Extended Callsign Data
+// in the META field. ok is false if the META field doesn't hold them.
+func (l *LSF) ExtendedCallsign() (field1, field2 EncodedCallsign, ok bool) {
+	if l.EncryptionType() != LSFEncryptionTypeNone || l.MetaType() != LSFMetaTypeExtendedCallsign {
+		return field1, field2, false
+	}
+	copy(field1[:], l.Meta[:EncodedCallsignLen])
+	copy(field2[:], l.Meta[EncodedCallsignLen:])
+	return field1, field2, true
+}
+
+// Originator returns the callsign of the station that originated a
+// transmission. That's field 1 of the Extended Callsign Data if present,
+// otherwise the source callsign.
+func (l *LSF) Originator() string {
+	if field1, _, ok := l.ExtendedCallsign(); ok && field1 != (EncodedCallsign{}) {
+		return field1.Callsign()
+	}
+	return l.Src.Callsign()
+}
+
+const (
+	// Each Text Data block is a control byte and 13 bytes of text
+	MetaTextBlockLen  = metaLen - 1
+	maxMetaTextBlocks = 4
+	MaxMetaTextLen    = maxMetaTextBlocks * MetaTextBlockLen
+)
+
+// MetaTextBlocks splits text into the Text Data META blocks that carry it.
+// The control byte at the start of each block has a bitmap of all the blocks
+// in the high nibble and the bit for this block in the low nibble. The last
+// block is padded with spaces.
+func MetaTextBlocks(text string) ([][metaLen]byte, error) {
+	if len(text) > MaxMetaTextLen {
+		return nil, fmt.Errorf("text length %d exceeds %d", len(text), MaxMetaTextLen)
+	}
+	n := max(1, (len(text)+MetaTextBlockLen-1)/MetaTextBlockLen)
+	all := byte(1<<n-1) << 4
+	blocks := make([][metaLen]byte, n)
+	for i := range blocks {
+		blocks[i][0] = all | 1<<i
+		copy(blocks[i][1:], bytes.Repeat([]byte{' '}, MetaTextBlockLen))
+		copy(blocks[i][1:], text[min(len(text), i*MetaTextBlockLen):])
+	}
+	return blocks, nil
+}
+
+// SetTextBlock puts a Text Data block from MetaTextBlocks in the META field
+// and sets the META type to match. The CRC must be recalculated afterward.
+func (l *LSF) SetTextBlock(block [metaLen]byte) {
+	l.Meta = block
+	l.SetMetaType(LSFMetaTypeText)
+}
+
+// MetaText reassembles text sent in Text Data blocks in a series of LSFs.
+type MetaText struct {
+	blocks [maxMetaTextBlocks][MetaTextBlockLen]byte
+	// Bitmaps of the blocks in the text and the blocks received so far
+	want byte
+	have byte
+}
+
+// Add adds the Text Data block from lsf, if it holds one. It returns the text
+// and true when the block completes it.
+func (t *MetaText) Add(lsf *LSF) (string, bool) {
+	if lsf.EncryptionType() != LSFEncryptionTypeNone || lsf.MetaType() != LSFMetaTypeText {
+		return "", false
+	}
+	want := lsf.Meta[0] >> 4
+	block := lsf.Meta[0] & 0xF
+	if want == 0 || block&want != block || block&(block-1) != 0 || block == 0 {
+		// Not a valid Text Data control byte
+		return "", false
+	}
+	if want != t.want {
+		t.Reset()
+		t.want = want
+	}
+	i := bits.TrailingZeros8(block)
+	copy(t.blocks[i][:], lsf.Meta[1:])
+	t.have |= block
+	if t.have != t.want {
+		return "", false
+	}
+	var text []byte
+	for i := range bits.Len8(t.want) {
+		text = append(text, t.blocks[i][:]...)
+	}
+	// Start over for the next time the text is sent
+	t.have = 0
+	return strings.TrimRight(string(text), " \x00"), true
+}
+
+// Reset discards any partial text.
+func (t *MetaText) Reset() {
+	*t = MetaText{}
+}
+
+// GNSSDataSource identifies what generated a GNSS position.
+type GNSSDataSource byte
+
+const (
+	GNSSDataSourceM17Client GNSSDataSource = 0
+	GNSSDataSourceOpenRTX   GNSSDataSource = 1
+	GNSSDataSourceOther     GNSSDataSource = 0xF
+)
+
+// GNSSStationType describes the station sending a GNSS position.
+type GNSSStationType byte
+
+const (
+	GNSSStationTypeFixed GNSSStationType = iota
+	GNSSStationTypeMobile
+	GNSSStationTypeHandheld
+)
+
+// GNSS META validity flags
+const (
+	gnssValidRadius = 1 << iota
+	gnssValidVelocity
+	gnssValidAltitude
+	gnssValidPosition
+)
+
+const (
+	// Full scale latitude and longitude values
+	gnssCoordScale = 1<<23 - 1
+	// Altitudes are sent in 0.5 m steps from -500 m
+	gnssAltitudeOffset = 500
+	gnssAltitudeStep   = 0.5
+	// Speeds are sent in 0.5 km/h steps
+	gnssSpeedStep = 0.5
+)
+
+// GNSS is a position report carried in the LSF META field. Each group of
+// fields is only meaningful when its validity flag is set.
+type GNSS struct {
+	Source      GNSSDataSource
+	StationType GNSSStationType
+
+	PositionValid bool
+	// Degrees, north and east positive
+	Latitude  float64
+	Longitude float64
+
+	AltitudeValid bool
+	// Meters above sea level, -500 to 32267
+	Altitude float64
+
+	VelocityValid bool
+	// Kilometers per hour, 0 to 2047.5
+	Speed float64
+	// Degrees clockwise from true north, 0 to 359
+	Bearing uint16
+
+	RadiusValid bool
+	// Position uncertainty in meters is 2^Radius, Radius 0 to 7
+	Radius byte
+}
+
+func (g GNSS) String() string {
+	if !g.PositionValid {
+		return "no position"
+	}
+	s := fmt.Sprintf("%.5f,%.5f", g.Latitude, g.Longitude)
+	if g.AltitudeValid {
+		s += fmt.Sprintf(" alt %.1fm", g.Altitude)
+	}
+	if g.VelocityValid {
+		s += fmt.Sprintf(" %.1fkm/h %d°", g.Speed, g.Bearing)
+	}
+	return s
+}
+
+// Convert a value to a fixed point integer, clamped to [lo, hi]
+func toFixed(v, step, lo, hi float64) int64 {
+	return int64(math.Round(math.Max(lo, math.Min(hi, v)) / step))
+}
+
+// SetGNSS puts a position report in the META field and sets the META type
+// to match. The CRC must be recalculated afterward.
+//
+// Layout, big endian: data source (4 bits), station type (4), validity (4),
+// radius (3), bearing (9), latitude (24), longitude (24), altitude (16),
+// speed (12) and 12 reserved bits.
+func (l *LSF) SetGNSS(g GNSS) {
+	var valid uint64
+	if g.PositionValid {
+		valid |= gnssValidPosition
+	}
+	if g.AltitudeValid {
+		valid |= gnssValidAltitude
+	}
+	if g.VelocityValid {
+		valid |= gnssValidVelocity
+	}
+	if g.RadiusValid {
+		valid |= gnssValidRadius
+	}
+	lat := toFixed(g.Latitude, 90.0/gnssCoordScale, -90, 90)
+	lon := toFixed(g.Longitude, 180.0/gnssCoordScale, -180, 180)
+	alt := toFixed(g.Altitude+gnssAltitudeOffset, gnssAltitudeStep, 0, math.MaxUint16*gnssAltitudeStep)
+	speed := toFixed(g.Speed, gnssSpeedStep, 0, 0xFFF*gnssSpeedStep)
+
+	hi := uint64(g.Source&0xF)<<60 |
+		uint64(g.StationType&0xF)<<56 |
+		valid<<52 |
+		uint64(g.Radius&0x7)<<49 |
+		uint64(g.Bearing%360)<<40 |
+		uint64(lat&0xFFFFFF)<<16 |
+		uint64(lon&0xFFFFFF)>>8
+	lo := uint64(lon&0xFF)<<40 |
+		uint64(alt)<<24 |
+		uint64(speed)<<12
+	var meta [16]byte
+	binary.BigEndian.PutUint64(meta[:8], hi)
+	binary.BigEndian.PutUint64(meta[8:], lo<<16)
+	copy(l.Meta[:], meta[:metaLen])
+	l.SetMetaType(LSFMetaTypeGNSS)
+}
+
+// Sign extend a 24 bit value
+func signExtend24(v uint64) int64 {
+	return int64(v<<40) >> 40
+}
+
+// GNSS returns the position report in the META field. ok is false if the
+// META field doesn't hold a position.
+func (l *LSF) GNSS() (g GNSS, ok bool) {
+	if l.EncryptionType() != LSFEncryptionTypeNone || l.MetaType() != LSFMetaTypeGNSS {
+		return g, false
+	}
+	var meta [16]byte
+	copy(meta[:], l.Meta[:])
+	hi := binary.BigEndian.Uint64(meta[:8])
+	lo := binary.BigEndian.Uint64(meta[8:]) >> 16
+
+	g.Source = GNSSDataSource(hi >> 60)
+	g.StationType = GNSSStationType((hi >> 56) & 0xF)
+	valid := (hi >> 52) & 0xF
+	g.PositionValid = valid&gnssValidPosition != 0
+	g.AltitudeValid = valid&gnssValidAltitude != 0
+	g.VelocityValid = valid&gnssValidVelocity != 0
+	g.RadiusValid = valid&gnssValidRadius != 0
+	g.Radius = byte((hi >> 49) & 0x7)
+	g.Bearing = uint16((hi >> 40) & 0x1FF)
+	g.Latitude = float64(signExtend24((hi>>16)&0xFFFFFF)) * 90 / gnssCoordScale
+	g.Longitude = float64(signExtend24((hi&0xFFFF)<<8|(lo>>40))) * 180 / gnssCoordScale
+	g.Altitude = float64((lo>>24)&0xFFFF)*gnssAltitudeStep - gnssAltitudeOffset
+	g.Speed = float64((lo>>12)&0xFFF) * gnssSpeedStep
+	return g, true
+}
@@ -0,0 +1,209 @@
+package m17
+
+import (
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/icza/gog"
+)
+
+func TestLSF_GNSS(t *testing.T) {
+	tests := []struct {
+		name string
+		g    GNSS
+		want GNSS
+	}{
+		{
+			name: "mobile",
+			g: GNSS{
+				Source: GNSSDataSourceOpenRTX, StationType: GNSSStationTypeMobile,
+				PositionValid: true, Latitude: 43.6615, Longitude: -70.2553,
+				AltitudeValid: true, Altitude: 18.5,
+				VelocityValid: true, Speed: 88.5, Bearing: 271,
+				RadiusValid: true, Radius: 3,
+			},
+		},
+		{
+			name: "southern hemisphere, no altitude",
+			g: GNSS{
+				Source: GNSSDataSourceM17Client, StationType: GNSSStationTypeHandheld,
+				PositionValid: true, Latitude: -33.8688, Longitude: 151.2093,
+			},
+		},
+		{
+			name: "extremes",
+			g: GNSS{
+				Source: GNSSDataSourceOther, StationType: GNSSStationTypeFixed,
+				PositionValid: true, Latitude: 90, Longitude: -180,
+				AltitudeValid: true, Altitude: -500,
+				VelocityValid: true, Speed: 0, Bearing: 359,
+			},
+		},
+		{
+			name: "out of range",
+			g: GNSS{
+				PositionValid: true, Latitude: 91, Longitude: 181,
+				AltitudeValid: true, Altitude: -1000,
+				VelocityValid: true, Speed: 5000, Bearing: 360,
+			},
+			want: GNSS{
+				PositionValid: true, Latitude: 90, Longitude: 180,
+				AltitudeValid: true, Altitude: -500,
+				VelocityValid: true, Speed: 2047.5, Bearing: 0,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want := tt.want
+			if want == (GNSS{}) {
+				want = tt.g
+			}
+			lsf := gog.Must(NewLSF("@ALL", "N0CALL", LSFTypeStream, LSFDataTypeVoice, LSFEncryptionTypeNone, 0, 0))
+			lsf.SetGNSS(tt.g)
+			lsf.CalcCRC()
+			if lsf.EncryptionType() != LSFEncryptionTypeNone || lsf.MetaType() != LSFMetaTypeGNSS {
+				t.Errorf("LSF type = %#v, want GNSS META", lsf.Type)
+			}
+			if lsf.LSFType() != LSFTypeStream {
+				t.Errorf("SetGNSS() changed LSF type %#v", lsf.Type)
+			}
+			received := NewLSFFromBytes(lsf.ToBytes())
+			got, ok := received.GNSS()
+			if !ok {
+				t.Fatalf("LSF.GNSS() ok = false")
+			}
+			// Coordinates are sent with about 1e-5 degree resolution
+			if math.Abs(got.Latitude-want.Latitude) > 2e-5 || math.Abs(got.Longitude-want.Longitude) > 3e-5 {
+				t.Errorf("LSF.GNSS() position = %f,%f, want %f,%f", got.Latitude, got.Longitude, want.Latitude, want.Longitude)
+			}
+			got.Latitude, got.Longitude = want.Latitude, want.Longitude
+			if got != want {
+				t.Errorf("LSF.GNSS() = %#v, want %#v", got, want)
+			}
+		})
+	}
+}
+
+func TestLSF_GNSSWrongType(t *testing.T) {
+	lsf := gog.Must(NewLSF("@ALL", "N0CALL", LSFTypeStream, LSFDataTypeVoice, LSFEncryptionTypeNone, 0, 0))
+	if _, ok := lsf.GNSS(); ok {
+		t.Errorf("LSF.GNSS() ok = true for text META")
+	}
+	lsf.SetGNSS(GNSS{PositionValid: true, Latitude: 1, Longitude: 1})
+	lsf.SetEncryption(LSFEncryptionTypeScrambler, LSFEncryptionSubtypeScrambler16)
+	if _, ok := lsf.GNSS(); ok {
+		t.Errorf("LSF.GNSS() ok = true for encrypted stream")
+	}
+}
+
+func TestLSF_ExtendedCallsign(t *testing.T) {
+	tests := []struct {
+		name   string
+		src    string
+		field1 string
+		field2 string
+		want   string
+	}{
+		{"relayed", "N1ADJ", "N0CALL", "N1ADJ G", "N0CALL"},
+		{"no reflector", "N1ADJ", "N0CALL", "", "N0CALL"},
+		{"empty originator", "N1ADJ", "", "N1ADJ G", "N1ADJ"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lsf := gog.Must(NewLSF("@ALL", tt.src, LSFTypeStream, LSFDataTypeVoice, LSFEncryptionTypeNone, 0, 0))
+			var f1, f2 EncodedCallsign
+			if tt.field1 != "" {
+				f1 = *gog.Must(EncodeCallsign(tt.field1))
+			}
+			if tt.field2 != "" {
+				f2 = *gog.Must(EncodeCallsign(tt.field2))
+			}
+			lsf.SetExtendedCallsign(f1, f2)
+			lsf.CalcCRC()
+			if lsf.MetaType() != LSFMetaTypeExtendedCallsign {
+				t.Errorf("LSF META type = %d, want %d", lsf.MetaType(), LSFMetaTypeExtendedCallsign)
+			}
+			received := NewLSFFromBytes(lsf.ToBytes())
+			got1, got2, ok := received.ExtendedCallsign()
+			if !ok {
+				t.Fatalf("LSF.ExtendedCallsign() ok = false")
+			}
+			if got1 != f1 || got2 != f2 {
+				t.Errorf("LSF.ExtendedCallsign() = %s, %s, want %s, %s", got1.Callsign(), got2.Callsign(), tt.field1, tt.field2)
+			}
+			if got := received.Originator(); got != tt.want {
+				t.Errorf("LSF.Originator() = %s, want %s", got, tt.want)
+			}
+			if _, ok := received.GNSS(); ok {
+				t.Errorf("LSF.GNSS() ok = true for Extended Callsign Data")
+			}
+		})
+	}
+	lsf := gog.Must(NewLSF("@ALL", "N0CALL", LSFTypeStream, LSFDataTypeVoice, LSFEncryptionTypeNone, 0, 0))
+	if _, _, ok := lsf.ExtendedCallsign(); ok {
+		t.Errorf("LSF.ExtendedCallsign() ok = true for text META")
+	}
+}
+
+func TestMetaText(t *testing.T) {
+	tests := []struct {
+		name    string
+		text    string
+		blocks  int
+		wantErr bool
+	}{
+		{"empty", "", 1, false},
+		{"one block", "Hello", 1, false},
+		{"full block", "0123456789ABC", 1, false},
+		{"two blocks", "0123456789ABCD", 2, false},
+		{"four blocks", strings.Repeat("x", MaxMetaTextLen), 4, false},
+		{"too long", strings.Repeat("x", MaxMetaTextLen+1), 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			blocks, err := MetaTextBlocks(tt.text)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("MetaTextBlocks() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(blocks) != tt.blocks {
+				t.Fatalf("MetaTextBlocks() len = %d, want %d", len(blocks), tt.blocks)
+			}
+			if tt.wantErr {
+				return
+			}
+			lsf := gog.Must(NewLSF("@ALL", "N0CALL", LSFTypeStream, LSFDataTypeVoice, LSFEncryptionTypeNone, 0, 0))
+			var mt MetaText
+			// Blocks may arrive in any order, starting anywhere
+			for i := range blocks {
+				lsf.SetTextBlock(blocks[(i+1)%len(blocks)])
+				got, ok := mt.Add(&lsf)
+				if ok != (i == len(blocks)-1) {
+					t.Fatalf("MetaText.Add() block %d ok = %v", i, ok)
+				}
+				if ok && got != tt.text {
+					t.Errorf("MetaText.Add() = %q, want %q", got, tt.text)
+				}
+			}
+		})
+	}
+}
+
+func TestMetaText_Changed(t *testing.T) {
+	lsf := gog.Must(NewLSF("@ALL", "N0CALL", LSFTypeStream, LSFDataTypeVoice, LSFEncryptionTypeNone, 0, 0))
+	var mt MetaText
+	first := gog.Must(MetaTextBlocks("This is the first text"))
+	second := gog.Must(MetaTextBlocks("Short"))
+	lsf.SetTextBlock(first[0])
+	mt.Add(&lsf)
+	// A different number of blocks discards the partial text
+	lsf.SetTextBlock(second[0])
+	if got, ok := mt.Add(&lsf); !ok || got != "Short" {
+		t.Errorf("MetaText.Add() = %q, %v, want Short", got, ok)
+	}
+	lsf.SetGNSS(GNSS{})
+	if _, ok := mt.Add(&lsf); ok {
+		t.Errorf("MetaText.Add() accepted GNSS META")
+	}
+}
@@ -1,11 +1,13 @@
 package m17
 
 import (
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"net"
 	"os"
 	"sync"
@@ -16,6 +18,10 @@ import (
 
 const (
 	samplesPerSecond = 24000
+	// Samples are read from the modem in blocks of up to 20 ms
+	rxBlockSize = samplesPerSecond / 50
+	// Up to a second of received samples are queued
+	rxQueueBlocks = 50
 
 // samplesPer40MS   = samplesPerSecond / 1000 * 40
 // samplesPerSymbol = 5
@@ -65,6 +71,8 @@ type Modem interface {
 	io.ReadCloser
 	TransmitPacket(Packet) error
 	TransmitVoiceStream(StreamDatagram) error
+	// TransmitBERT sends a BERT transmission of the given number of frames
+	TransmitBERT(frames int) error
 	StartRX() error
 	Reset() error
 	SetAFC(afc bool) error
@@ -74,9 +82,41 @@ type Modem interface {
 	SetTXPower(dbm float32) error
 }
 type DummyModem struct {
-	In    io.ReadCloser
-	Out   io.WriteCloser
-	extra []byte
+	In  io.ReadCloser
+	Out io.WriteCloser
+	// Keys, if set, is used to encrypt unencrypted streams before transmission
+	Keys *KeyStore
+	// InFormat and OutFormat are the formats of In and Out. In is read as a
+	// WAV file whatever InFormat is if it starts with a WAV header. IQ
+	// samples read from In are FM demodulated, and symbols written to Out in
+	// an IQ format are FM modulated.
+	InFormat  SampleFormat
+	OutFormat SampleFormat
+	// SampleRate, if set, is the rate of the samples written to Out, and of
+	// those read from In unless its format sets the rate. With FormatSymbols,
+	// setting it means In and Out carry float32 samples, such as a sound card
+	// capture or the output of an SDR's FM demodulator, rather than one
+	// float32 per symbol.
+	SampleRate int
+	// Deviation, if set, is the FM deviation of the outer symbols in Hz for
+	// IQ written to Out. Otherwise it's the standard 2.4 kHz.
+	Deviation float64
+	extra     []byte
+	reader    *SampleReader
+	writer    *SampleWriter
+	// filters between symbols and samples, and their buffers
+	rx      Filter[float32, float32]
+	iq      Filter[complex64, float32]
+	tx      Filter[Symbol, float32]
+	fm      *FMModulator
+	iqBuf   []complex64
+	samples []float32
+	rxBuf   []float32
+	txBuf   []float32
+	txIQBuf []complex64
+	// encoder for the stream currently being transmitted, nil when idle
+	stream   *StreamEncoder
+	streamID uint16
 }
 
 func (m *DummyModem) TransmitPacket(p Packet) error {
@@ -84,7 +124,7 @@ func (m *DummyModem) TransmitPacket(p Packet) error {
 	if err != nil {
 		return err
 	}
-	err = binary.Write(m.Out, binary.LittleEndian, encoded)
+	err = m.writeSymbols(encoded)
 	if err != nil {
 		return fmt.Errorf("failed to send: %w", err)
 	}
@@ -92,50 +132,174 @@ func (m *DummyModem) TransmitPacket(p Packet) error {
 }
 
 func (m *DummyModem) TransmitVoiceStream(sd StreamDatagram) error {
+	var syms []Symbol
+	if m.stream != nil && m.streamID != sd.StreamID {
+		// A new stream started before the old one ended, so end the old one
+		log.Printf("[DEBUG] Stream %x replaced by %x before last frame", m.streamID, sd.StreamID)
+		syms = m.stream.End()
+		m.stream = nil
+	}
+	if m.stream == nil {
+		// First frame
+		log.Printf("[DEBUG] Sending first frame of stream %x, fn %d, lsf: %v", sd.StreamID, sd.FrameNumber, sd.LSF)
+		enc, err := newTXStreamEncoder(sd.LSF, m.Keys)
+		if err != nil {
+			return err
+		}
+		m.stream = enc
+		m.streamID = sd.StreamID
+		start, err := m.stream.Start()
+		if err != nil {
+			return fmt.Errorf("failed to generate LSF symbols: %w", err)
+		}
+		syms = append(syms, start...)
+	}
+	frame, err := m.stream.EncodeFrame(sd.FrameNumber, sd.Payload)
+	if err != nil {
+		return fmt.Errorf("failed to generate stream symbols: %w", err)
+	}
+	syms = append(syms, frame...)
+	if sd.LastFrame {
+		log.Printf("[DEBUG] Sending EOT for stream %x, fn %d", sd.StreamID, sd.FrameNumber)
+		syms = append(syms, m.stream.End()...)
+		m.stream = nil
+	}
+	err = m.writeSymbols(syms)
+	if err != nil {
+		return fmt.Errorf("failed to send: %w", err)
+	}
 	return nil
 }
 
-func (m *DummyModem) Read(p []byte) (n int, err error) {
-	l := len(p)
-	el := len(m.extra)
-	log.Printf("[DEBUG] Request to read %d bytes, el: %d", l, el)
-	if el < l {
-		rl := (l - el) / 5
-		if (l-el)%5 > 0 {
-			// make sure we have enough symbols
-			rl++
+func (m *DummyModem) TransmitBERT(frames int) error {
+	syms, err := NewBERTEncoder().Encode(frames)
+	if err != nil {
+		return err
+	}
+	err = m.writeSymbols(syms)
+	if err != nil {
+		return fmt.Errorf("failed to send: %w", err)
+	}
+	return nil
+}
+
+// Return format, or FormatFloat32 for symbols if SampleRate is set
+func (m *DummyModem) format(format SampleFormat) SampleFormat {
+	if format == FormatSymbols && m.SampleRate != 0 {
+		return FormatFloat32
+	}
+	return format
+}
+
+// Write symbols to Out, shaped into samples or modulated unless it takes
+// symbols
+func (m *DummyModem) writeSymbols(syms []Symbol) error {
+	if m.writer == nil {
+		w, err := NewSampleWriter(m.Out, m.format(m.OutFormat), m.SampleRate)
+		if err != nil {
+			return err
+		}
+		m.writer = w
+	}
+	if m.writer.Format == FormatSymbols {
+		m.txBuf = m.txBuf[:0]
+		for _, s := range syms {
+			m.txBuf = append(m.txBuf, float32(s))
 		}
-		// Get whole symbols
-		if rl%4 > 0 {
-			rl += 4 - rl%4
+		return m.writer.WriteSamples(m.txBuf)
+	}
+	if m.writer.Format.IsIQ() {
+		if m.fm == nil {
+			fm, err := NewFMModulator(m.writer.SampleRate, m.Deviation)
+			if err != nil {
+				return err
+			}
+			m.fm = fm
+		}
+		m.txIQBuf = m.fm.Process(m.txIQBuf[:0], syms)
+		return m.writer.WriteIQ(m.txIQBuf)
+	}
+	if m.tx == nil {
+		tx, err := NewTXFilter(m.writer.SampleRate)
+		if err != nil {
+			return err
 		}
-		sBuff := make([]byte, rl)
-		log.Printf("[DEBUG] Attempting to read %d bytes", len(sBuff))
-		nn, err := m.In.Read(sBuff)
+		m.tx = tx
+	}
+	m.txBuf = m.tx.Process(m.txBuf[:0], syms)
+	return m.writer.WriteSamples(m.txBuf)
+}
+
+// Read returns float32 symbols at 5 samples per symbol, repeating symbols read
+// from In or filtering samples down to symbols.
+func (m *DummyModem) Read(p []byte) (int, error) {
+	if m.reader == nil {
+		r, err := NewSampleReader(m.In, m.format(m.InFormat), m.SampleRate)
 		if err != nil {
+			return 0, err
+		}
+		m.reader = r
+		log.Printf("[DEBUG] DummyModem reading %s at %d Hz", r.Format, r.SampleRate)
+	}
+	for len(m.extra) == 0 {
+		nn, err := m.readSymbols(max(len(p)/4, 1))
+		if err != nil && err != io.EOF {
 			log.Printf("[ERROR] DummyModem Read failed: %v", err)
-			if nn == 0 {
+		}
+		for _, s := range m.rxBuf[:nn] {
+			m.extra = binary.LittleEndian.AppendUint32(m.extra, math.Float32bits(s))
+		}
+		if err != nil {
+			if len(m.extra) == 0 {
 				return 0, err
 			}
+			break
 		}
-		log.Printf("[DEBUG] Read %d bytes", nn)
-		if nn%4 != 0 {
-			// panic("handle this!")
-			nn -= nn % 4
+	}
+	n := copy(p, m.extra)
+	m.extra = m.extra[n:]
+	return n, nil
+}
+
+// Read up to about n symbols at 5 samples per symbol into rxBuf
+func (m *DummyModem) readSymbols(n int) (int, error) {
+	if m.reader.Format == FormatSymbols {
+		// Repeat each read symbol 5 times
+		m.samples = resize(m.samples, (n+decoderSamplesPerSymbol-1)/decoderSamplesPerSymbol)
+		nn, err := m.reader.ReadSamples(m.samples)
+		m.rxBuf = m.rxBuf[:0]
+		for _, s := range m.samples[:nn] {
+			for range decoderSamplesPerSymbol {
+				m.rxBuf = append(m.rxBuf, s)
+			}
 		}
-		sBuff = sBuff[:nn]
-		for i := 0; i < nn; i += 4 {
-			// Repeat each read symbol 5 times
-			for range 5 {
-				m.extra = append(m.extra, sBuff[i:i+4]...)
+		return len(m.rxBuf), err
+	}
+	if m.reader.Format.IsIQ() {
+		if m.iq == nil {
+			iq, err := NewIQDemodulator(m.reader.SampleRate)
+			if err != nil {
+				return 0, err
 			}
+			m.iq = iq
+		}
+		// Read enough IQ samples for about n samples out
+		m.iqBuf = resize(m.iqBuf, max(1, n*m.reader.SampleRate/decoderSampleRate))
+		nn, err := m.reader.ReadIQ(m.iqBuf)
+		m.rxBuf = m.iq.Process(m.rxBuf[:0], m.iqBuf[:nn])
+		return len(m.rxBuf), err
+	}
+	if m.rx == nil {
+		rx, err := NewRXFilter(m.reader.SampleRate)
+		if err != nil {
+			return 0, err
 		}
-		l = min(l, len(m.extra))
+		m.rx = rx
 	}
-	n = copy(p, m.extra[:l])
-	m.extra = m.extra[l:]
-	log.Printf("[DEBUG] Returning %d bytes", n)
-	return
+	m.samples = resize(m.samples, n)
+	nn, err := m.reader.ReadSamples(m.samples)
+	m.rxBuf = m.rx.Process(m.rxBuf[:0], m.samples[:nn])
+	return len(m.rxBuf), err
 }
 
 func (m *DummyModem) Write(buf []byte) (n int, err error) {
@@ -164,16 +328,33 @@ func (m *DummyModem) StartRX() error {
 }
 
 func (m *DummyModem) Close() error {
-	err := m.In.Close()
-	err2 := m.Out.Close()
-	return errors.Join(err, err2)
+	var errs []error
+	if m.In != nil {
+		errs = append(errs, m.In.Close())
+	}
+	if m.writer != nil {
+		// Complete the WAV header before closing Out
+		errs = append(errs, m.writer.Close())
+	}
+	if m.Out != nil {
+		errs = append(errs, m.Out.Close())
+	}
+	return errors.Join(errs...)
 }
 
 type CC1200Modem struct {
-	modem     io.ReadWriteCloser
-	rxSymbols chan float32
+	// Keys, if set, is used to encrypt unencrypted streams before transmission
+	Keys *KeyStore
+
+	modem io.ReadWriteCloser
+	rx    *Pipeline[int8, float32]
+	// received symbols, reused by Read
+	rxBuf []float32
 	// txSymbols chan float32
-	s2s SymbolToSample
+	s2s *SymbolToSample
+	// encoder for the stream currently being transmitted, nil when idle
+	streamEnc *StreamEncoder
+	streamID  uint16
 
 	trxMutex sync.Mutex
 	trxState int
@@ -192,7 +373,6 @@ func NewCC1200Modem(
 	boot0Pin int,
 	baudRate int) (*CC1200Modem, error) {
 	ret := CC1200Modem{
-		rxSymbols: make(chan float32),
 		s2s:       NewSymbolToSample(rrcTaps5, TXSymbolScalingCoeff*transmitGain, false, 5),
 		cmdSource: make(chan byte),
 	}
@@ -227,12 +407,11 @@ func NewCC1200Modem(
 			return nil, fmt.Errorf("modem open: %w", err)
 		}
 	}
-	rxSource := make(chan int8, samplesPerSecond)
-	ret.rxSymbols, err = ret.rxPipeline(rxSource)
+	ret.rx, err = ret.rxPipeline()
 	if err != nil {
 		return nil, fmt.Errorf("rx pipeline setup: %w", err)
 	}
-	go ret.processReceivedData(rxSource)
+	go ret.processReceivedData()
 
 	_, err = ret.commandWithResponse([]byte{cmdPing, 2})
 	if err != nil {
@@ -247,49 +426,53 @@ func NewCC1200Modem(
 	return &ret, nil
 }
 
-func (m *CC1200Modem) processReceivedData(rxSource chan int8) {
-	buf := make([]byte, 1)
+func (m *CC1200Modem) processReceivedData() {
+	buf := make([]byte, rxBlockSize)
+	samples := make([]int8, rxBlockSize)
+	// samples dropped since the pipeline last had room
+	dropped := 0
 	for {
 		// log.Printf("[DEBUG] processReceivedData Read()")
 		n, err := m.modem.Read(buf)
 		if n > 0 {
-			// log.Printf("[DEBUG] processReceivedData read %x, trxState: %d", buf[0], m.trxState.Load())
+			// log.Printf("[DEBUG] processReceivedData read % x, trxState: %d", buf[:n], m.trxState)
 			m.trxMutex.Lock()
 			if m.trxState == trxRX {
 				m.trxMutex.Unlock()
-				select {
-				case rxSource <- int8(buf[0]):
-					// sent
-					// log.Printf("[DEBUG] processReceivedData rxSource <- : %x", buf[0])
-				default:
-					// pipeline is full, so drop it
-					log.Printf("[DEBUG] processReceivedData dropped rx: %x", buf[0])
+				for i, b := range buf[:n] {
+					samples[i] = int8(b)
+				}
+				// Waiting for room would only leave the samples to overflow
+				// the serial port's buffer instead, so drop them
+				if !m.rx.TryWrite(samples[:n]) {
+					if dropped == 0 {
+						log.Printf("[ERROR] Receive pipeline full, dropping samples")
+					}
+					dropped += n
+				} else if dropped > 0 {
+					log.Printf("[ERROR] Dropped %d received samples (%d ms) while the receive pipeline was full", dropped, dropped*1000/samplesPerSecond)
+					dropped = 0
 				}
 			} else {
 				m.trxMutex.Unlock()
-				// log.Printf("[DEBUG] processReceivedData cmdSource <- : %x", buf[0])
-				m.cmdSource <- buf[0]
+				// log.Printf("[DEBUG] processReceivedData cmdSource <- : % x", buf[:n])
+				for _, b := range buf[:n] {
+					m.cmdSource <- b
+				}
 			}
 		}
 		if err != nil {
 			log.Printf("[ERROR] Error reading from modem: %v", err)
+			m.rx.Close()
 			break
 		}
 	}
 }
-func (m *CC1200Modem) rxPipeline(sampleSource chan int8) (chan float32, error) {
-	// modem samples -> DC filter --> RRC filter & scale
-	var err error
-	dcf, err := NewDCFilter(sampleSource, len(rrcTaps5))
-	if err != nil {
-		return nil, fmt.Errorf("dc filter: %w", err)
-	}
-	s2s := NewSampleToSymbol(dcf.Source(), rrcTaps5, RXSymbolScalingCoeff)
-	// ds, err := NewDownsampler(s2s.Source(), 5, 0)
-	// if err != nil {
-	// 	return nil, fmt.Errorf("downsampler: %w", err)
-	// }
-	return s2s.Source(), nil
+func (m *CC1200Modem) rxPipeline() (*Pipeline[int8, float32], error) {
+	// modem samples --> RRC filter & scale
+	// The Decoder corrects for any offset from a carrier frequency error
+	s2s := NewSampleToSymbol(rrcTaps5, RXSymbolScalingCoeff)
+	return NewPipeline(context.Background(), s2s, rxQueueBlocks), nil
 }
 
 func (m *CC1200Modem) setNRSTGPIO(set bool) error {
@@ -354,23 +537,20 @@ func (m *CC1200Modem) Close() error {
 	if m.debugLog != nil {
 		m.debugLog.Close()
 	}
+	m.rx.Stop()
 	return m.modem.Close()
 }
 
 // Read received symbols
 func (m *CC1200Modem) Read(buf []byte) (n int, err error) {
 	// log.Printf("[DEBUG] Modem.read requested %d bytes", len(buf))
-	sBuf := make([]float32, len(buf)/4)
-	for i := range sBuf {
-		sBuf[i] = <-m.rxSymbols
+	m.rxBuf = resize(m.rxBuf, len(buf)/4)
+	n, err = m.rx.Read(m.rxBuf)
+	for i, s := range m.rxBuf[:n] {
+		binary.LittleEndian.PutUint32(buf[4*i:], math.Float32bits(s))
 	}
-	sb, err := binary.Append(nil, binary.LittleEndian, sBuf)
-	if err != nil {
-		return 0, fmt.Errorf("append symbol: %w", err)
-	}
-	cnt := copy(buf, sb)
-	// log.Printf("[DEBUG] Modem.read returned  %d bytes", cnt)
-	return cnt, nil
+	// log.Printf("[DEBUG] Modem.read returned  %d bytes", 4*n)
+	return 4 * n, err
 }
 
 // Send symbols to transmit. If no symbols are received for more than `txEndDuration` milliseconds,
@@ -468,118 +648,108 @@ func (m *CC1200Modem) TransmitPacket(p Packet) error {
 
 func (m *CC1200Modem) TransmitVoiceStream(sd StreamDatagram) error {
 	m.trxMutex.Lock()
-	if m.trxState != trxTX {
+	transmitting := m.trxState == trxTX
+	m.trxMutex.Unlock()
+	if !transmitting {
 		// First frame
-		m.trxMutex.Unlock()
 		log.Printf("[DEBUG] Sending first frame of stream %x, fn %d, lsf: %v", sd.StreamID, sd.FrameNumber, sd.LSF)
 		m.StopRX()
 		time.Sleep(2 * time.Millisecond)
 		m.StartTX()
 		time.Sleep(10 * time.Millisecond)
-
-		var syms []Symbol
-		//fill preamble
-		syms = AppendPreamble(syms, lsfPreamble)
-		err := m.writeSymbols(syms)
-		if err != nil {
-			return fmt.Errorf("failed to send preamble: %w", err)
-		}
-		syms, err = generateLSFSymbols(sd.LSF)
-		if err != nil {
-			return fmt.Errorf("failed to generate LSF symbols: %w", err)
-		}
-		err = m.writeSymbols(syms)
-		if err != nil {
-			return fmt.Errorf("failed to send LSF: %w", err)
-		}
-		syms, err = generateStreamSymbols(sd)
-		if err != nil {
-			return fmt.Errorf("failed to generate LSF symbols: %w", err)
-		}
-		err = m.writeSymbols(syms)
-		if err != nil {
-			return fmt.Errorf("failed to send stream frame: %w", err)
-		}
+		// Any earlier stream ended when the modem left TX
+		m.streamEnc = nil
 	} else {
-		m.trxMutex.Unlock()
 		log.Printf("[DEBUG] Sending frame of stream %x, fn %d", sd.StreamID, sd.FrameNumber)
-		syms, err := generateStreamSymbols(sd)
+	}
+	var syms []Symbol
+	if m.streamEnc != nil && m.streamID != sd.StreamID {
+		// A new stream started before the old one ended, so end the old one
+		log.Printf("[DEBUG] Stream %x replaced by %x before last frame", m.streamID, sd.StreamID)
+		syms = m.streamEnc.End()
+		m.streamEnc = nil
+	}
+	if m.streamEnc == nil {
+		enc, err := newTXStreamEncoder(sd.LSF, m.Keys)
 		if err != nil {
-			return fmt.Errorf("failed to generate LSF symbols: %w", err)
+			m.endTX()
+			return err
 		}
-		err = m.writeSymbols(syms)
+		start, err := enc.Start()
 		if err != nil {
-			return fmt.Errorf("failed to send stream frame: %w", err)
+			m.endTX()
+			return fmt.Errorf("failed to generate LSF symbols: %w", err)
 		}
+		m.streamEnc = enc
+		m.streamID = sd.StreamID
+		syms = append(syms, start...)
+	}
+	frame, err := m.streamEnc.EncodeFrame(sd.FrameNumber, sd.Payload)
+	if err != nil {
+		return fmt.Errorf("failed to generate stream symbols: %w", err)
+	}
+	err = m.writeSymbols(append(syms, frame...))
+	if err != nil {
+		return fmt.Errorf("failed to send stream frame: %w", err)
 	}
 	if sd.LastFrame {
 		// send EOT
 		log.Printf("[DEBUG] Sending EOT for stream %x, fn %d", sd.StreamID, sd.FrameNumber)
-		syms := AppendEOT(nil)
-		err := m.writeSymbols(syms)
+		err := m.writeSymbols(m.streamEnc.End())
+		m.streamEnc = nil
 		if err != nil {
 			return fmt.Errorf("failed to send EOT: %w", err)
 		}
 		log.Printf("[DEBUG] Finished TransmitVoiceStream")
 		time.Sleep(10 * 40 * time.Millisecond)
 		log.Printf("[DEBUG] Finished TransmitVoiceStream wait")
-		m.StopTX()
-		m.StartRX()
+		m.endTX()
 	}
 	return nil
 }
 
-func generateLSFSymbols(l LSF) ([]Symbol, error) {
-	syms := AppendSyncword(nil, LSFSync)
-
-	b, err := ConvolutionalEncode(l.ToBytes(), LSFPuncturePattern, LSFFinalBit)
-	if err != nil {
-		return nil, fmt.Errorf("unable to encode LSF: %w", err)
-	}
-	encodedBits := NewBits(b)
-	// encodedBits[0:len(b)] = b[:]
-	rfBits := InterleaveBits(encodedBits)
-	rfBits = RandomizeBits(rfBits)
-	// Append LSF to the output
-	syms = AppendBits(syms, rfBits)
-	return syms, nil
+// Return from TX to RX
+func (m *CC1200Modem) endTX() {
+	m.StopTX()
+	m.StartRX()
 }
 
-func generateStreamSymbols(sd StreamDatagram) ([]Symbol, error) {
-	syms := AppendSyncword(nil, StreamSync)
-	lich := extractLICH(int((sd.FrameNumber&0x7fff)%6), sd.LSF)
-	encodedLICH := EncodeLICH(lich)
-	lichBits := unpackBits(encodedLICH)
-	b, err := ConvolutionalEncodeStream(lichBits, sd)
+func (m *CC1200Modem) TransmitBERT(frames int) error {
+	log.Printf("[DEBUG] TransmitBERT: %d frames", frames)
+	m.StopRX()
+	time.Sleep(2 * time.Millisecond)
+	m.StartTX()
+	time.Sleep(10 * time.Millisecond)
+	defer func() {
+		m.StopTX()
+		m.StartRX()
+	}()
+
+	e := NewBERTEncoder()
+	err := m.writeSymbols(e.Start())
 	if err != nil {
-		return syms, fmt.Errorf("encode stream: %w", err)
+		return fmt.Errorf("failed to send preamble: %w", err)
 	}
-	encodedBits := NewBits(b)
-	rfBits := InterleaveBits(encodedBits)
-	rfBits = RandomizeBits(rfBits)
-	syms = AppendBits(syms, rfBits)
-	// log.Printf("[DEBUG] len(syms): %d, syms: [% v]", len(syms), syms)
-	// d := NewDecoder()
-	// frameData, li, fn, lichCnt, vd := d.decodeStreamFrame(syms[8:])
-	// log.Printf("[DEBUG] frameData: [% 2x], lich: %x, lichCnt: %d, fn: %x, FN: %d, vd: %1.1f", frameData, li, lichCnt, fn, (fn>>8)|((fn&0xFF)<<8), vd)
-	return syms, nil
-}
-
-func extractLICH(lichCnt int, lsf LSF) []byte {
-	lich := lsf.ToBytes()[lichCnt*5 : lichCnt*5+5]
-	return append(lich, byte(lichCnt)<<5)
-}
-
-func unpackBits(in []byte) []Bit {
-	bits := make([]Bit, 8*len(in))
-	for i := range in {
-		for j := range 8 {
-			bits[i*8+j].Set((in[i] >> (7 - j)) & 1)
+	for i := range frames {
+		syms, err := e.NextFrame()
+		if err != nil {
+			return err
 		}
+		err = m.writeSymbols(syms)
+		if err != nil {
+			return fmt.Errorf("failed to send BERT frame %d: %w", i, err)
+		}
+		time.Sleep(40 * time.Millisecond)
 	}
-
-	return bits
+	err = m.writeSymbols(e.End())
+	if err != nil {
+		return fmt.Errorf("failed to send EOT: %w", err)
+	}
+	log.Printf("[DEBUG] Finished TransmitBERT")
+	time.Sleep(10 * 40 * time.Millisecond)
+	return nil
 }
+
 func (m *CC1200Modem) StartTX() error {
 	m.trxMutex.Lock()
 	defer m.trxMutex.Unlock()
@@ -716,7 +886,7 @@ func (m *CC1200Modem) SetFreqCorrection(corr int16) error {
 	return nil
 }
 func (m *CC1200Modem) writeSymbols(symbols []Symbol) error {
-	buf := m.s2s.Transform(symbols)
+	buf := m.s2s.Process(nil, symbols)
 	if m.debugLog != nil {
 		_, err := m.debugLog.Write(buf)
 		if err != nil {
@@ -0,0 +1,180 @@
+package m17
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"reflect"
+	"testing"
+
+	"github.com/icza/gog"
+)
+
+type nopWriteCloser struct {
+	bytes.Buffer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+func TestDummyModem_TransmitVoiceStream(t *testing.T) {
+	lsfA := testStreamLSF(t)
+	lsfB := gog.Must(NewLSF("@ALL", "N1ADJ", LSFTypeStream, LSFDataTypeVoice, LSFEncryptionTypeNone, 0, 0))
+	payloads := testPayloads(5)
+	datagrams := []StreamDatagram{
+		// stream A never sends a last frame
+		{StreamID: 0x1234, FrameNumber: 0, LSF: lsfA, Payload: payloads[0]},
+		{StreamID: 0x1234, FrameNumber: 1, LSF: lsfA, Payload: payloads[1]},
+		{StreamID: 0x1234, FrameNumber: 2, LSF: lsfA, Payload: payloads[2]},
+		{StreamID: 0x5678, FrameNumber: 0, LSF: lsfB, Payload: payloads[3]},
+		{StreamID: 0x5678, FrameNumber: 1 | LastFrameFlag, LastFrame: true, LSF: lsfB, Payload: payloads[4]},
+	}
+	out := &nopWriteCloser{}
+	m := DummyModem{Out: out}
+	for _, sd := range datagrams {
+		err := m.TransmitVoiceStream(sd)
+		if err != nil {
+			t.Fatalf("DummyModem.TransmitVoiceStream() error = %v", err)
+		}
+	}
+	got := make([]Symbol, out.Len()/4)
+	err := binary.Read(out, binary.LittleEndian, got)
+	if err != nil {
+		t.Fatalf("failed to read symbols: %v", err)
+	}
+
+	preamble := AppendPreamble(nil, lsfPreamble)
+	eot := AppendEOT(nil)
+	lsfSync := AppendSyncword(nil, LSFSync)
+	streamSync := AppendSyncword(nil, StreamSync)
+	// preamble, LSF, 3 frames, EOT, preamble, LSF, 2 frames, EOT
+	want := [][]Symbol{preamble, lsfSync, streamSync, streamSync, streamSync, eot, preamble, lsfSync, streamSync, streamSync, eot}
+	if len(got) != len(want)*SymbolsPerFrame {
+		t.Fatalf("DummyModem.TransmitVoiceStream() wrote %d symbols, want %d", len(got), len(want)*SymbolsPerFrame)
+	}
+	d := NewDecoder(nil)
+	frame := 0
+	for i, w := range want {
+		f := got[i*SymbolsPerFrame : (i+1)*SymbolsPerFrame]
+		if !reflect.DeepEqual(f[:len(w)], w) {
+			t.Errorf("frame %d = %v, want %v", i, f[:len(w)], w)
+			continue
+		}
+		if reflect.DeepEqual(w, streamSync) {
+			data, _, fn, _, _ := d.decodeStreamFrame(f[SymbolsPerSyncword:])
+			if fn != datagrams[frame].FrameNumber {
+				t.Errorf("frame %d fn = %04x, want %04x", i, fn, datagrams[frame].FrameNumber)
+			}
+			if !bytes.Equal(data, datagrams[frame].Payload[:]) {
+				t.Errorf("frame %d payload = % x, want % x", i, data, datagrams[frame].Payload)
+			}
+			frame++
+		}
+	}
+	if m.stream != nil {
+		t.Errorf("DummyModem stream still active after last frame")
+	}
+}
+
+// testCC1200Modem returns a CC1200Modem writing to an in-memory port
+func testCC1200Modem() *CC1200Modem {
+	return &CC1200Modem{
+		modem:     &nopWriteCloser{},
+		s2s:       NewSymbolToSample(rrcTaps5, TXSymbolScalingCoeff*transmitGain, false, 5),
+		cmdSource: make(chan byte),
+	}
+}
+
+func TestCC1200Modem_TransmitVoiceStream(t *testing.T) {
+	lsfA := testStreamLSF(t)
+	lsfB := gog.Must(NewLSF("@ALL", "N1ADJ", LSFTypeStream, LSFDataTypeVoice, LSFEncryptionTypeNone, 0, 0))
+	payloads := testPayloads(3)
+	m := testCC1200Modem()
+	// Stream A never sends a last frame, so stream B replaces it
+	for _, sd := range []StreamDatagram{
+		{StreamID: 0x1234, FrameNumber: 0, LSF: lsfA, Payload: payloads[0]},
+		{StreamID: 0x1234, FrameNumber: 1, LSF: lsfA, Payload: payloads[1]},
+		{StreamID: 0x5678, FrameNumber: 0, LSF: lsfB, Payload: payloads[2]},
+	} {
+		err := m.TransmitVoiceStream(sd)
+		if err != nil {
+			t.Fatalf("CC1200Modem.TransmitVoiceStream() error = %v", err)
+		}
+	}
+	if m.streamEnc == nil {
+		t.Fatalf("CC1200Modem stream ended before last frame")
+	}
+	if m.streamID != 0x5678 || m.streamEnc.lsf.Src != lsfB.Src {
+		t.Errorf("CC1200Modem still encoding stream %x with LSF %v, want stream 5678", m.streamID, m.streamEnc.lsf)
+	}
+
+	// A modem already in TX without a stream starts one rather than panicking
+	m = testCC1200Modem()
+	m.trxState = trxTX
+	err := m.TransmitVoiceStream(StreamDatagram{StreamID: 0x1234, LSF: lsfA, Payload: payloads[0]})
+	if err != nil {
+		t.Fatalf("CC1200Modem.TransmitVoiceStream() error = %v", err)
+	}
+	if m.streamEnc == nil {
+		t.Errorf("CC1200Modem didn't start a stream")
+	}
+}
+
+func TestDummyModem_TransmitBERT(t *testing.T) {
+	out := &nopWriteCloser{}
+	m := DummyModem{Out: out}
+	err := m.TransmitBERT(3)
+	if err != nil {
+		t.Fatalf("DummyModem.TransmitBERT() error = %v", err)
+	}
+	want := gog.Must(NewBERTEncoder().Encode(3))
+	got := make([]Symbol, out.Len()/4)
+	err = binary.Read(out, binary.LittleEndian, got)
+	if err != nil {
+		t.Fatalf("failed to read symbols: %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("DummyModem.TransmitBERT() wrote %d symbols, want %d", len(got), len(want))
+	}
+	// BERT transmissions start with the BERT preamble
+	if got[0] != -3 || got[1] != +3 {
+		t.Errorf("BERT preamble starts %v", got[:2])
+	}
+}
+
+func TestDummyModem_SampleRate(t *testing.T) {
+	data := make([]byte, 200)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	p := gog.Must(NewPacket("N1ADJ", "N0CALL", PacketTypeSMS, data))
+	for _, rate := range []int{24000, 48000, 96000, 44100, 16000} {
+		t.Run(fmt.Sprint(rate), func(t *testing.T) {
+			out := &nopWriteCloser{}
+			tx := DummyModem{Out: out, SampleRate: rate}
+			err := tx.TransmitPacket(*p)
+			if err != nil {
+				t.Fatalf("DummyModem.TransmitPacket() error = %v", err)
+			}
+			// A packet is 1+1+9+1 frames of 40 ms
+			if want := 12 * rate / 25; out.Len()/4 != want {
+				t.Errorf("DummyModem.TransmitPacket() wrote %d samples, want %d", out.Len()/4, want)
+			}
+			// Follow the packet with silence to flush the decoder
+			out.Write(make([]byte, 4*rate/decoderSampleRate*symbolBufSize))
+			rx := &DummyModem{In: io.NopCloser(&out.Buffer), SampleRate: rate}
+			var got []byte
+			NewDecoder(nil).DecodeSymbols(rx, func(e Event) {
+				switch e := e.(type) {
+				case PacketEvent:
+					got = e.Payload
+				case PacketCRCErrorEvent:
+					t.Errorf("packet CRC error")
+				}
+			})
+			if !bytes.Equal(got, p.PayloadBytes()) {
+				t.Errorf("decoded packet of %d bytes, want %d", len(got), len(p.PayloadBytes()))
+			}
+		})
+	}
+}
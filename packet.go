@@ -42,7 +42,7 @@ func NewPacketFromBytes(buf []byte) Packet {
 }
 
 func NewPacket(dst, src string, t PacketType, data []byte) (*Packet, error) {
-	lsf, err := NewLSF(dst, src, LSFTypePacket, LSFDataTypeData, 0)
+	lsf, err := NewLSF(dst, src, LSFTypePacket, LSFDataTypeData, LSFEncryptionTypeNone, 0, 0)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create LSF for Packet: %w", err)
 	}
@@ -0,0 +1,184 @@
+package m17
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+)
+
+// ErrPipelineClosed is returned when writing to a closed Pipeline.
+var ErrPipelineClosed = errors.New("pipeline closed")
+
+// Pipeline runs a Filter in its own goroutine, passing blocks of samples in
+// and out through queues of a fixed depth. When the reader falls behind, the
+// queues fill and Write blocks, or TryWrite fails, rather than samples piling
+// up. Cancelling its context stops it at once, while Close lets it finish the
+// queued input first. A Pipeline may have one reader and any number of
+// writers.
+type Pipeline[I any, O any] struct {
+	filter Filter[I, O]
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	in     chan []I
+	out    chan []O
+	closed chan struct{}
+	once   sync.Once
+	// output blocks returned by the reader for reuse
+	free chan []O
+
+	// output block being read, and the part not yet read
+	block   []O
+	pending []O
+	// error returned by Read once the output ends
+	err error
+}
+
+// NewPipeline starts a Pipeline running filter, with queues of depth blocks.
+func NewPipeline[I any, O any](ctx context.Context, filter Filter[I, O], depth int) *Pipeline[I, O] {
+	ctx, cancel := context.WithCancel(ctx)
+	p := &Pipeline[I, O]{
+		filter: filter,
+		ctx:    ctx,
+		cancel: cancel,
+		in:     make(chan []I, depth),
+		out:    make(chan []O, depth),
+		closed: make(chan struct{}),
+		free:   make(chan []O, depth+1),
+	}
+	go p.run()
+	return p
+}
+
+func (p *Pipeline[I, O]) run() {
+	defer close(p.out)
+	for {
+		select {
+		case block := <-p.in:
+			if !p.process(block) {
+				return
+			}
+		case <-p.closed:
+			// Finish what was queued before Close
+			for {
+				select {
+				case block := <-p.in:
+					if !p.process(block) {
+						return
+					}
+				default:
+					return
+				}
+			}
+		case <-p.ctx.Done():
+			return
+		}
+	}
+}
+
+// Filter a block and queue the output, returning false if cancelled
+func (p *Pipeline[I, O]) process(block []I) bool {
+	var buf []O
+	select {
+	case buf = <-p.free:
+	default:
+	}
+	buf = p.filter.Process(buf[:0], block)
+	if len(buf) == 0 {
+		return true
+	}
+	select {
+	case p.out <- buf:
+		return true
+	case <-p.ctx.Done():
+		return false
+	}
+}
+
+// Write queues a copy of block for filtering, waiting while the queue is full.
+func (p *Pipeline[I, O]) Write(block []I) error {
+	if err := p.stopped(); err != nil {
+		return err
+	}
+	select {
+	case p.in <- append([]I(nil), block...):
+		return nil
+	case <-p.closed:
+		return ErrPipelineClosed
+	case <-p.ctx.Done():
+		return p.ctx.Err()
+	}
+}
+
+// TryWrite queues a copy of block for filtering if there's room, reporting
+// whether there was.
+func (p *Pipeline[I, O]) TryWrite(block []I) bool {
+	if p.stopped() != nil {
+		return false
+	}
+	select {
+	case p.in <- append([]I(nil), block...):
+		return true
+	default:
+		return false
+	}
+}
+
+// Return the error writes fail with once the Pipeline is closed or cancelled
+func (p *Pipeline[I, O]) stopped() error {
+	select {
+	case <-p.closed:
+		return ErrPipelineClosed
+	default:
+		return p.ctx.Err()
+	}
+}
+
+// Read copies filtered samples to buf, waiting until there are some. After
+// Close it returns io.EOF once all output has been read.
+func (p *Pipeline[I, O]) Read(buf []O) (int, error) {
+	for len(p.pending) == 0 {
+		if p.err != nil {
+			return 0, p.err
+		}
+		if p.block != nil {
+			select {
+			case p.free <- p.block:
+			default:
+			}
+			p.block = nil
+		}
+		select {
+		case block, ok := <-p.out:
+			if !ok {
+				p.err = p.ctx.Err()
+				if p.err == nil {
+					p.err = io.EOF
+					// release the context
+					p.cancel()
+				}
+				continue
+			}
+			p.block, p.pending = block, block
+		case <-p.ctx.Done():
+			p.err = p.ctx.Err()
+		}
+	}
+	n := copy(buf, p.pending)
+	p.pending = p.pending[n:]
+	return n, nil
+}
+
+// Close stops the Pipeline accepting input. Input already queued is still
+// filtered and can be read.
+func (p *Pipeline[I, O]) Close() error {
+	p.once.Do(func() { close(p.closed) })
+	return nil
+}
+
+// Stop shuts the Pipeline down at once, discarding any queued samples.
+func (p *Pipeline[I, O]) Stop() {
+	p.Close()
+	p.cancel()
+}
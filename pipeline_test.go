@@ -0,0 +1,182 @@
+package m17
+
+import (
+	"context"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/icza/gog"
+)
+
+func TestChain(t *testing.T) {
+	ds := gog.Must(NewDownsampler[int8](2, 0))
+	f := Chain(Chain[int8, int8, int8](NewScaler[int8](3), ds), NewScaler[int8](-1))
+	got := processBlocks(f, []int8{1, 2, 3, 4, 5, 6, 7}, 3)
+	want := []int8{-3, -9, -15, -21}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Chain got %v, want %v", got, want)
+	}
+}
+
+// readAll reads from p until it returns an error
+func readAll[I any, O any](p *Pipeline[I, O], n int) ([]O, error) {
+	var out []O
+	buf := make([]O, n)
+	for {
+		n, err := p.Read(buf)
+		out = append(out, buf[:n]...)
+		if err != nil {
+			return out, err
+		}
+	}
+}
+
+func TestPipeline(t *testing.T) {
+	in := make([]int8, 1000)
+	for i := range in {
+		in[i] = int8(i)
+	}
+	want := processBlocks(NewSampleToSymbol(rrcTaps5, RXSymbolScalingCoeff), in, len(in))
+	p := NewPipeline[int8, float32](context.Background(), NewSampleToSymbol(rrcTaps5, RXSymbolScalingCoeff), 4)
+	go func() {
+		for i := 0; i < len(in); i += 64 {
+			if err := p.Write(in[i:min(i+64, len(in))]); err != nil {
+				t.Errorf("Pipeline.Write() error = %v", err)
+			}
+		}
+		p.Close()
+	}()
+	got, err := readAll(p, 100)
+	if err != io.EOF {
+		t.Errorf("Pipeline.Read() error = %v, want EOF", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Pipeline output differs from the filter's")
+	}
+	if err := p.Write(in); err != ErrPipelineClosed {
+		t.Errorf("Pipeline.Write() after Close() error = %v, want %v", err, ErrPipelineClosed)
+	}
+}
+
+func TestPipeline_Backpressure(t *testing.T) {
+	const depth = 2
+	p := NewPipeline[int8, int8](context.Background(), NewScaler[int8](1), depth)
+	defer p.Stop()
+	// With no reader, the output queue, the filter goroutine and the input
+	// queue fill up
+	written := 0
+	for last := time.Now(); time.Since(last) < 100*time.Millisecond; {
+		if p.TryWrite([]int8{1}) {
+			written++
+			last = time.Now()
+		} else {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	if written != 2*depth+1 {
+		t.Errorf("TryWrite() accepted %d blocks, want %d", written, 2*depth+1)
+	}
+	// Reading frees room for more
+	if n, err := p.Read(make([]int8, 1)); n != 1 || err != nil {
+		t.Fatalf("Pipeline.Read() = %d, %v", n, err)
+	}
+	ok := false
+	for deadline := time.Now().Add(time.Second); !ok && time.Now().Before(deadline); {
+		ok = p.TryWrite([]int8{1})
+	}
+	if !ok {
+		t.Errorf("TryWrite() failed after a read")
+	}
+}
+
+func TestPipeline_Cancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	p := NewPipeline[int8, int8](ctx, NewScaler[int8](1), 1)
+	errc := make(chan error)
+	go func() {
+		_, err := readAll(p, 1)
+		errc <- err
+	}()
+	p.Write([]int8{1, 2, 3})
+	cancel()
+	select {
+	case err := <-errc:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Pipeline.Read() error = %v, want %v", err, context.Canceled)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Pipeline.Read() still blocked after cancel")
+	}
+	if err := p.Write([]int8{1}); err == nil {
+		t.Errorf("Pipeline.Write() after cancel succeeded")
+	}
+}
+
+// A second of samples from the modem
+func benchmarkSamples() []int8 {
+	in := make([]int8, samplesPerSecond)
+	for i := range in {
+		in[i] = int8(i * 7)
+	}
+	return in
+}
+
+// channelStage runs f on one sample at a time between channels, the way the
+// receive path used to work
+func channelStage[I any, O any](in chan I, f Filter[I, O]) chan O {
+	out := make(chan O)
+	go func() {
+		defer close(out)
+		one := make([]I, 1)
+		var buf []O
+		for s := range in {
+			one[0] = s
+			buf = f.Process(buf[:0], one)
+			for _, o := range buf {
+				out <- o
+			}
+		}
+	}()
+	return out
+}
+
+func BenchmarkRXChannels(b *testing.B) {
+	in := benchmarkSamples()
+	b.ReportAllocs()
+	for b.Loop() {
+		src := make(chan int8, samplesPerSecond)
+		dcf := channelStage(src, gog.Must(NewDCFilter(len(rrcTaps5))))
+		symbols := channelStage(dcf, NewSampleToSymbol(rrcTaps5, RXSymbolScalingCoeff))
+		go func() {
+			for _, s := range in {
+				src <- s
+			}
+			close(src)
+		}()
+		for range symbols {
+		}
+	}
+}
+
+func BenchmarkRXPipeline(b *testing.B) {
+	in := benchmarkSamples()
+	buf := make([]float32, 4*SymbolsPerFrame)
+	b.ReportAllocs()
+	for b.Loop() {
+		p := NewPipeline(context.Background(), Chain(gog.Must(NewDCFilter(len(rrcTaps5))), NewSampleToSymbol(rrcTaps5, RXSymbolScalingCoeff)), rxQueueBlocks)
+		go func() {
+			for i := 0; i < len(in); i += rxBlockSize {
+				p.Write(in[i : i+rxBlockSize])
+			}
+			p.Close()
+		}()
+		for {
+			if _, err := p.Read(buf); err != nil {
+				break
+			}
+		}
+	}
+}
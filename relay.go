@@ -37,6 +37,10 @@ type Relay struct {
 	done            bool
 	dashLog         *slog.Logger
 	lastStreamID    uint16
+	// LSFVersion is the TYPE field layout used on the network. Outgoing
+	// traffic is converted to it. The default, LSFVersionAuto, detects the
+	// layout of incoming traffic and sends LSFs unchanged.
+	LSFVersion LSFVersion
 }
 
 func NewRelay(server string, port uint, module string, callsign string, dashLog *slog.Logger, packetHandler func(Packet) error, streamHandler func(StreamDatagram) error) (*Relay, error) {
@@ -128,18 +132,18 @@ func (c *Relay) Handle() {
 		case magicM17Voice: // M17 voice stream
 			// log.Printf("[DEBUG] stream buffer: % 2x", buffer)
 			if c.streamHandler != nil {
-				sd, err := NewStreamDatagram(c.EncodedCallsign, buffer)
+				sd, err := newStreamDatagram(c.EncodedCallsign, buffer, c.LSFVersion)
 				if err != nil {
 					log.Printf("[INFO] Dropping bad stream datagram: %v", err)
 				} else {
 					// log.Printf("[DEBUG] sd: %#v", sd)
 					c.streamHandler(sd)
 					if c.dashLog != nil && c.lastStreamID != sd.StreamID {
-						c.dashLog.Info("", "type", "Internet", "subtype", "Voice Start", "src", sd.LSF.Src.Callsign(), "dst", sd.LSF.Dst.Callsign(), "can", sd.LSF.CAN())
+						c.dashLog.Info("", sd.LSF.dashAttrs("Internet", "Voice Start")...)
 						c.lastStreamID = sd.StreamID
 					}
 					if c.dashLog != nil && sd.LastFrame {
-						c.dashLog.Info("", "type", "Internet", "subtype", "Voice End", "src", sd.LSF.Src.Callsign(), "dst", sd.LSF.Dst.Callsign(), "can", sd.LSF.CAN())
+						c.dashLog.Info("", sd.LSF.dashAttrs("Internet", "Voice End")...)
 						c.lastStreamID = 0xFFFF
 					}
 				}
@@ -147,9 +151,11 @@ func (c *Relay) Handle() {
 		case magicM17Packet: // M17 packet
 			if c.packetHandler != nil {
 				p := NewPacketFromBytes(buffer[4:])
+				p.LSF.assumeVersion(c.LSFVersion)
+				p.LSF.assumeType(LSFTypePacket)
 				c.packetHandler(p)
 				if c.dashLog != nil {
-					c.dashLog.Info("", "type", "Internet", "subtype", "Packet", "src", p.LSF.Src.Callsign(), "dst", p.LSF.Dst.Callsign(), "can", p.LSF.CAN())
+					c.dashLog.Info("", p.LSF.dashAttrs("Internet", "Packet")...)
 				}
 			}
 		}
@@ -160,6 +166,7 @@ func (c *Relay) SendPacket(p Packet) error {
 	if time.Since(c.lastPing) > 30*time.Second {
 		log.Printf("[DEBUG] Last ping was at %s", c.lastPing)
 	}
+	p.LSF = p.LSF.ToVersion(c.LSFVersion)
 	b := p.ToBytes()
 	cmd := make([]byte, 0, magicLen+len(b))
 	cmd = append(cmd, []byte(magicM17Packet)...)
@@ -181,6 +188,7 @@ func (c *Relay) SendStream(lsf LSF, sid uint16, fn uint16, payload []byte) error
 	cmd := make([]byte, 0, 54)
 	cmd = append(cmd, []byte(magicM17Voice)...)
 	cmd, _ = binary.Append(cmd, binary.BigEndian, sid)
+	lsf = lsf.ToVersion(c.LSFVersion)
 	cmd = append(cmd, lsf.ToLSDBytes()...)
 	cmd, _ = binary.Append(cmd, binary.BigEndian, fn)
 	cmd = append(cmd, payload...)
@@ -238,6 +246,10 @@ type StreamDatagram struct {
 }
 
 func NewStreamDatagram(encodedCallsign [6]byte, buffer []byte) (StreamDatagram, error) {
+	return newStreamDatagram(encodedCallsign, buffer, LSFVersionAuto)
+}
+
+func newStreamDatagram(encodedCallsign [6]byte, buffer []byte, v LSFVersion) (StreamDatagram, error) {
 	sd := StreamDatagram{}
 	if len(buffer) != 54 {
 		return sd, fmt.Errorf("stream datagram buffer length %d != 50", len(buffer))
@@ -252,11 +264,14 @@ func NewStreamDatagram(encodedCallsign [6]byte, buffer []byte) (StreamDatagram,
 		return sd, fmt.Errorf("bad streamID from stream datagram: %v", err)
 	}
 	sd.LSF = NewLSFFromLSD(buffer[2:30])
+	sd.LSF.assumeVersion(v)
+	sd.LSF.assumeType(LSFTypeStream)
 	dst, _ := EncodeCallsign("@ALL")
 	sd.LSF.Dst = *dst
-	sd.LSF.Type[1] |= 0x2 << 5
-	copy(sd.LSF.Meta[:], sd.LSF.Src[:])
-	copy(sd.LSF.Meta[6:], encodedCallsign[:])
+	if sd.LSF.EncryptionType() == LSFEncryptionTypeNone {
+		// Encrypted streams need the META field for the nonce
+		sd.LSF.SetExtendedCallsign(sd.LSF.Src, encodedCallsign)
+	}
 	sd.LSF.CalcCRC()
 
 	_, err = binary.Decode(buffer[30:], binary.BigEndian, &sd.FrameNumber)
@@ -0,0 +1,78 @@
+package m17
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/icza/gog"
+)
+
+func TestNewStreamDatagram(t *testing.T) {
+	lsf := gog.Must(NewLSF("#CLUB", "N0CALL", LSFTypeStream, LSFDataTypeVoice, LSFEncryptionTypeNone, 0, 0))
+	reflector := *gog.Must(EncodeCallsign("N1ADJ G"))
+	payload := testPayloads(1)[0]
+	buf := []byte(magicM17Voice)
+	buf = binary.BigEndian.AppendUint16(buf, 0x1234)
+	buf = append(buf, lsf.ToLSDBytes()...)
+	buf = binary.BigEndian.AppendUint16(buf, 7|LastFrameFlag)
+	buf = append(buf, payload[:]...)
+	buf = binary.BigEndian.AppendUint16(buf, CRC(buf))
+
+	sd, err := NewStreamDatagram(reflector, buf)
+	if err != nil {
+		t.Fatalf("NewStreamDatagram() error = %v", err)
+	}
+	if sd.StreamID != 0x1234 || sd.FrameNumber != 7|LastFrameFlag || !sd.LastFrame || sd.Payload != payload {
+		t.Errorf("NewStreamDatagram() = %#v", sd)
+	}
+	if !sd.LSF.CheckCRC() {
+		t.Errorf("NewStreamDatagram() LSF bad CRC")
+	}
+	if got := sd.LSF.Dst.Callsign(); got != DestinationAll {
+		t.Errorf("NewStreamDatagram() dst = %s, want %s", got, DestinationAll)
+	}
+	field1, field2, ok := sd.LSF.ExtendedCallsign()
+	if !ok || field1.Callsign() != "N0CALL" || field2 != reflector {
+		t.Errorf("NewStreamDatagram() extended callsign = %s, %s, %v", field1.Callsign(), field2.Callsign(), ok)
+	}
+	if got := sd.LSF.Originator(); got != "N0CALL" {
+		t.Errorf("NewStreamDatagram() originator = %s, want N0CALL", got)
+	}
+
+	buf[len(buf)-1] ^= 1
+	if _, err := NewStreamDatagram(reflector, buf); err == nil {
+		t.Errorf("NewStreamDatagram() accepted bad CRC")
+	}
+}
+
+func TestNewStreamDatagram_Version(t *testing.T) {
+	// 0x0003 is a v1 data stream but a v2 voice+data stream
+	lsf := gog.Must(NewLSF("@ALL", "N0CALL", LSFTypeStream, LSFDataTypeVoice, LSFEncryptionTypeNone, 0, 0))
+	lsf.Type = [2]byte{0x00, 0x03}
+	buf := []byte(magicM17Voice)
+	buf = binary.BigEndian.AppendUint16(buf, 0x1234)
+	buf = append(buf, lsf.ToLSDBytes()...)
+	buf = binary.BigEndian.AppendUint16(buf, 0)
+	buf = append(buf, make([]byte, StreamPayloadLen)...)
+	buf = binary.BigEndian.AppendUint16(buf, CRC(buf))
+
+	tests := []struct {
+		v    LSFVersion
+		want LSFDataType
+	}{
+		{LSFVersionAuto, LSFDataTypeData},
+		{LSFVersion2, LSFDataTypeVoiceData},
+	}
+	for _, tt := range tests {
+		sd, err := newStreamDatagram(EncodedCallsign{}, buf, tt.v)
+		if err != nil {
+			t.Fatalf("newStreamDatagram() error = %v", err)
+		}
+		if got := sd.LSF.DataType(); got != tt.want {
+			t.Errorf("version %d data type = %d, want %d", tt.v, got, tt.want)
+		}
+		if sd.LSF.MetaType() != LSFMetaTypeExtendedCallsign {
+			t.Errorf("version %d META type = %d", tt.v, sd.LSF.MetaType())
+		}
+	}
+}
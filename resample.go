@@ -0,0 +1,95 @@
+package m17
+
+import (
+	"fmt"
+	"math"
+
+	"golang.org/x/exp/constraints"
+)
+
+// Input samples, at the lower of the two rates, spanned by the resampler's
+// anti-aliasing filter
+const resamplerSpan = 24
+
+// Resampler converts a stream from one sample rate to another, by any
+// rational factor. It upsamples, lowpass filters and downsamples in one step,
+// using a polyphase filter so that only the output samples are computed.
+type Resampler[T constraints.Float] struct {
+	// the rates, reduced to lowest terms
+	up, down int
+	// the filter split into up phases, each in input order
+	phases [][]float32
+	fir    fir
+	// phase of the next output, at up times the input rate
+	phase int
+}
+
+// NewResampler creates a Resampler from inRate to outRate samples per second.
+func NewResampler[T constraints.Float](inRate, outRate int) (*Resampler[T], error) {
+	if inRate < 1 || outRate < 1 {
+		return nil, fmt.Errorf("sample rates must be positive, got %d and %d", inRate, outRate)
+	}
+	g := gcd(inRate, outRate)
+	up, down := outRate/g, inRate/g
+	// Windowed sinc lowpass at 80% of the lower Nyquist frequency, in cycles
+	// per sample at the upsampled rate
+	cutoff := 0.4 / float64(max(up, down))
+	perPhase := (resamplerSpan*max(up, down) + up - 1) / up
+	h := make([]float64, perPhase*up)
+	center := float64(len(h)-1) / 2
+	var sum float64
+	for i := range h {
+		x := float64(i) - center
+		h[i] = sinc(2*cutoff*x) * blackman(i, len(h))
+		sum += h[i]
+	}
+	// Each phase has unity gain at DC
+	phases := make([][]float32, up)
+	for p := range phases {
+		phases[p] = make([]float32, perPhase)
+		for k := range perPhase {
+			phases[p][perPhase-1-k] = float32(h[p+k*up] * float64(up) / sum)
+		}
+	}
+	return &Resampler[T]{
+		up:     up,
+		down:   down,
+		phases: phases,
+		fir:    newFIR(phases[0]),
+	}, nil
+}
+
+func (r *Resampler[T]) Process(out []T, in []T) []T {
+	for _, sample := range in {
+		r.fir.push(float32(sample))
+		// Output every sample that falls before the next input
+		for ; r.phase < r.up; r.phase += r.down {
+			out = append(out, T(r.fir.output(r.phases[r.phase])))
+		}
+		r.phase -= r.up
+	}
+	return out
+}
+
+func gcd(a, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
+
+func sinc(x float64) float64 {
+	if x == 0 {
+		return 1
+	}
+	return math.Sin(math.Pi*x) / (math.Pi * x)
+}
+
+// Blackman window of length n at i
+func blackman(i, n int) float64 {
+	if n == 1 {
+		return 1
+	}
+	x := 2 * math.Pi * float64(i) / float64(n-1)
+	return 0.42 - 0.5*math.Cos(x) + 0.08*math.Cos(2*x)
+}
@@ -0,0 +1,91 @@
+package m17
+
+import (
+	"math"
+	"testing"
+
+	"github.com/icza/gog"
+)
+
+// Fit a sine of frequency f to x, returning its amplitude and the RMS error
+func fitSine(x []float32, f float64) (float64, float64) {
+	var s, c float64
+	for i, v := range x {
+		s += float64(v) * math.Sin(2*math.Pi*f*float64(i))
+		c += float64(v) * math.Cos(2*math.Pi*f*float64(i))
+	}
+	s, c = 2*s/float64(len(x)), 2*c/float64(len(x))
+	var errSq float64
+	for i, v := range x {
+		e := float64(v) - s*math.Sin(2*math.Pi*f*float64(i)) - c*math.Cos(2*math.Pi*f*float64(i))
+		errSq += e * e
+	}
+	return math.Hypot(s, c), math.Sqrt(errSq / float64(len(x)))
+}
+
+func TestResampler(t *testing.T) {
+	tests := []struct {
+		name    string
+		in, out int
+		// tone frequency
+		freq float64
+		// expected output amplitude
+		amplitude float64
+	}{
+		{"48 to 24 kHz", 48000, 24000, 1000, 1},
+		{"24 to 48 kHz", 24000, 48000, 1000, 1},
+		{"96 to 24 kHz", 96000, 24000, 3000, 1},
+		{"44.1 to 24 kHz", 44100, 24000, 1000, 1},
+		{"24 to 44.1 kHz", 24000, 44100, 3000, 1},
+		{"16 to 24 kHz", 16000, 24000, 2000, 1},
+		{"48 to 24 kHz, aliased tone", 48000, 24000, 15000, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in := make([]float32, tt.in)
+			for i := range in {
+				in[i] = float32(math.Sin(2 * math.Pi * tt.freq * float64(i) / float64(tt.in)))
+			}
+			r := gog.Must(NewResampler[float32](tt.in, tt.out))
+			got := processBlocks(r, in, 97)
+			if len(got) != tt.out {
+				t.Errorf("Resampler output %d samples, want %d", len(got), tt.out)
+			}
+			// Skip the filter's delay at the start
+			f := tt.freq / float64(tt.out)
+			if tt.amplitude == 0 {
+				// The tone is above the output's Nyquist frequency, so
+				// measure it where it would alias to
+				f = 1 - f
+			}
+			amplitude, rms := fitSine(got[tt.out/10:], f)
+			if math.Abs(amplitude-tt.amplitude) > 0.01 {
+				t.Errorf("tone amplitude %.4f, want %.4f", amplitude, tt.amplitude)
+			}
+			if rms > 0.01 {
+				t.Errorf("RMS error %.4f", rms)
+			}
+		})
+	}
+}
+
+func TestResampler_Errors(t *testing.T) {
+	for _, rates := range [][2]int{{0, 24000}, {24000, 0}, {-48000, 24000}} {
+		if _, err := NewResampler[float32](rates[0], rates[1]); err == nil {
+			t.Errorf("NewResampler(%d, %d) succeeded", rates[0], rates[1])
+		}
+	}
+}
+
+func BenchmarkResampler(b *testing.B) {
+	in := make([]float32, 44100)
+	for i := range in {
+		in[i] = float32(math.Sin(float64(i)))
+	}
+	r := gog.Must(NewResampler[float32](44100, 24000))
+	var out []float32
+	b.ReportAllocs()
+	for b.Loop() {
+		out = r.Process(out[:0], in)
+	}
+}
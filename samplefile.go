@@ -0,0 +1,528 @@
+package m17
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"path/filepath"
+	"strings"
+)
+
+// SampleFormat is a way of storing symbols or baseband samples in a file.
+type SampleFormat int
+
+const (
+	// FormatSymbols is little endian float32 symbols, one per symbol, as in
+	// .flt and .sym files
+	FormatSymbols SampleFormat = iota
+	// FormatFloat32 is little endian float32 samples in symbol units, as in
+	// .f32 files
+	FormatFloat32
+	// FormatS16 is little endian int16 samples, as in .s16 files
+	FormatS16
+	// FormatS8 is int8 samples at 24 kHz as exchanged with the CC1200 modem,
+	// as in .s8 files
+	FormatS8
+	// FormatWAV is a WAV file of 16 bit PCM or 32 bit float samples, written
+	// with 16 bit samples
+	FormatWAV
+	// FormatCU8 is complex IQ samples of unsigned 8 bit I and Q, as recorded
+	// by rtl_sdr
+	FormatCU8
+	// FormatCS16 is complex IQ samples of little endian int16 I and Q
+	FormatCS16
+	// FormatCF32 is complex IQ samples of little endian float32 I and Q, as
+	// in GNU Radio .cfile files
+	FormatCF32
+	// FormatCS8 is complex IQ samples of signed 8 bit I and Q, as used by
+	// hackrf_transfer
+	FormatCS8
+	// FormatWAVFloat is a WAV file written with 32 bit float samples in
+	// symbol units. It's read as FormatWAV.
+	FormatWAVFloat
+)
+
+const (
+	// Symbol units per int16 sample, so the outer symbols use about two
+	// thirds of the range, leaving room for overshoot
+	s16Scale = 7168
+	// Rate of raw int16 samples when none is given
+	defaultS16Rate = 48000
+	// The CC1200's sample rate
+	s8Rate = 24000
+)
+
+var formatNames = []string{"symbols", "float32", "s16", "s8", "WAV", "cu8", "cs16", "cf32", "cs8", "float WAV"}
+
+func (f SampleFormat) String() string {
+	if f < 0 || int(f) >= len(formatNames) {
+		return fmt.Sprintf("SampleFormat(%d)", int(f))
+	}
+	return formatNames[f]
+}
+
+// IsIQ reports whether f holds complex IQ samples from an SDR, rather than
+// symbols or demodulated samples.
+func (f SampleFormat) IsIQ() bool {
+	return f == FormatCU8 || f == FormatCS8 || f == FormatCS16 || f == FormatCF32
+}
+
+// FormatForName returns the format of a file from its extension, reporting
+// whether the extension was recognized.
+func FormatForName(name string) (SampleFormat, bool) {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".flt", ".sym":
+		return FormatSymbols, true
+	case ".f32":
+		return FormatFloat32, true
+	case ".s16":
+		return FormatS16, true
+	case ".s8":
+		return FormatS8, true
+	case ".wav":
+		return FormatWAV, true
+	case ".cu8":
+		return FormatCU8, true
+	case ".cs8":
+		return FormatCS8, true
+	case ".cs16":
+		return FormatCS16, true
+	case ".cf32", ".cfile":
+		return FormatCF32, true
+	}
+	return FormatSymbols, false
+}
+
+// Return the sample rate of a raw format, given sampleRate, which may be zero
+// for the format's default
+func rawSampleRate(format SampleFormat, sampleRate int) (int, error) {
+	switch format {
+	case FormatS8:
+		if sampleRate != 0 && sampleRate != s8Rate {
+			return 0, fmt.Errorf("%s samples are always at %d Hz, not %d", format, s8Rate, sampleRate)
+		}
+		return s8Rate, nil
+	case FormatS16, FormatWAV, FormatWAVFloat:
+		if sampleRate == 0 {
+			return defaultS16Rate, nil
+		}
+	case FormatFloat32, FormatCU8, FormatCS8, FormatCS16, FormatCF32:
+		if sampleRate == 0 {
+			return 0, fmt.Errorf("%s samples need a sample rate", format)
+		}
+	}
+	if sampleRate < 0 {
+		return 0, fmt.Errorf("bad sample rate %d", sampleRate)
+	}
+	return sampleRate, nil
+}
+
+const (
+	wavFormatPCM        = 1
+	wavFormatFloat      = 3
+	wavFormatExtensible = 0xFFFE
+)
+
+// SampleReader reads symbols or samples in any SampleFormat, converting them
+// to float32 in symbol units, or IQ samples, converting them to complex64.
+type SampleReader struct {
+	// Format of the input, FormatWAV if it had a WAV header whatever
+	// format it was created with
+	Format SampleFormat
+	// SampleRate of the input, zero for symbols
+	SampleRate int
+
+	r *bufio.Reader
+	// bytes per sample of one channel, and the channels in each frame, of
+	// which only the first is read
+	size     int
+	channels int
+	decode   func(b []byte) float32
+	decodeIQ func(b []byte) complex64
+	buf      []byte
+	// data bytes left in a WAV file, or -1 if unknown
+	remaining int64
+}
+
+// NewSampleReader creates a SampleReader for r in format, at sampleRate for
+// the raw sample formats. If r starts with a WAV header, the header is used
+// instead.
+func NewSampleReader(r io.Reader, format SampleFormat, sampleRate int) (*SampleReader, error) {
+	sr := &SampleReader{
+		Format:    format,
+		r:         bufio.NewReader(r),
+		channels:  1,
+		remaining: -1,
+	}
+	head, err := sr.r.Peek(12)
+	if err == nil && bytes.Equal(head[:4], []byte("RIFF")) && bytes.Equal(head[8:], []byte("WAVE")) {
+		sr.Format = FormatWAV
+		err = sr.readWAVHeader()
+		if err != nil {
+			return nil, fmt.Errorf("read WAV header: %w", err)
+		}
+		return sr, nil
+	}
+	if format == FormatWAV || format == FormatWAVFloat {
+		return nil, fmt.Errorf("no WAV header")
+	}
+	if format != FormatSymbols {
+		sr.SampleRate, err = rawSampleRate(format, sampleRate)
+		if err != nil {
+			return nil, err
+		}
+	}
+	switch format {
+	case FormatSymbols, FormatFloat32:
+		sr.size, sr.decode = 4, decodeFloat32
+	case FormatS16:
+		sr.size, sr.decode = 2, decodeS16
+	case FormatS8:
+		sr.size, sr.decode = 1, decodeS8
+	case FormatCU8:
+		sr.size, sr.decodeIQ = 2, decodeCU8
+	case FormatCS8:
+		sr.size, sr.decodeIQ = 2, decodeCS8
+	case FormatCS16:
+		sr.size, sr.decodeIQ = 4, decodeCS16
+	case FormatCF32:
+		sr.size, sr.decodeIQ = 8, decodeCF32
+	default:
+		return nil, fmt.Errorf("unknown sample format %d", format)
+	}
+	return sr, nil
+}
+
+func decodeFloat32(b []byte) float32 {
+	return math.Float32frombits(binary.LittleEndian.Uint32(b))
+}
+
+func decodeS16(b []byte) float32 {
+	return float32(int16(binary.LittleEndian.Uint16(b))) / s16Scale
+}
+
+// CC1200 received samples, scaled as SampleToSymbol scales them
+func decodeS8(b []byte) float32 {
+	return float32(int8(b[0])) * RXSymbolScalingCoeff * transmitGain
+}
+
+func decodeCU8(b []byte) complex64 {
+	return complex((float32(b[0])-127.5)/128, (float32(b[1])-127.5)/128)
+}
+
+func decodeCS8(b []byte) complex64 {
+	return complex(float32(int8(b[0]))/128, float32(int8(b[1]))/128)
+}
+
+func decodeCS16(b []byte) complex64 {
+	return complex(float32(int16(binary.LittleEndian.Uint16(b)))/32768, float32(int16(binary.LittleEndian.Uint16(b[2:])))/32768)
+}
+
+func decodeCF32(b []byte) complex64 {
+	return complex(decodeFloat32(b), decodeFloat32(b[4:]))
+}
+
+// Read the WAV header up to the start of the data
+func (sr *SampleReader) readWAVHeader() error {
+	var riff [12]byte
+	if _, err := io.ReadFull(sr.r, riff[:]); err != nil {
+		return err
+	}
+	gotFormat := false
+	for {
+		var chunk [8]byte
+		if _, err := io.ReadFull(sr.r, chunk[:]); err != nil {
+			return err
+		}
+		id := string(chunk[:4])
+		size := int64(binary.LittleEndian.Uint32(chunk[4:]))
+		switch id {
+		case "fmt ":
+			if size < 16 {
+				return fmt.Errorf("fmt chunk of %d bytes", size)
+			}
+			fmtChunk := make([]byte, size+size%2)
+			if _, err := io.ReadFull(sr.r, fmtChunk); err != nil {
+				return err
+			}
+			if err := sr.parseWAVFormat(fmtChunk); err != nil {
+				return err
+			}
+			gotFormat = true
+		case "data":
+			if !gotFormat {
+				return errors.New("data before fmt chunk")
+			}
+			if size != math.MaxUint32 {
+				sr.remaining = size
+			}
+			return nil
+		default:
+			// Skip chunks we don't use, which are padded to an even length
+			if _, err := sr.r.Discard(int(size + size%2)); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (sr *SampleReader) parseWAVFormat(b []byte) error {
+	tag := binary.LittleEndian.Uint16(b)
+	channels := int(binary.LittleEndian.Uint16(b[2:]))
+	rate := int(binary.LittleEndian.Uint32(b[4:]))
+	bits := int(binary.LittleEndian.Uint16(b[14:]))
+	if tag == wavFormatExtensible && len(b) >= 26 {
+		// The format tag starts the subformat GUID
+		tag = binary.LittleEndian.Uint16(b[24:])
+	}
+	if channels < 1 || rate < 1 {
+		return fmt.Errorf("bad WAV format: %d channels at %d Hz", channels, rate)
+	}
+	switch {
+	case tag == wavFormatPCM && bits == 16:
+		sr.size, sr.decode = 2, decodeS16
+	case tag == wavFormatFloat && bits == 32:
+		sr.size, sr.decode = 4, decodeFloat32
+	default:
+		return fmt.Errorf("unsupported WAV format %d with %d bit samples", tag, bits)
+	}
+	// Use the first channel of a stereo capture
+	sr.channels = channels
+	sr.SampleRate = rate
+	return nil
+}
+
+// ReadSamples reads up to len(buf) samples, or symbols for FormatSymbols,
+// returning the number read. It returns io.EOF at the end of the input.
+func (sr *SampleReader) ReadSamples(buf []float32) (int, error) {
+	if sr.decode == nil {
+		return 0, fmt.Errorf("%s samples must be read with ReadIQ", sr.Format)
+	}
+	n, err := sr.read(len(buf))
+	frame := sr.size * sr.channels
+	for i := range n {
+		buf[i] = sr.decode(sr.buf[i*frame:])
+	}
+	return n, err
+}
+
+// ReadIQ reads up to len(buf) IQ samples, returning the number read. It
+// returns io.EOF at the end of the input.
+func (sr *SampleReader) ReadIQ(buf []complex64) (int, error) {
+	if sr.decodeIQ == nil {
+		return 0, fmt.Errorf("%s samples can't be read with ReadIQ", sr.Format)
+	}
+	n, err := sr.read(len(buf))
+	for i := range n {
+		buf[i] = sr.decodeIQ(sr.buf[i*sr.size:])
+	}
+	return n, err
+}
+
+// Read up to n samples of all channels into buf, returning the number read
+func (sr *SampleReader) read(n int) (int, error) {
+	frame := sr.size * sr.channels
+	want := n * frame
+	if sr.remaining >= 0 {
+		want = int(min(int64(want), sr.remaining-sr.remaining%int64(frame)))
+		if want == 0 {
+			return 0, io.EOF
+		}
+	}
+	sr.buf = resize(sr.buf, want)
+	// Read at least one whole frame
+	nn, err := io.ReadAtLeast(sr.r, sr.buf, frame)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	nn -= nn % frame
+	if sr.remaining >= 0 {
+		sr.remaining -= int64(nn)
+	}
+	if nn > 0 {
+		return nn / frame, nil
+	}
+	return 0, err
+}
+
+// SampleWriter writes symbols or samples in any SampleFormat, converting them
+// from float32 in symbol units, or IQ samples, converting them from complex64.
+type SampleWriter struct {
+	Format     SampleFormat
+	SampleRate int
+
+	w        io.Writer
+	size     int
+	encode   func(b []byte, v float32)
+	encodeIQ func(b []byte, v complex64)
+	buf      []byte
+	// data bytes written to a WAV file
+	written int64
+}
+
+// NewSampleWriter creates a SampleWriter writing to w in format, at
+// sampleRate for the sample formats.
+func NewSampleWriter(w io.Writer, format SampleFormat, sampleRate int) (*SampleWriter, error) {
+	sw := &SampleWriter{
+		Format: format,
+		w:      w,
+	}
+	if format != FormatSymbols {
+		var err error
+		sw.SampleRate, err = rawSampleRate(format, sampleRate)
+		if err != nil {
+			return nil, err
+		}
+	}
+	switch format {
+	case FormatSymbols, FormatFloat32:
+		sw.size, sw.encode = 4, encodeFloat32
+	case FormatS16:
+		sw.size, sw.encode = 2, encodeS16
+	case FormatS8:
+		sw.size, sw.encode = 1, encodeS8
+	case FormatWAV:
+		sw.size, sw.encode = 2, encodeS16
+	case FormatWAVFloat:
+		sw.size, sw.encode = 4, encodeFloat32
+	case FormatCU8:
+		sw.size, sw.encodeIQ = 2, encodeCU8
+	case FormatCS8:
+		sw.size, sw.encodeIQ = 2, encodeCS8
+	case FormatCS16:
+		sw.size, sw.encodeIQ = 4, encodeCS16
+	case FormatCF32:
+		sw.size, sw.encodeIQ = 8, encodeCF32
+	default:
+		return nil, fmt.Errorf("unknown sample format %d", format)
+	}
+	if sw.isWAV() {
+		// The lengths aren't known yet. If w can seek, Close fills them in.
+		if _, err := w.Write(sw.wavHeader(math.MaxUint32)); err != nil {
+			return nil, fmt.Errorf("write WAV header: %w", err)
+		}
+	}
+	return sw, nil
+}
+
+func (sw *SampleWriter) isWAV() bool {
+	return sw.Format == FormatWAV || sw.Format == FormatWAVFloat
+}
+
+// Header of a mono WAV file of the writer's samples, with dataSize bytes of
+// them
+func (sw *SampleWriter) wavHeader(dataSize uint32) []byte {
+	tag := uint16(wavFormatPCM)
+	if sw.Format == FormatWAVFloat {
+		tag = wavFormatFloat
+	}
+	riffSize := dataSize
+	if dataSize != math.MaxUint32 {
+		riffSize = 36 + dataSize
+	}
+	b := []byte("RIFF")
+	b = binary.LittleEndian.AppendUint32(b, riffSize)
+	b = append(b, "WAVEfmt "...)
+	b = binary.LittleEndian.AppendUint32(b, 16)
+	b = binary.LittleEndian.AppendUint16(b, tag)
+	b = binary.LittleEndian.AppendUint16(b, 1)
+	b = binary.LittleEndian.AppendUint32(b, uint32(sw.SampleRate))
+	b = binary.LittleEndian.AppendUint32(b, uint32(sw.size*sw.SampleRate))
+	b = binary.LittleEndian.AppendUint16(b, uint16(sw.size))
+	b = binary.LittleEndian.AppendUint16(b, uint16(8*sw.size))
+	b = append(b, "data"...)
+	return binary.LittleEndian.AppendUint32(b, dataSize)
+}
+
+func encodeFloat32(b []byte, v float32) {
+	binary.LittleEndian.PutUint32(b, math.Float32bits(v))
+}
+
+func encodeS16(b []byte, v float32) {
+	binary.LittleEndian.PutUint16(b, uint16(clampRound(v*s16Scale, math.MinInt16, math.MaxInt16)))
+}
+
+// CC1200 samples to transmit, scaled as SymbolToSample scales them
+func encodeS8(b []byte, v float32) {
+	b[0] = byte(clampRound(v*TXSymbolScalingCoeff, math.MinInt8, math.MaxInt8))
+}
+
+// IQ samples are scaled so that a magnitude of 1 is full scale
+func encodeCU8(b []byte, v complex64) {
+	b[0] = byte(clampRound(real(v)*128+127.5, 0, math.MaxUint8))
+	b[1] = byte(clampRound(imag(v)*128+127.5, 0, math.MaxUint8))
+}
+
+func encodeCS8(b []byte, v complex64) {
+	b[0] = byte(clampRound(real(v)*math.MaxInt8, math.MinInt8, math.MaxInt8))
+	b[1] = byte(clampRound(imag(v)*math.MaxInt8, math.MinInt8, math.MaxInt8))
+}
+
+func encodeCS16(b []byte, v complex64) {
+	binary.LittleEndian.PutUint16(b, uint16(clampRound(real(v)*math.MaxInt16, math.MinInt16, math.MaxInt16)))
+	binary.LittleEndian.PutUint16(b[2:], uint16(clampRound(imag(v)*math.MaxInt16, math.MinInt16, math.MaxInt16)))
+}
+
+func encodeCF32(b []byte, v complex64) {
+	encodeFloat32(b, real(v))
+	encodeFloat32(b[4:], imag(v))
+}
+
+func clampRound(v float32, lo, hi int) int {
+	return int(max(float32(lo), min(float32(hi), float32(math.Round(float64(v))))))
+}
+
+// WriteSamples writes samples, or symbols for FormatSymbols.
+func (sw *SampleWriter) WriteSamples(samples []float32) error {
+	if sw.encode == nil {
+		return fmt.Errorf("%s samples must be written with WriteIQ", sw.Format)
+	}
+	sw.buf = resize(sw.buf, len(samples)*sw.size)
+	for i, v := range samples {
+		sw.encode(sw.buf[i*sw.size:], v)
+	}
+	return sw.write()
+}
+
+// WriteIQ writes IQ samples.
+func (sw *SampleWriter) WriteIQ(samples []complex64) error {
+	if sw.encodeIQ == nil {
+		return fmt.Errorf("%s samples can't be written with WriteIQ", sw.Format)
+	}
+	sw.buf = resize(sw.buf, len(samples)*sw.size)
+	for i, v := range samples {
+		sw.encodeIQ(sw.buf[i*sw.size:], v)
+	}
+	return sw.write()
+}
+
+func (sw *SampleWriter) write() error {
+	n, err := sw.w.Write(sw.buf)
+	sw.written += int64(n)
+	return err
+}
+
+// Close completes the header of a WAV file, if it can seek back to it. It
+// doesn't close the underlying writer.
+func (sw *SampleWriter) Close() error {
+	if !sw.isWAV() {
+		return nil
+	}
+	ws, ok := sw.w.(io.WriteSeeker)
+	if !ok || sw.written > math.MaxUint32-36 {
+		return nil
+	}
+	if _, err := ws.Seek(0, io.SeekStart); err != nil {
+		// Not seekable after all, like a pipe
+		return nil
+	}
+	if _, err := ws.Write(sw.wavHeader(uint32(sw.written))); err != nil {
+		return fmt.Errorf("update WAV header: %w", err)
+	}
+	_, err := ws.Seek(0, io.SeekEnd)
+	return err
+}
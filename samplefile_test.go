@@ -0,0 +1,296 @@
+package m17
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/icza/gog"
+)
+
+func TestFormatForName(t *testing.T) {
+	tests := []struct {
+		name   string
+		want   SampleFormat
+		wantOK bool
+	}{
+		{"capture.wav", FormatWAV, true},
+		{"CAPTURE.WAV", FormatWAV, true},
+		{"out.s16", FormatS16, true},
+		{"rx.s8", FormatS8, true},
+		{"demod.f32", FormatFloat32, true},
+		{"dir.x/symbols.sym", FormatSymbols, true},
+		{"symbols.flt", FormatSymbols, true},
+		{"rtl.cu8", FormatCU8, true},
+		{"hackrf.cs8", FormatCS8, true},
+		{"hackrf.cs16", FormatCS16, true},
+		{"sdr.cf32", FormatCF32, true},
+		{"gnuradio.cfile", FormatCF32, true},
+		{"-", FormatSymbols, false},
+		{"symbols.bin", FormatSymbols, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := FormatForName(tt.name)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("FormatForName() = %v, %v, want %v, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+// readAllSamples reads from r until it returns an error
+func readAllSamples(r *SampleReader) ([]float32, error) {
+	var out []float32
+	buf := make([]float32, 7)
+	for {
+		n, err := r.ReadSamples(buf)
+		out = append(out, buf[:n]...)
+		if err != nil {
+			return out, err
+		}
+	}
+}
+
+func TestSampleFile_RoundTrip(t *testing.T) {
+	in := []float32{0, 1, -1, 3, -3, 0.5, -2.25, 4.5}
+	tests := []struct {
+		format SampleFormat
+		rate   int
+		// expected rate once read
+		wantRate int
+		// largest error from quantizing
+		tolerance float64
+	}{
+		{FormatSymbols, 0, 0, 0},
+		{FormatFloat32, 44100, 44100, 0},
+		{FormatS16, 0, 48000, 1.0 / s16Scale},
+		{FormatS16, 96000, 96000, 1.0 / s16Scale},
+		{FormatS8, 0, 24000, 1 / TXSymbolScalingCoeff},
+		{FormatWAV, 0, 48000, 1.0 / s16Scale},
+		{FormatWAV, 24000, 24000, 1.0 / s16Scale},
+		{FormatWAVFloat, 0, 48000, 0},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s/%d", tt.format, tt.rate), func(t *testing.T) {
+			var b bytes.Buffer
+			w, err := NewSampleWriter(&b, tt.format, tt.rate)
+			if err != nil {
+				t.Fatalf("NewSampleWriter() error = %v", err)
+			}
+			// Write in two parts
+			if err := w.WriteSamples(in[:3]); err != nil {
+				t.Fatalf("SampleWriter.WriteSamples() error = %v", err)
+			}
+			if err := w.WriteSamples(in[3:]); err != nil {
+				t.Fatalf("SampleWriter.WriteSamples() error = %v", err)
+			}
+			w.Close()
+			r, err := NewSampleReader(&b, tt.format, tt.rate)
+			if err != nil {
+				t.Fatalf("NewSampleReader() error = %v", err)
+			}
+			if r.SampleRate != tt.wantRate {
+				t.Errorf("SampleReader.SampleRate = %d, want %d", r.SampleRate, tt.wantRate)
+			}
+			got, err := readAllSamples(r)
+			if err != io.EOF {
+				t.Errorf("SampleReader.ReadSamples() error = %v, want EOF", err)
+			}
+			if len(got) != len(in) {
+				t.Fatalf("read %d samples, want %d", len(got), len(in))
+			}
+			for i := range in {
+				// The CC1200 scaling differs a little each way
+				want := float64(in[i])
+				if tt.format == FormatS8 {
+					want *= float64(TXSymbolScalingCoeff * RXSymbolScalingCoeff * transmitGain)
+				}
+				if math.Abs(float64(got[i])-want) > tt.tolerance {
+					t.Errorf("sample %d = %f, want %f", i, got[i], want)
+				}
+			}
+		})
+	}
+}
+
+func TestSampleFile_Errors(t *testing.T) {
+	if _, err := NewSampleReader(bytes.NewReader(make([]byte, 100)), FormatWAV, 0); err == nil {
+		t.Errorf("NewSampleReader() of a WAV file with no header succeeded")
+	}
+	if _, err := NewSampleReader(bytes.NewReader(nil), FormatFloat32, 0); err == nil {
+		t.Errorf("NewSampleReader() of float32 samples with no rate succeeded")
+	}
+	if _, err := NewSampleWriter(io.Discard, FormatS8, 48000); err == nil {
+		t.Errorf("NewSampleWriter() of CC1200 samples at 48 kHz succeeded")
+	}
+	if _, err := NewSampleWriter(io.Discard, FormatS16, -1); err == nil {
+		t.Errorf("NewSampleWriter() with a negative rate succeeded")
+	}
+}
+
+// wavFile builds a WAV file with a LIST chunk before the data
+func wavFile(tag uint16, channels, rate, bits int, data []byte) []byte {
+	var fmtChunk []byte
+	fmtChunk = binary.LittleEndian.AppendUint16(fmtChunk, tag)
+	fmtChunk = binary.LittleEndian.AppendUint16(fmtChunk, uint16(channels))
+	fmtChunk = binary.LittleEndian.AppendUint32(fmtChunk, uint32(rate))
+	fmtChunk = binary.LittleEndian.AppendUint32(fmtChunk, uint32(rate*channels*bits/8))
+	fmtChunk = binary.LittleEndian.AppendUint16(fmtChunk, uint16(channels*bits/8))
+	fmtChunk = binary.LittleEndian.AppendUint16(fmtChunk, uint16(bits))
+	if tag == wavFormatExtensible {
+		fmtChunk = binary.LittleEndian.AppendUint16(fmtChunk, 22)
+		fmtChunk = binary.LittleEndian.AppendUint16(fmtChunk, uint16(bits))
+		fmtChunk = binary.LittleEndian.AppendUint32(fmtChunk, 4)
+		// The subformat GUID for float samples
+		fmtChunk = binary.LittleEndian.AppendUint16(fmtChunk, wavFormatFloat)
+		fmtChunk = append(fmtChunk, 0, 0, 0, 0, 0x10, 0, 0x80, 0, 0, 0xAA, 0, 0x38, 0x9B, 0x71)
+	}
+	b := []byte("RIFF")
+	b = binary.LittleEndian.AppendUint32(b, uint32(4+8+len(fmtChunk)+8+6+8+len(data)))
+	b = append(b, "WAVEfmt "...)
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(fmtChunk)))
+	b = append(b, fmtChunk...)
+	// An odd sized chunk, padded to an even length
+	b = append(b, "LIST"...)
+	b = binary.LittleEndian.AppendUint32(b, 5)
+	b = append(b, "INFOx\x00"...)
+	b = append(b, "data"...)
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(data)))
+	b = append(b, data...)
+	// Trailing metadata after the data isn't read as samples
+	return append(b, "id3 \x00\x00\x00\x00"...)
+}
+
+func TestSampleReader_WAV(t *testing.T) {
+	var stereo16, stereoFloat []byte
+	for _, v := range []float32{1, -1, -3, 3, 0.5, 2} {
+		stereo16 = binary.LittleEndian.AppendUint16(stereo16, uint16(int16(v*s16Scale)))
+		stereoFloat = binary.LittleEndian.AppendUint32(stereoFloat, math.Float32bits(v))
+	}
+	tests := []struct {
+		name     string
+		file     []byte
+		format   SampleFormat
+		wantRate int
+		want     []float32
+		wantErr  bool
+	}{
+		{"PCM stereo", wavFile(wavFormatPCM, 2, 48000, 16, stereo16), FormatWAV, 48000, []float32{1, -3, 0.5}, false},
+		{"float stereo", wavFile(wavFormatFloat, 2, 96000, 32, stereoFloat), FormatWAV, 96000, []float32{1, -3, 0.5}, false},
+		{"extensible mono", wavFile(wavFormatExtensible, 1, 44100, 32, stereoFloat), FormatWAV, 44100, []float32{1, -1, -3, 3, 0.5, 2}, false},
+		// The header is used whatever format was asked for
+		{"detected", wavFile(wavFormatPCM, 1, 24000, 16, stereo16), FormatSymbols, 24000, []float32{1, -1, -3, 3, 0.5, 2}, false},
+		{"8 bit", wavFile(wavFormatPCM, 1, 24000, 8, stereo16), FormatWAV, 0, nil, true},
+		{"truncated", wavFile(wavFormatPCM, 1, 24000, 16, nil)[:30], FormatWAV, 0, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := NewSampleReader(bytes.NewReader(tt.file), tt.format, 0)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewSampleReader() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if r.Format != FormatWAV || r.SampleRate != tt.wantRate {
+				t.Errorf("NewSampleReader() read %s at %d Hz, want WAV at %d Hz", r.Format, r.SampleRate, tt.wantRate)
+			}
+			got, _ := readAllSamples(r)
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("SampleReader.ReadSamples() got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSampleWriter_WAVHeader(t *testing.T) {
+	tests := []struct {
+		format SampleFormat
+		tag    uint16
+		// bytes per sample
+		size int
+	}{
+		{FormatWAV, wavFormatPCM, 2},
+		{FormatWAVFloat, wavFormatFloat, 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format.String(), func(t *testing.T) {
+			name := filepath.Join(t.TempDir(), "out.wav")
+			f := gog.Must(os.Create(name))
+			w := gog.Must(NewSampleWriter(f, tt.format, 48000))
+			w.WriteSamples(make([]float32, 100))
+			if err := w.Close(); err != nil {
+				t.Fatalf("SampleWriter.Close() error = %v", err)
+			}
+			f.Close()
+			b := gog.Must(os.ReadFile(name))
+			dataSize := 100 * tt.size
+			if len(b) != 44+dataSize {
+				t.Fatalf("wrote %d bytes, want %d", len(b), 44+dataSize)
+			}
+			if got := binary.LittleEndian.Uint32(b[4:]); got != uint32(36+dataSize) {
+				t.Errorf("RIFF size = %d, want %d", got, 36+dataSize)
+			}
+			if got := binary.LittleEndian.Uint16(b[20:]); got != tt.tag {
+				t.Errorf("format tag = %d, want %d", got, tt.tag)
+			}
+			if got := binary.LittleEndian.Uint16(b[34:]); got != uint16(8*tt.size) {
+				t.Errorf("bits per sample = %d, want %d", got, 8*tt.size)
+			}
+			if got := binary.LittleEndian.Uint32(b[40:]); got != uint32(dataSize) {
+				t.Errorf("data size = %d, want %d", got, dataSize)
+			}
+		})
+	}
+}
+
+func TestDummyModem_Formats(t *testing.T) {
+	data := []byte("Hello, world!")
+	p := gog.Must(NewPacket("N1ADJ", "N0CALL", PacketTypeSMS, data))
+	tests := []struct {
+		name string
+		// format for transmitting and receiving, and their sample rates
+		outFormat SampleFormat
+		outRate   int
+		inFormat  SampleFormat
+		inRate    int
+	}{
+		{"symbols", FormatSymbols, 0, FormatSymbols, 0},
+		{"WAV", FormatWAV, 48000, FormatSymbols, 0},
+		{"WAV 44.1 kHz", FormatWAV, 44100, FormatWAV, 0},
+		{"s16", FormatS16, 0, FormatS16, 0},
+		{"s8", FormatS8, 0, FormatS8, 0},
+		{"f32", FormatFloat32, 96000, FormatFloat32, 96000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := &nopWriteCloser{}
+			tx := DummyModem{Out: out, OutFormat: tt.outFormat, SampleRate: tt.outRate}
+			if err := tx.TransmitPacket(*p); err != nil {
+				t.Fatalf("DummyModem.TransmitPacket() error = %v", err)
+			}
+			// Follow the packet with silence to flush the decoder
+			silence := symbolBufSize / decoderSamplesPerSymbol
+			if tx.writer.SampleRate != 0 {
+				silence = symbolBufSize * tx.writer.SampleRate / decoderSampleRate
+			}
+			tx.writer.WriteSamples(make([]float32, silence+1))
+			rx := &DummyModem{In: io.NopCloser(&out.Buffer), InFormat: tt.inFormat, SampleRate: tt.inRate}
+			var got []byte
+			NewDecoder(nil).DecodeSymbols(rx, func(e Event) {
+				if e, ok := e.(PacketEvent); ok {
+					got = e.Payload
+				}
+			})
+			if !bytes.Equal(got, p.PayloadBytes()) {
+				t.Errorf("decoded packet %q, want %q", got, p.PayloadBytes())
+			}
+		})
+	}
+}
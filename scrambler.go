@@ -0,0 +1,169 @@
+package m17
+
+import (
+	"fmt"
+)
+
+// Each stream frame payload uses 128 bits of the scrambler keystream
+const scramblerBitsPerFrame = 8 * StreamPayloadLen
+
+// lfsrMatrix is a linear map of LFSR states over GF(2). Element i is the image
+// of state bit i.
+type lfsrMatrix [24]uint32
+
+func (m *lfsrMatrix) apply(state uint32) uint32 {
+	var r uint32
+	for i := range m {
+		if state>>i&1 != 0 {
+			r ^= m[i]
+		}
+	}
+	return r
+}
+
+// Each LFSR step is linear, so frame number fn's state is a matrix power times
+// the seed. frameJumps[subtype][k] advances the state 2^k frames, so reaching
+// any frame number takes one jump per set bit.
+var frameJumps = func() (jumps [3][15]lfsrMatrix) {
+	for subtype := range jumps {
+		s := Scrambler{subtype: LSFEncryptionSubtype(subtype)}
+		m := &jumps[subtype][0]
+		for i := range m {
+			s.state = 1 << i
+			for range scramblerBitsPerFrame {
+				s.step()
+			}
+			m[i] = s.state
+		}
+		for k := 1; k < len(jumps[subtype]); k++ {
+			prev := &jumps[subtype][k-1]
+			for i := range prev {
+				jumps[subtype][k][i] = prev.apply(prev[i])
+			}
+		}
+	}
+	return jumps
+}()
+
+// Scrambler implements M17 scrambler encryption. An 8, 16 or 24 bit LFSR
+// generates a keystream that is XORed with the stream payloads. The keystream
+// is tied to the frame number, so a receiver can join a stream late.
+type Scrambler struct {
+	seed    uint32
+	subtype LSFEncryptionSubtype
+	// LFSR state at the start of frame nextFN
+	state  uint32
+	nextFN uint16
+}
+
+// NewScrambler creates a Scrambler with an LFSR of the length given by
+// subtype, starting from seed.
+func NewScrambler(seed uint32, subtype LSFEncryptionSubtype) (*Scrambler, error) {
+	var mask uint32
+	switch subtype {
+	case LSFEncryptionSubtypeScrambler8:
+		mask = 0xFF
+	case LSFEncryptionSubtypeScrambler16:
+		mask = 0xFFFF
+	case LSFEncryptionSubtypeScrambler24:
+		mask = 0xFFFFFF
+	default:
+		return nil, fmt.Errorf("bad scrambler subtype %d", subtype)
+	}
+	if seed == 0 || seed&^mask != 0 {
+		return nil, fmt.Errorf("scrambler seed %#x must be nonzero and fit in the LFSR (mask %#x)", seed, mask)
+	}
+	return &Scrambler{
+		seed:    seed,
+		subtype: subtype,
+		state:   seed,
+	}, nil
+}
+
+// ScramblerSubtype returns the smallest scrambler subtype that can hold seed.
+func ScramblerSubtype(seed uint32) LSFEncryptionSubtype {
+	switch {
+	case seed <= 0xFF:
+		return LSFEncryptionSubtypeScrambler8
+	case seed <= 0xFFFF:
+		return LSFEncryptionSubtypeScrambler16
+	}
+	return LSFEncryptionSubtypeScrambler24
+}
+
+// newScramblerFromKey creates a Scrambler from a 1 to 3 byte big endian seed
+// as stored in a KeyStore. The seed length selects the subtype.
+func newScramblerFromKey(key []byte) (*Scrambler, error) {
+	if len(key) < 1 || len(key) > 3 {
+		return nil, fmt.Errorf("scrambler seed length %d must be 1, 2 or 3", len(key))
+	}
+	var seed uint32
+	for _, b := range key {
+		seed = seed<<8 | uint32(b)
+	}
+	return NewScrambler(seed, LSFEncryptionSubtype(len(key)-1))
+}
+
+// Seed returns the scrambler's initial LFSR value.
+func (s *Scrambler) Seed() uint32 {
+	return s.seed
+}
+
+// Subtype returns the LSF encryption subtype for this scrambler.
+func (s *Scrambler) Subtype() LSFEncryptionSubtype {
+	return s.subtype
+}
+
+// Advance the LFSR one step, returning the output bit
+func (s *Scrambler) step() byte {
+	l := s.state
+	var bit uint32
+	switch s.subtype {
+	case LSFEncryptionSubtypeScrambler8:
+		bit = (l >> 7) ^ (l >> 5) ^ (l >> 4) ^ (l >> 3)
+	case LSFEncryptionSubtypeScrambler16:
+		bit = (l >> 15) ^ (l >> 14) ^ (l >> 12) ^ (l >> 3)
+	default:
+		bit = (l >> 23) ^ (l >> 22) ^ (l >> 21) ^ (l >> 16)
+	}
+	bit &= 1
+	s.state = ((l << 1) | bit) & 0xFFFFFF
+	return byte(bit)
+}
+
+// Keystream returns the keystream for the stream frame with frame number fn.
+// Consecutive frames continue from the current LFSR state. Otherwise, as on
+// late entry or after lost frames, the LFSR jumps ahead from the seed.
+func (s *Scrambler) Keystream(fn uint16) [StreamPayloadLen]byte {
+	fn &= frameNumberMask
+	if fn != s.nextFN {
+		s.state = s.seed
+		for k, m := range frameJumps[s.subtype] {
+			if fn>>k&1 != 0 {
+				s.state = m.apply(s.state)
+			}
+		}
+	}
+	var ks [StreamPayloadLen]byte
+	for i := range ks {
+		for range 8 {
+			ks[i] = ks[i]<<1 | s.step()
+		}
+	}
+	s.nextFN = (fn + 1) & frameNumberMask
+	if s.nextFN == 0 {
+		// The frame number wrapped, so the keystream starts over
+		s.state = s.seed
+	}
+	return ks
+}
+
+// CryptStreamPayload scrambles or descrambles the payload of the stream frame
+// with frame number fn.
+func (s *Scrambler) CryptStreamPayload(fn uint16, payload [StreamPayloadLen]byte) [StreamPayloadLen]byte {
+	ks := s.Keystream(fn)
+	for i := range payload {
+		payload[i] ^= ks[i]
+	}
+	return payload
+}
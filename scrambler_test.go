@@ -0,0 +1,231 @@
+package m17
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/icza/gog"
+)
+
+func TestNewScrambler(t *testing.T) {
+	tests := []struct {
+		name    string
+		seed    uint32
+		subtype LSFEncryptionSubtype
+		wantErr bool
+	}{
+		{"8 bit", 0x5A, LSFEncryptionSubtypeScrambler8, false},
+		{"16 bit", 0x1234, LSFEncryptionSubtypeScrambler16, false},
+		{"24 bit", 0xABCDEF, LSFEncryptionSubtypeScrambler24, false},
+		{"short seed in long LFSR", 0x5A, LSFEncryptionSubtypeScrambler24, false},
+		{"zero seed", 0, LSFEncryptionSubtypeScrambler8, true},
+		{"seed too long", 0x1234, LSFEncryptionSubtypeScrambler8, true},
+		{"bad subtype", 0x5A, 3, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewScrambler(tt.seed, tt.subtype)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NewScrambler() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestScramblerSubtype(t *testing.T) {
+	tests := []struct {
+		seed uint32
+		want LSFEncryptionSubtype
+	}{
+		{0x01, LSFEncryptionSubtypeScrambler8},
+		{0xFF, LSFEncryptionSubtypeScrambler8},
+		{0x100, LSFEncryptionSubtypeScrambler16},
+		{0xFFFF, LSFEncryptionSubtypeScrambler16},
+		{0x10000, LSFEncryptionSubtypeScrambler24},
+	}
+	for _, tt := range tests {
+		if got := ScramblerSubtype(tt.seed); got != tt.want {
+			t.Errorf("ScramblerSubtype(%#x) = %d, want %d", tt.seed, got, tt.want)
+		}
+	}
+}
+
+func TestScrambler_Period(t *testing.T) {
+	// The LFSR taps give maximal length sequences
+	tests := []struct {
+		seed    uint32
+		subtype LSFEncryptionSubtype
+		mask    uint32
+		period  int
+	}{
+		{0x5A, LSFEncryptionSubtypeScrambler8, 0xFF, 0xFF},
+		{0x1234, LSFEncryptionSubtypeScrambler16, 0xFFFF, 0xFFFF},
+	}
+	for _, tt := range tests {
+		s := gog.Must(NewScrambler(tt.seed, tt.subtype))
+		for i := 1; i <= tt.period; i++ {
+			s.step()
+			if s.state&tt.mask == tt.seed {
+				if i != tt.period {
+					t.Errorf("subtype %d period = %d, want %d", tt.subtype, i, tt.period)
+				}
+				break
+			}
+		}
+	}
+}
+
+func TestScrambler_Keystream(t *testing.T) {
+	for _, seed := range []uint32{0x5A, 0x1234, 0xABCDEF} {
+		s := gog.Must(NewScrambler(seed, ScramblerSubtype(seed)))
+		var stream [][StreamPayloadLen]byte
+		for fn := range uint16(10) {
+			stream = append(stream, s.Keystream(fn))
+		}
+		if stream[0] == stream[1] {
+			t.Errorf("seed %#x keystream repeats", seed)
+		}
+		// Late entry must produce the same keystream as following from the start
+		for _, fn := range []uint16{7, 3, 9 | LastFrameFlag} {
+			late := gog.Must(NewScrambler(seed, ScramblerSubtype(seed)))
+			if got := late.Keystream(fn); got != stream[fn&frameNumberMask] {
+				t.Errorf("seed %#x late entry at fn %d = % x, want % x", seed, fn, got, stream[fn&frameNumberMask])
+			}
+		}
+		// Frame numbers wrap back to the start of the keystream
+		s.Keystream(frameNumberMask)
+		if got := s.Keystream(0); got != stream[0] {
+			t.Errorf("seed %#x keystream after wrap = % x, want % x", seed, got, stream[0])
+		}
+	}
+}
+
+func TestScrambler_KeystreamJump(t *testing.T) {
+	// Jumping ahead to a frame must match stepping the LFSR frame by frame
+	for _, seed := range []uint32{0x5A, 0x1234, 0xABCDEF} {
+		s := gog.Must(NewScrambler(seed, ScramblerSubtype(seed)))
+		fns := []uint16{1, 2, 255, 256, 4097, 0x5555, frameNumberMask}
+		for fn := range frameNumberMask + 1 {
+			if len(fns) == 0 {
+				break
+			}
+			var ks [StreamPayloadLen]byte
+			for i := range ks {
+				for range 8 {
+					ks[i] = ks[i]<<1 | s.step()
+				}
+			}
+			if fn != fns[0] {
+				continue
+			}
+			fns = fns[1:]
+			late := gog.Must(NewScrambler(seed, ScramblerSubtype(seed)))
+			if got := late.Keystream(fn); got != ks {
+				t.Errorf("seed %#x jump to fn %d = % x, want % x", seed, fn, got, ks)
+			}
+		}
+	}
+}
+
+func BenchmarkScrambler_KeystreamLate(b *testing.B) {
+	s := gog.Must(NewScrambler(0xABCDEF, LSFEncryptionSubtypeScrambler24))
+	var fn uint16
+	for b.Loop() {
+		// Every other frame lost, so each one jumps
+		fn += 2
+		s.Keystream(fn)
+	}
+}
+
+func TestStreamEncoder_Scrambler(t *testing.T) {
+	tests := []struct {
+		name string
+		seed []byte
+	}{
+		{"8 bit", []byte{0x5A}},
+		{"16 bit", []byte{0x12, 0x34}},
+		{"24 bit", []byte{0xAB, 0xCD, 0xEF}},
+	}
+	payloads := testPayloads(8)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lsf := gog.Must(NewLSF("@ALL", "N0CALL", LSFTypeStream, LSFDataTypeVoice, LSFEncryptionTypeNone, 0, 0))
+			e := NewStreamEncoder(lsf)
+			err := e.SetKey(tt.seed)
+			if err != nil {
+				t.Fatalf("StreamEncoder.SetKey() error = %v", err)
+			}
+			encLSF := e.LSF()
+			if encLSF.EncryptionType() != LSFEncryptionTypeScrambler || encLSF.EncryptionSubtype() != LSFEncryptionSubtype(len(tt.seed)-1) {
+				t.Errorf("StreamEncoder LSF type = %#v", encLSF.Type)
+			}
+			syms, err := e.Encode(payloads)
+			if err != nil {
+				t.Fatalf("StreamEncoder.Encode() error = %v", err)
+			}
+			for _, withKey := range []bool{false, true} {
+				d := NewDecoder(nil)
+				if withKey {
+					d.Keys = NewKeyStore()
+					d.Keys.AddCallsignKey("N0CALL", tt.seed)
+				}
+				var got [][]byte
+				d.DecodeSymbols(&DummyModem{In: symbolReader(t, syms)}, func(e Event) {
+					if f, ok := e.(StreamFrameEvent); ok {
+						got = append(got, bytes.Clone(f.Payload))
+					}
+				})
+				if len(got) == 0 {
+					t.Fatalf("no frames decoded")
+				}
+				for i := range got {
+					if bytes.Equal(got[i], payloads[i][:]) != withKey {
+						t.Errorf("frame %d with key %v payload = % x", i, withKey, got[i])
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestDummyModem_Scrambler(t *testing.T) {
+	seed := []byte{0x12, 0x34}
+	lsf := gog.Must(NewLSF("@ALL", "N0CALL", LSFTypeStream, LSFDataTypeVoice, LSFEncryptionTypeNone, 0, 0))
+	payloads := testPayloads(2)
+	out := &nopWriteCloser{}
+	m := DummyModem{Out: out, Keys: NewKeyStore()}
+	m.Keys.SetDefaultKey(seed)
+	for i, p := range payloads {
+		sd := StreamDatagram{StreamID: 0x1234, FrameNumber: uint16(i), LSF: lsf, Payload: p}
+		if i == len(payloads)-1 {
+			sd.FrameNumber |= LastFrameFlag
+			sd.LastFrame = true
+		}
+		err := m.TransmitVoiceStream(sd)
+		if err != nil {
+			t.Fatalf("DummyModem.TransmitVoiceStream() error = %v", err)
+		}
+	}
+	syms := make([]Symbol, out.Len()/4)
+	err := binary.Read(out, binary.LittleEndian, syms)
+	if err != nil {
+		t.Fatalf("failed to read symbols: %v", err)
+	}
+	d := NewDecoder(nil)
+	d.Keys = m.Keys
+	var got [][]byte
+	var gotLSF *LSF
+	d.DecodeSymbols(&DummyModem{In: symbolReader(t, syms)}, func(e Event) {
+		if f, ok := e.(StreamFrameEvent); ok {
+			gotLSF = f.LSF
+			got = append(got, bytes.Clone(f.Payload))
+		}
+	})
+	if gotLSF == nil || gotLSF.EncryptionType() != LSFEncryptionTypeScrambler || gotLSF.EncryptionSubtype() != LSFEncryptionSubtypeScrambler16 {
+		t.Fatalf("decoded LSF %v", gotLSF)
+	}
+	if len(got) == 0 || !bytes.Equal(got[0], payloads[0][:]) {
+		t.Errorf("decoded payloads % x, want % x", got, payloads)
+	}
+}
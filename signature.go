@@ -0,0 +1,263 @@
+package m17
+
+import (
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"fmt"
+	"log"
+	"math/big"
+	"sync"
+)
+
+const (
+	// ECDSA P-256 signature, r followed by s
+	SignatureLen = 64
+	// The signature is sent in the payloads of the last 4 stream frames
+	signatureFrames = SignatureLen / StreamPayloadLen
+	// Frame number of the first signature frame
+	signatureFirstFN = uint16(0x7FFC)
+	// Length of a P-256 private key and of each public key coordinate
+	p256KeyLen = 32
+)
+
+// signatureFN returns the frame number of signature frame i. The last one
+// carries the LastFrameFlag.
+func signatureFN(i int) uint16 {
+	fn := signatureFirstFN + uint16(i)
+	if i == signatureFrames-1 {
+		fn |= LastFrameFlag
+	}
+	return fn
+}
+
+// isSignatureFrame reports whether fn is one of the frame numbers used for the
+// signature at the end of a signed stream.
+func isSignatureFrame(fn uint16) bool {
+	return fn&frameNumberMask >= signatureFirstFN
+}
+
+// StreamDigest is the value signed in a signed stream. Each payload, as sent
+// over the air, is XORed in and then the digest is rotated left one byte.
+type StreamDigest [StreamPayloadLen]byte
+
+// Add adds a stream frame payload to the digest.
+func (d *StreamDigest) Add(payload [StreamPayloadLen]byte) {
+	for i := range d {
+		d[i] ^= payload[i]
+	}
+	first := d[0]
+	copy(d[:], d[1:])
+	d[len(d)-1] = first
+}
+
+// SignStream signs a stream digest with a P-256 private key.
+func SignStream(key *ecdsa.PrivateKey, digest StreamDigest) ([SignatureLen]byte, error) {
+	var sig [SignatureLen]byte
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	if err != nil {
+		return sig, fmt.Errorf("failed to sign stream: %w", err)
+	}
+	r.FillBytes(sig[:SignatureLen/2])
+	s.FillBytes(sig[SignatureLen/2:])
+	return sig, nil
+}
+
+// VerifyStream checks a stream signature against a P-256 public key.
+func VerifyStream(key *ecdsa.PublicKey, digest StreamDigest, sig [SignatureLen]byte) bool {
+	r := new(big.Int).SetBytes(sig[:SignatureLen/2])
+	s := new(big.Int).SetBytes(sig[SignatureLen/2:])
+	return ecdsa.Verify(key, digest[:], r, s)
+}
+
+// ParseSigningPrivateKey parses a raw 32 byte P-256 private key.
+func ParseSigningPrivateKey(b []byte) (*ecdsa.PrivateKey, error) {
+	k, err := ecdh.P256().NewPrivateKey(b)
+	if err != nil {
+		return nil, fmt.Errorf("bad signing private key: %w", err)
+	}
+	pub, err := ParseSigningPublicKey(k.PublicKey().Bytes())
+	if err != nil {
+		return nil, err
+	}
+	return &ecdsa.PrivateKey{
+		PublicKey: *pub,
+		D:         new(big.Int).SetBytes(b),
+	}, nil
+}
+
+// ParseSigningPublicKey parses a P-256 public key, either 64 bytes of X and Y
+// coordinates or 65 bytes in uncompressed form, starting with 0x04.
+func ParseSigningPublicKey(b []byte) (*ecdsa.PublicKey, error) {
+	switch {
+	case len(b) == 2*p256KeyLen:
+	case len(b) == 2*p256KeyLen+1 && b[0] == 0x04:
+		b = b[1:]
+	default:
+		return nil, fmt.Errorf("bad signing public key length %d, must be 64 or 65", len(b))
+	}
+	k := &ecdsa.PublicKey{
+		Curve: elliptic.P256(),
+		X:     new(big.Int).SetBytes(b[:p256KeyLen]),
+		Y:     new(big.Int).SetBytes(b[p256KeyLen:]),
+	}
+	// Conversion fails for points that aren't on the curve
+	_, err := k.ECDH()
+	if err != nil {
+		return nil, fmt.Errorf("bad signing public key: %w", err)
+	}
+	return k, nil
+}
+
+// SignatureStatus is the result of checking the signature of a stream.
+type SignatureStatus byte
+
+const (
+	// The stream is not signed
+	SignatureNone SignatureStatus = iota
+	// Signed with a key registered to the stream's originator
+	SignatureValid
+	// Signed with a key registered to a different callsign
+	SignatureWrongCallsign
+	// No registered key matches the signature
+	SignatureUnverified
+	// Frames were missed, so the signature can't be checked
+	SignatureIncomplete
+)
+
+func (s SignatureStatus) String() string {
+	switch s {
+	case SignatureNone:
+		return "none"
+	case SignatureValid:
+		return "valid"
+	case SignatureWrongCallsign:
+		return "wrong callsign"
+	case SignatureUnverified:
+		return "unverified"
+	case SignatureIncomplete:
+		return "incomplete"
+	}
+	return fmt.Sprintf("unknown (%d)", s)
+}
+
+// SignatureResult describes the outcome of checking a stream signature.
+type SignatureResult struct {
+	Status SignatureStatus
+	// Callsign registered for the key that made the signature, if any
+	Signer string
+}
+
+func (r SignatureResult) String() string {
+	if r.Status == SignatureWrongCallsign {
+		return fmt.Sprintf("%s, signed by %s", r.Status, r.Signer)
+	}
+	return r.Status.String()
+}
+
+type signer struct {
+	callsign string
+	key      *ecdsa.PublicKey
+}
+
+// SignerRegistry maps the public keys used to sign streams to the callsigns
+// they belong to. It is safe for concurrent use.
+type SignerRegistry struct {
+	mu      sync.RWMutex
+	signers []signer
+}
+
+// NewSignerRegistry creates an empty SignerRegistry.
+func NewSignerRegistry() *SignerRegistry {
+	return &SignerRegistry{}
+}
+
+// Add registers key as belonging to callsign. A callsign may have more than
+// one key.
+func (r *SignerRegistry) Add(callsign string, key *ecdsa.PublicKey) error {
+	if key == nil || key.Curve != elliptic.P256() {
+		return fmt.Errorf("signing key for %s must be P-256", callsign)
+	}
+	cs, err := EncodeCallsign(callsign)
+	if err != nil {
+		return fmt.Errorf("bad signer callsign %s: %w", callsign, err)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.signers = append(r.signers, signer{EncodedCallsign(*cs).Callsign(), key})
+	return nil
+}
+
+// Verify checks the signature of the stream described by lsf. A signature
+// made with a key registered to a different callsign than the originator
+// suggests a spoofed callsign.
+func (r *SignerRegistry) Verify(lsf *LSF, digest StreamDigest, sig [SignatureLen]byte) SignatureResult {
+	if !lsf.Signed() {
+		return SignatureResult{Status: SignatureNone}
+	}
+	if r == nil {
+		return SignatureResult{Status: SignatureUnverified}
+	}
+	originator := lsf.Originator()
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var ret SignatureResult
+	for _, s := range r.signers {
+		if !VerifyStream(s.key, digest, sig) {
+			continue
+		}
+		if s.callsign == originator {
+			return SignatureResult{Status: SignatureValid, Signer: s.callsign}
+		}
+		ret = SignatureResult{Status: SignatureWrongCallsign, Signer: s.callsign}
+	}
+	if ret.Status == SignatureNone {
+		ret.Status = SignatureUnverified
+	}
+	return ret
+}
+
+// signatureReceiver collects the digest and signature of a received stream.
+type signatureReceiver struct {
+	digest StreamDigest
+	sig    [SignatureLen]byte
+	// bitmap of the signature frames received
+	parts  byte
+	nextFN uint16
+	// set when a frame is missed, as on late entry
+	missed bool
+}
+
+func (s *signatureReceiver) reset() {
+	*s = signatureReceiver{}
+}
+
+// Add the over the air payload of the stream frame with frame number fn
+func (s *signatureReceiver) addFrame(fn uint16, payload []byte) {
+	var p [StreamPayloadLen]byte
+	copy(p[:], payload)
+	if isSignatureFrame(fn) {
+		i := fn&frameNumberMask - signatureFirstFN
+		copy(s.sig[i*StreamPayloadLen:], p[:])
+		s.parts |= 1 << i
+		return
+	}
+	if fn&frameNumberMask != s.nextFN {
+		s.missed = true
+	}
+	s.nextFN = (fn + 1) & frameNumberMask
+	s.digest.Add(p)
+}
+
+// Check the signature of the stream described by lsf
+func (s *signatureReceiver) verify(lsf *LSF, signers *SignerRegistry) SignatureResult {
+	if !lsf.Signed() {
+		return SignatureResult{Status: SignatureNone}
+	}
+	if s.missed || s.parts != 1<<signatureFrames-1 {
+		log.Printf("[DEBUG] Incomplete signed stream, signature parts %04b, missed frames %v", s.parts, s.missed)
+		return SignatureResult{Status: SignatureIncomplete}
+	}
+	return signers.Verify(lsf, s.digest, s.sig)
+}
@@ -0,0 +1,185 @@
+package m17
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/hex"
+	"testing"
+
+	"github.com/icza/gog"
+)
+
+func TestStreamDigest(t *testing.T) {
+	var d StreamDigest
+	var p [StreamPayloadLen]byte
+	p[0] = 0xAA
+	p[15] = 0x55
+	d.Add(p)
+	want := StreamDigest{14: 0x55, 15: 0xAA}
+	if d != want {
+		t.Errorf("StreamDigest.Add() = % x, want % x", d, want)
+	}
+	d.Add(p)
+	want = StreamDigest{13: 0x55, 14: 0xFF, 15: 0xAA}
+	if d != want {
+		t.Errorf("StreamDigest.Add() = % x, want % x", d, want)
+	}
+}
+
+func TestSignStream(t *testing.T) {
+	key := gog.Must(ecdsa.GenerateKey(elliptic.P256(), rand.Reader))
+	other := gog.Must(ecdsa.GenerateKey(elliptic.P256(), rand.Reader))
+	digest := StreamDigest{1, 2, 3}
+	sig, err := SignStream(key, digest)
+	if err != nil {
+		t.Fatalf("SignStream() error = %v", err)
+	}
+	if !VerifyStream(&key.PublicKey, digest, sig) {
+		t.Errorf("VerifyStream() = false")
+	}
+	if VerifyStream(&other.PublicKey, digest, sig) {
+		t.Errorf("VerifyStream() = true with wrong key")
+	}
+	digest[0] ^= 1
+	if VerifyStream(&key.PublicKey, digest, sig) {
+		t.Errorf("VerifyStream() = true with wrong digest")
+	}
+}
+
+func TestParseSigningKeys(t *testing.T) {
+	priv := gog.Must(hex.DecodeString("c9afa9d845ba75166b5c215767b1d6934e50c3db36e89b127b8a622b120f6721"))
+	key, err := ParseSigningPrivateKey(priv)
+	if err != nil {
+		t.Fatalf("ParseSigningPrivateKey() error = %v", err)
+	}
+	// Public key from RFC 6979 A.2.5
+	wantX := "60fed4ba255a9d31c961eb74c6356d68c049b8923b61fa6ce669622e60f29fb6"
+	if got := hex.EncodeToString(key.X.Bytes()); got != wantX {
+		t.Errorf("ParseSigningPrivateKey() X = %s, want %s", got, wantX)
+	}
+	raw := append(key.X.FillBytes(make([]byte, 32)), key.Y.FillBytes(make([]byte, 32))...)
+	tests := []struct {
+		name    string
+		b       []byte
+		wantErr bool
+	}{
+		{"raw", raw, false},
+		{"uncompressed", append([]byte{0x04}, raw...), false},
+		{"short", raw[:63], true},
+		{"not on curve", append(bytes.Clone(raw[:63]), raw[63]^1), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pub, err := ParseSigningPublicKey(tt.b)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseSigningPublicKey() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && !pub.Equal(&key.PublicKey) {
+				t.Errorf("ParseSigningPublicKey() = %v, want %v", pub, key.PublicKey)
+			}
+		})
+	}
+	if _, err := ParseSigningPrivateKey(priv[:31]); err == nil {
+		t.Errorf("ParseSigningPrivateKey() accepted a short key")
+	}
+}
+
+// encodeSignedStream encodes a stream signed with key.
+func encodeSignedStream(t *testing.T, lsf LSF, key *ecdsa.PrivateKey, payloads [][StreamPayloadLen]byte) []Symbol {
+	e := NewStreamEncoder(lsf)
+	e.SetSigningKey(key)
+	if l := e.LSF(); !l.Signed() {
+		t.Fatalf("StreamEncoder.SetSigningKey() didn't set signed bit")
+	}
+	syms := gog.Must(e.Start())
+	for i, p := range payloads {
+		syms = append(syms, gog.Must(e.NextFrame(p, i == len(payloads)-1))...)
+	}
+	return append(syms, e.End()...)
+}
+
+func TestDecoder_SignedStream(t *testing.T) {
+	key := gog.Must(ecdsa.GenerateKey(elliptic.P256(), rand.Reader))
+	other := gog.Must(ecdsa.GenerateKey(elliptic.P256(), rand.Reader))
+	lsf := gog.Must(NewLSF("@ALL", "N0CALL", LSFTypeStream, LSFDataTypeVoice, LSFEncryptionTypeNone, 0, 0))
+	payloads := testPayloads(8)
+	syms := encodeSignedStream(t, lsf, key, payloads)
+
+	tests := []struct {
+		name       string
+		signers    map[string]*ecdsa.PublicKey
+		skip       int
+		want       SignatureStatus
+		wantSigner string
+	}{
+		{"valid", map[string]*ecdsa.PublicKey{"N1ADJ": &other.PublicKey, "N0CALL": &key.PublicKey}, 0, SignatureValid, "N0CALL"},
+		{"spoofed", map[string]*ecdsa.PublicKey{"N1ADJ": &key.PublicKey}, 0, SignatureWrongCallsign, "N1ADJ"},
+		{"unknown key", map[string]*ecdsa.PublicKey{"N0CALL": &other.PublicKey}, 0, SignatureUnverified, ""},
+		{"no registry", nil, 0, SignatureUnverified, ""},
+		// Joining late, the digest is missing the first frames
+		{"late entry", map[string]*ecdsa.PublicKey{"N0CALL": &key.PublicKey}, 2 * SymbolsPerFrame, SignatureIncomplete, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := NewDecoder(nil)
+			if tt.signers != nil {
+				d.Signers = NewSignerRegistry()
+				for cs, k := range tt.signers {
+					if err := d.Signers.Add(cs, k); err != nil {
+						t.Fatalf("SignerRegistry.Add() error = %v", err)
+					}
+				}
+			}
+			var results []SignatureResult
+			var got [][]byte
+			d.DecodeSymbols(&DummyModem{In: symbolReader(t, syms[tt.skip:])}, func(e Event) {
+				switch e := e.(type) {
+				case StreamFrameEvent:
+					if !e.Signature {
+						got = append(got, bytes.Clone(e.Payload))
+					}
+				case StreamEndEvent:
+					results = append(results, e.Signature)
+				}
+			})
+			if len(results) != 1 {
+				t.Fatalf("StreamEndEvents got %v, want one", results)
+			}
+			if results[0].Status != tt.want || results[0].Signer != tt.wantSigner {
+				t.Errorf("StreamEndEvent signature %v (%q), want %v (%q)", results[0], results[0].Signer, tt.want, tt.wantSigner)
+			}
+			if tt.skip == 0 && len(got) != len(payloads) {
+				t.Errorf("decoded %d frames, want %d", len(got), len(payloads))
+			}
+		})
+	}
+}
+
+func TestSignerRegistry(t *testing.T) {
+	key := gog.Must(ecdsa.GenerateKey(elliptic.P256(), rand.Reader))
+	r := NewSignerRegistry()
+	if err := r.Add("N0CALL", &key.PublicKey); err != nil {
+		t.Fatalf("SignerRegistry.Add() error = %v", err)
+	}
+	p384 := gog.Must(ecdsa.GenerateKey(elliptic.P384(), rand.Reader))
+	if err := r.Add("N0CALL", &p384.PublicKey); err == nil {
+		t.Errorf("SignerRegistry.Add() accepted a P-384 key")
+	}
+	lsf := gog.Must(NewLSF("@ALL", "N1ADJ", LSFTypeStream, LSFDataTypeVoice, LSFEncryptionTypeNone, 0, 0))
+	digest := StreamDigest{4, 5, 6}
+	sig := gog.Must(SignStream(key, digest))
+	if got := r.Verify(&lsf, digest, sig); got.Status != SignatureNone {
+		t.Errorf("SignerRegistry.Verify() unsigned = %v", got)
+	}
+	lsf.SetSigned(true)
+	if got := r.Verify(&lsf, digest, sig); got.Status != SignatureWrongCallsign || got.Signer != "N0CALL" {
+		t.Errorf("SignerRegistry.Verify() = %v", got)
+	}
+	// A relayed stream is checked against its originator
+	lsf.SetExtendedCallsign(*gog.Must(EncodeCallsign("N0CALL")), EncodedCallsign{})
+	if got := r.Verify(&lsf, digest, sig); got.Status != SignatureValid {
+		t.Errorf("SignerRegistry.Verify() relayed = %v", got)
+	}
+}
@@ -0,0 +1,142 @@
+package m17
+
+import (
+	"fmt"
+	"math"
+)
+
+const (
+	// Soft bits saturate at this log-likelihood ratio
+	maxLLR = 12
+	// Lower bound on the estimated noise variance, so a clean frame doesn't
+	// make every bit infinitely certain
+	minNoiseVariance = 0.01
+	// Iterations of the symbol offset estimate, enough for it to settle from
+	// the syncword's estimate
+	offsetIterations = 10
+)
+
+// symbolStats estimates where each of the four symbols was received, in the
+// order of SymbolList, and the variance of the noise around them. Each payload
+// symbol is assigned to its nearest center, and the centers moved to the mean
+// of their symbols.
+func symbolStats(pld []Symbol) ([4]float64, float64) {
+	var centers [4]float64
+	for i, s := range SymbolList {
+		centers[i] = float64(s)
+	}
+	var variance float64
+	for range 2 {
+		var sum, sumSq [4]float64
+		var n [4]int
+		for _, s := range pld {
+			v := float64(s)
+			c := nearestSymbol(centers, v)
+			sum[c] += v
+			sumSq[c] += v * v
+			n[c]++
+		}
+		variance = 0
+		for i := range centers {
+			if n[i] == 0 {
+				continue
+			}
+			centers[i] = sum[i] / float64(n[i])
+			variance += sumSq[i] - float64(n[i])*centers[i]*centers[i]
+		}
+		variance /= float64(len(pld))
+	}
+	return centers, max(variance, minNoiseVariance)
+}
+
+// Index of the center nearest v
+func nearestSymbol(centers [4]float64, v float64) int {
+	best := 0
+	for i := range centers {
+		if math.Abs(v-centers[i]) < math.Abs(v-centers[best]) {
+			best = i
+		}
+	}
+	return best
+}
+
+// symbolOffset estimates how far the payload symbols are offset from the
+// nominal symbols, given the variance of the noise around them. It fits a
+// mixture of Gaussians at the offset symbols by expectation maximization,
+// which unlike assigning each symbol to the nearest one doesn't hold the
+// estimate near where it started.
+func symbolOffset(pld []Symbol, variance float64) float64 {
+	var offset float64
+	for range offsetIterations {
+		var sum float64
+		for _, s := range pld {
+			// The distance to each symbol, weighted by how likely it is
+			// that s was sent as that symbol
+			var w, wd float64
+			for _, c := range SymbolList {
+				e := float64(s) - offset - float64(c)
+				p := math.Exp(-e * e / (2 * variance))
+				w += p
+				wd += p * e
+			}
+			if w > 0 {
+				sum += wd / w
+			}
+		}
+		offset += sum / float64(len(pld))
+	}
+	return offset
+}
+
+// symbolLLRs returns the log-likelihood ratios of the two bits carried by a
+// symbol received as v, positive when a bit is more likely 1. SymbolList
+// holds the symbols for dibits 11, 10, 00 and 01.
+func symbolLLRs(v float64, centers [4]float64, variance float64) (msb, lsb float64) {
+	var logP [4]float64
+	for i, c := range centers {
+		logP[i] = -(v - c) * (v - c) / (2 * variance)
+	}
+	msb = logSumExp(logP[0], logP[1]) - logSumExp(logP[2], logP[3])
+	lsb = logSumExp(logP[0], logP[3]) - logSumExp(logP[1], logP[2])
+	return msb, lsb
+}
+
+// log(exp(a) + exp(b))
+func logSumExp(a, b float64) float64 {
+	d := math.Abs(a - b)
+	if d > 30 {
+		// The smaller term is negligible
+		return max(a, b)
+	}
+	return max(a, b) + math.Log1p(math.Exp(-d))
+}
+
+// Convert a log-likelihood ratio to a soft bit, scaled so that the Viterbi
+// decoder's metrics stay proportional to the likelihoods
+func llrToSoftBit(llr float64) SoftBit {
+	llr = max(-maxLLR, min(maxLLR, llr))
+	return SoftBit(math.Round(softMaybe + llr/maxLLR*softMaybe))
+}
+
+// calcSoftbits converts payload symbols to soft bits, two per symbol, from
+// their log-likelihood ratios given the noise in the frame.
+func calcSoftbits(pld []Symbol) []SoftBit {
+	return fillSoftbits(make([]SoftBit, 2*SymbolsPerPayload), pld)
+}
+
+// fillSoftbits is calcSoftbits writing to softBit, which must hold
+// 2*SymbolsPerPayload soft bits.
+func fillSoftbits(softBit []SoftBit, pld []Symbol) []SoftBit {
+	if len(pld) > SymbolsPerPayload {
+		panic(fmt.Sprintf("pld contains %d symbols (>%d)", len(pld), SymbolsPerPayload))
+	}
+	softBit = softBit[:2*SymbolsPerPayload]
+	clear(softBit[2*len(pld):])
+	centers, variance := symbolStats(pld)
+	for i, sym := range pld {
+		msb, lsb := symbolLLRs(float64(sym), centers, variance)
+		softBit[i*2] = llrToSoftBit(msb)
+		softBit[i*2+1] = llrToSoftBit(lsb)
+	}
+	return softBit
+}
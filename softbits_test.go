@@ -0,0 +1,170 @@
+package m17
+
+import (
+	"bytes"
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/icza/gog"
+)
+
+// rampSoftbits is the fixed piecewise-linear mapping calcSoftbits replaced,
+// kept to measure the gain from log-likelihood ratios
+func rampSoftbits(pld []Symbol) []SoftBit {
+	softBit := make([]SoftBit, 2*SymbolsPerPayload)
+	for i, sym := range pld {
+		//bit 0
+		if sym >= SymbolList[3] {
+			softBit[i*2+1] = softTrue
+		} else if sym >= SymbolList[2] {
+			softBit[i*2+1] = SoftBit(-softTrue/((SymbolList[3]-SymbolList[2])*SymbolList[2]) + sym*softTrue/(SymbolList[3]-SymbolList[2]))
+		} else if sym >= SymbolList[1] {
+			softBit[i*2+1] = softFalse
+		} else if sym >= SymbolList[0] {
+			softBit[i*2+1] = SoftBit(softTrue/((SymbolList[1]-SymbolList[0])*SymbolList[1]) - sym*softTrue/(SymbolList[1]-SymbolList[0]))
+		} else {
+			softBit[i*2+1] = softTrue
+		}
+
+		//bit 1
+		if sym >= SymbolList[2] {
+			softBit[i*2] = softFalse
+		} else if sym >= SymbolList[1] {
+			softBit[i*2] = SoftBit(softMaybe - (sym * softTrue / (SymbolList[2] - SymbolList[1])))
+		} else {
+			softBit[i*2] = softTrue
+		}
+	}
+	return softBit
+}
+
+// Count the packet frames of p that fail to decode with a soft bit mapping
+// after distorting their symbols with shape and adding Gaussian noise with
+// standard deviation sigma
+func frameErrors(p *Packet, shape func(Symbol) Symbol, sigma float64, softbits func([]Symbol) []SoftBit) int {
+	syms := gog.Must(p.Encode())
+	data := p.PayloadBytes()
+	rnd := rand.New(rand.NewSource(1))
+	errs := 0
+	// Skip the preamble and LSF
+	for i, start := 0, 2*SymbolsPerFrame; i*25 < len(data); i, start = i+1, start+SymbolsPerFrame {
+		pld := make([]Symbol, SymbolsPerPayload)
+		for j, s := range syms[start+SymbolsPerSyncword : start+SymbolsPerFrame] {
+			pld[j] = shape(s) + Symbol(sigma*rnd.NormFloat64())
+		}
+		vd := ViterbiDecoder{}
+		frame, _ := vd.DecodePunctured(DeinterleaveSoftBits(DerandomizeSoftBits(softbits(pld))), PacketPuncturePattern)
+		end := min((i+1)*25, len(data))
+		if !bytes.Equal(frame[1:1+end-i*25], data[i*25:end]) {
+			errs++
+		}
+	}
+	return errs
+}
+
+func TestSymbolStats(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	want := [4]float64{-2.4, -0.9, 1.1, 2.6}
+	const sigma = 0.3
+	pld := make([]Symbol, 1000)
+	for i := range pld {
+		pld[i] = Symbol(want[i%4] + sigma*rnd.NormFloat64())
+	}
+	centers, variance := symbolStats(pld)
+	for i := range centers {
+		if math.Abs(centers[i]-want[i]) > 0.1 {
+			t.Errorf("centers = %.2f, want %.2f", centers, want)
+			break
+		}
+	}
+	if math.Abs(variance-sigma*sigma) > 0.03 {
+		t.Errorf("variance = %.3f, want %.3f", variance, sigma*sigma)
+	}
+}
+
+func TestSymbolOffset(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	const sigma = 0.5
+	for _, offset := range []float64{-0.6, 0, 0.3} {
+		pld := make([]Symbol, 1000)
+		for i := range pld {
+			pld[i] = SymbolList[rnd.Intn(4)] + Symbol(offset+sigma*rnd.NormFloat64())
+		}
+		if got := symbolOffset(pld, sigma*sigma); math.Abs(got-offset) > 0.05 {
+			t.Errorf("symbolOffset() = %.3f, want %.1f", got, offset)
+		}
+	}
+}
+
+func TestCalcSoftbits_Sensitivity(t *testing.T) {
+	data := make([]byte, 800)
+	rand.New(rand.NewSource(2)).Read(data)
+	p := gog.Must(NewPacket("N1ADJ", "N0CALL", PacketTypeSMS, data))
+	tests := []struct {
+		name  string
+		shape func(Symbol) Symbol
+		sigma float64
+	}{
+		{"nominal levels", func(s Symbol) Symbol { return s }, 0.85},
+		{"compressed outer levels", func(s Symbol) Symbol {
+			if s == 3 || s == -3 {
+				return s * 0.8
+			}
+			return s
+		}, 0.6},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			llr := frameErrors(p, tt.shape, tt.sigma, calcSoftbits)
+			ramp := frameErrors(p, tt.shape, tt.sigma, rampSoftbits)
+			t.Logf("frame errors: %d with LLRs, %d with fixed ramps", llr, ramp)
+			if llr >= ramp {
+				t.Errorf("LLRs gave %d frame errors, no better than %d with fixed ramps", llr, ramp)
+			}
+		})
+	}
+}
+
+func TestDecoder_NoisyCaptureSensitivity(t *testing.T) {
+	const trials = 10
+	tests := []struct {
+		capture string
+		sigma   float64
+		want    int
+	}{
+		{"short-noise2.flt", 0.4, 7},
+		{"medium-noise2.flt", 0.3, 7},
+	}
+	// Count the packets decoded from noisy copies of syms
+	decode := func(syms []Symbol, sigma float64, softbits func([]SoftBit, []Symbol) []SoftBit) int {
+		rnd := rand.New(rand.NewSource(1))
+		packets := 0
+		for range trials {
+			d := NewDecoder(nil)
+			d.softbits = softbits
+			d.DecodeSymbols(&DummyModem{In: symbolReader(t, distort(syms, 1, sigma, rnd))}, func(e Event) {
+				if _, ok := e.(PacketEvent); ok {
+					packets++
+				}
+			})
+		}
+		return packets
+	}
+	for _, tt := range tests {
+		t.Run(tt.capture, func(t *testing.T) {
+			syms := readCapture(t, tt.capture)
+			packets := decode(syms, tt.sigma, fillSoftbits)
+			ramp := decode(syms, tt.sigma, func(_ []SoftBit, pld []Symbol) []SoftBit {
+				return rampSoftbits(pld)
+			})
+			t.Logf("decoded %d of %d packets, %d with fixed ramps", packets, trials, ramp)
+			if packets < tt.want {
+				t.Errorf("decoded %d of %d packets, want at least %d", packets, trials, tt.want)
+			}
+			if packets <= ramp {
+				t.Errorf("decoded %d of %d packets, no more than %d with fixed ramps", packets, trials, ramp)
+			}
+		})
+	}
+}
@@ -1 +1,297 @@
 package m17
+
+import (
+	"crypto/ecdsa"
+	"fmt"
+	"time"
+)
+
+const (
+	// Length of the payload carried in each stream frame
+	StreamPayloadLen = 16
+	// Frame number bit that marks the last frame of a stream
+	LastFrameFlag = uint16(0x8000)
+	// Frame numbers count from 0 to 0x7FFF, then wrap
+	frameNumberMask = uint16(0x7FFF)
+	// Number of LICH chunks needed to rebuild an LSF
+	lichChunks = 6
+)
+
+// StreamEncoder generates the symbols for an M17 stream mode transmission:
+// a preamble, the LSF, stream frames carrying the LSF in rotating LICH chunks
+// and finally an EOT marker.
+type StreamEncoder struct {
+	lsf       LSF
+	fn        uint16
+	lichCnt   int
+	aesKey    []byte
+	scrambler *Scrambler
+	// Text Data META blocks, sent one per superframe
+	text    [][metaLen]byte
+	textIdx int
+	// Key for signing the stream and the digest of the payloads sent so far
+	signingKey *ecdsa.PrivateKey
+	digest     StreamDigest
+}
+
+// NewStreamEncoder creates a StreamEncoder for a stream described by lsf.
+func NewStreamEncoder(lsf LSF) *StreamEncoder {
+	lsf.CalcCRC()
+	return &StreamEncoder{
+		lsf: lsf,
+	}
+}
+
+// LSF returns the Link Setup Frame used by this encoder.
+func (e *StreamEncoder) LSF() LSF {
+	return e.lsf
+}
+
+// SetAESKey enables AES encryption of the stream payloads. The LSF is updated
+// to signal encryption and carry the nonce, so this must be called before Start.
+func (e *StreamEncoder) SetAESKey(key []byte, nonce [NonceLen]byte) error {
+	st, err := AESSubtype(key)
+	if err != nil {
+		return err
+	}
+	e.lsf.SetEncryption(LSFEncryptionTypeAES, st)
+	e.lsf.SetNonce(nonce)
+	e.lsf.CalcCRC()
+	e.aesKey = append([]byte(nil), key...)
+	e.scrambler = nil
+	e.text = nil
+	return nil
+}
+
+// SetScrambler enables scrambler encryption of the stream payloads using an
+// LFSR of the length given by subtype. ScramblerSubtype picks the shortest one
+// that fits seed. Like SetAESKey, this must be called before Start.
+func (e *StreamEncoder) SetScrambler(seed uint32, subtype LSFEncryptionSubtype) error {
+	s, err := NewScrambler(seed, subtype)
+	if err != nil {
+		return err
+	}
+	e.lsf.SetEncryption(LSFEncryptionTypeScrambler, subtype)
+	e.lsf.CalcCRC()
+	e.scrambler = s
+	e.aesKey = nil
+	e.text = nil
+	return nil
+}
+
+// SetKey enables encryption using a key from a KeyStore. Keys of 1 to 3 bytes
+// are scrambler seeds. Longer keys are used for AES with a new nonce.
+func (e *StreamEncoder) SetKey(key []byte) error {
+	if len(key) <= 3 {
+		s, err := newScramblerFromKey(key)
+		if err != nil {
+			return err
+		}
+		return e.SetScrambler(s.Seed(), s.Subtype())
+	}
+	nonce, err := NewNonce(time.Now())
+	if err != nil {
+		return err
+	}
+	return e.SetAESKey(key, nonce)
+}
+
+// SetText sends text, up to MaxMetaTextLen bytes, in the META field. Each
+// superframe carries the next block of the text, so receivers can show it
+// after 4 superframes at most. Encrypted streams use the META field for other
+// things, so they can't send text. This must be called before Start.
+func (e *StreamEncoder) SetText(text string) error {
+	if e.lsf.EncryptionType() != LSFEncryptionTypeNone {
+		return fmt.Errorf("encrypted streams can't send text")
+	}
+	blocks, err := MetaTextBlocks(text)
+	if err != nil {
+		return err
+	}
+	e.text = blocks
+	e.textIdx = 0
+	e.lsf.SetTextBlock(blocks[0])
+	e.lsf.CalcCRC()
+	return nil
+}
+
+// SetSigningKey signs the stream with a P-256 private key. The signature is
+// sent in 4 extra frames after the last one. This must be called before Start.
+func (e *StreamEncoder) SetSigningKey(key *ecdsa.PrivateKey) {
+	e.signingKey = key
+	e.digest = StreamDigest{}
+	e.lsf.SetSigned(key != nil)
+	e.lsf.CalcCRC()
+}
+
+// Start generates the preamble and LSF that begin a stream transmission.
+func (e *StreamEncoder) Start() ([]Symbol, error) {
+	syms := AppendPreamble(nil, lsfPreamble)
+	lsfSyms, err := generateLSFSymbols(e.lsf)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate LSF symbols: %w", err)
+	}
+	return append(syms, lsfSyms...), nil
+}
+
+// EncodeFrame generates a stream frame with frame number fn. The LastFrameFlag
+// bit of fn marks the last frame of the stream. The LICH counter advances with
+// each call, independent of fn. When signing, the last frame is followed by
+// the signature frames.
+func (e *StreamEncoder) EncodeFrame(fn uint16, payload [StreamPayloadLen]byte) ([]Symbol, error) {
+	if e.signingKey == nil {
+		return e.encodeFrame(fn, payload)
+	}
+	syms, err := e.encodeFrame(fn&^LastFrameFlag, payload)
+	if err != nil || fn&LastFrameFlag == 0 {
+		return syms, err
+	}
+	sig, err := SignStream(e.signingKey, e.digest)
+	if err != nil {
+		return nil, err
+	}
+	for i := range signatureFrames {
+		var p [StreamPayloadLen]byte
+		copy(p[:], sig[i*StreamPayloadLen:])
+		frame, err := e.encodeFrame(signatureFN(i), p)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode signature frame %d: %w", i, err)
+		}
+		syms = append(syms, frame...)
+	}
+	e.digest = StreamDigest{}
+	return syms, nil
+}
+
+func (e *StreamEncoder) encodeFrame(fn uint16, payload [StreamPayloadLen]byte) ([]Symbol, error) {
+	var err error
+	signature := e.signingKey != nil && isSignatureFrame(fn)
+	switch {
+	case signature:
+		// The signature is sent in the clear
+	case e.aesKey != nil:
+		payload, err = AESCryptStreamPayload(e.aesKey, e.lsf.Nonce(), fn, payload)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encrypt payload: %w", err)
+		}
+	case e.scrambler != nil:
+		payload = e.scrambler.CryptStreamPayload(fn, payload)
+	}
+	if e.signingKey != nil && !signature {
+		// The signature covers the payloads as sent
+		e.digest.Add(payload)
+	}
+	if e.lichCnt == 0 && len(e.text) > 0 {
+		// Start a new superframe with the next block of text
+		e.lsf.SetTextBlock(e.text[e.textIdx%len(e.text)])
+		e.lsf.CalcCRC()
+		e.textIdx++
+	}
+	syms, err := generateStreamSymbols(e.lsf, e.lichCnt, fn, payload)
+	if err != nil {
+		return nil, err
+	}
+	e.lichCnt = (e.lichCnt + 1) % lichChunks
+	e.fn = (fn + 1) & frameNumberMask
+	return syms, nil
+}
+
+// NextFrame generates the stream frame following the previous one.
+func (e *StreamEncoder) NextFrame(payload [StreamPayloadLen]byte, last bool) ([]Symbol, error) {
+	fn := e.fn
+	if last {
+		fn |= LastFrameFlag
+	}
+	return e.EncodeFrame(fn, payload)
+}
+
+// End generates the EOT marker that ends a transmission.
+func (e *StreamEncoder) End() []Symbol {
+	return AppendEOT(nil)
+}
+
+// Encode generates a complete stream transmission carrying payloads.
+func (e *StreamEncoder) Encode(payloads [][StreamPayloadLen]byte) ([]Symbol, error) {
+	if len(payloads) == 0 {
+		return nil, fmt.Errorf("stream must have at least one frame")
+	}
+	out, err := e.Start()
+	if err != nil {
+		return nil, err
+	}
+	for i, p := range payloads {
+		syms, err := e.NextFrame(p, i == len(payloads)-1)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode frame %d: %w", i, err)
+		}
+		out = append(out, syms...)
+	}
+	return append(out, e.End()...), nil
+}
+
+// newTXStreamEncoder creates a StreamEncoder for transmitting lsf. If keys
+// holds a key for an unencrypted stream, the stream is encrypted with it.
+// Signed streams are sent unchanged, since encrypting them would invalidate
+// the signature.
+func newTXStreamEncoder(lsf LSF, keys *KeyStore) (*StreamEncoder, error) {
+	e := NewStreamEncoder(lsf)
+	if keys == nil || lsf.EncryptionType() != LSFEncryptionTypeNone || lsf.Signed() {
+		return e, nil
+	}
+	key := keys.Key(&lsf)
+	if key == nil {
+		return e, nil
+	}
+	err := e.SetKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set stream key: %w", err)
+	}
+	return e, nil
+}
+
+func generateLSFSymbols(l LSF) ([]Symbol, error) {
+	syms := AppendSyncword(nil, LSFSync)
+
+	b, err := ConvolutionalEncode(l.ToBytes(), LSFPuncturePattern, LSFFinalBit)
+	if err != nil {
+		return nil, fmt.Errorf("unable to encode LSF: %w", err)
+	}
+	encodedBits := NewBits(b)
+	rfBits := InterleaveBits(encodedBits)
+	rfBits = RandomizeBits(rfBits)
+	// Append LSF to the output
+	syms = AppendBits(syms, rfBits)
+	return syms, nil
+}
+
+func generateStreamSymbols(lsf LSF, lichCnt int, fn uint16, payload [StreamPayloadLen]byte) ([]Symbol, error) {
+	syms := AppendSyncword(nil, StreamSync)
+	lich := extractLICH(lichCnt, lsf)
+	encodedLICH := EncodeLICH(lich)
+	lichBits := unpackBits(encodedLICH)
+	b, err := ConvolutionalEncodeStream(lichBits, fn, payload)
+	if err != nil {
+		return syms, fmt.Errorf("encode stream: %w", err)
+	}
+	encodedBits := NewBits(b)
+	rfBits := InterleaveBits(encodedBits)
+	rfBits = RandomizeBits(rfBits)
+	syms = AppendBits(syms, rfBits)
+	return syms, nil
+}
+
+func extractLICH(lichCnt int, lsf LSF) []byte {
+	lich := lsf.ToBytes()[lichCnt*5 : lichCnt*5+5]
+	return append(lich, byte(lichCnt)<<5)
+}
+
+func unpackBits(in []byte) []Bit {
+	bits := make([]Bit, 8*len(in))
+	for i := range in {
+		for j := range 8 {
+			bits[i*8+j].Set((in[i] >> (7 - j)) & 1)
+		}
+	}
+
+	return bits
+}
@@ -0,0 +1,224 @@
+package m17
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"reflect"
+	"testing"
+
+	"github.com/icza/gog"
+)
+
+// symbolReader returns a DummyModem input containing syms followed by enough
+// silence for the Decoder to process all of them
+func symbolReader(t *testing.T, syms []Symbol) io.ReadCloser {
+	var buf bytes.Buffer
+	err := binary.Write(&buf, binary.LittleEndian, syms)
+	if err != nil {
+		t.Fatalf("failed to write symbols: %v", err)
+	}
+	buf.Write(make([]byte, 4*symbolBufSize))
+	return io.NopCloser(&buf)
+}
+
+// testStreamLSF returns the LSF of a voice stream from N0CALL to N1ADJ
+func testStreamLSF(tb testing.TB) LSF {
+	tb.Helper()
+	lsf, err := NewLSF("N1ADJ", "N0CALL", LSFTypeStream, LSFDataTypeVoice, LSFEncryptionTypeNone, 0, 0)
+	if err != nil {
+		tb.Fatalf("NewLSF() error = %v", err)
+	}
+	return lsf
+}
+
+func testPayloads(n int) [][StreamPayloadLen]byte {
+	payloads := make([][StreamPayloadLen]byte, n)
+	for i := range payloads {
+		for j := range payloads[i] {
+			payloads[i][j] = byte(i*StreamPayloadLen + j)
+		}
+	}
+	return payloads
+}
+
+func TestStreamEncoder_Encode(t *testing.T) {
+	tests := []struct {
+		name    string
+		frames  int
+		wantErr bool
+	}{
+		{"empty", 0, true},
+		{"one frame", 1, false},
+		{"full superframe", 6, false},
+		{"two seconds", 50, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lsf := testStreamLSF(t)
+			e := NewStreamEncoder(lsf)
+			payloads := testPayloads(tt.frames)
+			got, err := e.Encode(payloads)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("StreamEncoder.Encode() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			// preamble, LSF, frames, EOT
+			if len(got) != (tt.frames+3)*SymbolsPerFrame {
+				t.Fatalf("StreamEncoder.Encode() len = %d, want %d", len(got), (tt.frames+3)*SymbolsPerFrame)
+			}
+			if !reflect.DeepEqual(got[SymbolsPerFrame:SymbolsPerFrame+SymbolsPerSyncword], AppendSyncword(nil, LSFSync)) {
+				t.Errorf("StreamEncoder.Encode() missing LSF syncword")
+			}
+			if !reflect.DeepEqual(got[len(got)-SymbolsPerFrame:], AppendEOT(nil)) {
+				t.Errorf("StreamEncoder.Encode() missing EOT")
+			}
+			d := NewDecoder(nil)
+			encLSF := e.LSF()
+			lsfBytes := encLSF.ToBytes()
+			for i := range tt.frames {
+				frame := got[(i+2)*SymbolsPerFrame : (i+3)*SymbolsPerFrame]
+				if !reflect.DeepEqual(frame[:SymbolsPerSyncword], AppendSyncword(nil, StreamSync)) {
+					t.Errorf("frame %d missing stream syncword", i)
+				}
+				data, lich, fn, lichCnt, _ := d.decodeStreamFrame(frame[SymbolsPerSyncword:])
+				wantFN := uint16(i)
+				if i == tt.frames-1 {
+					wantFN |= LastFrameFlag
+				}
+				if fn != wantFN {
+					t.Errorf("frame %d fn = %04x, want %04x", i, fn, wantFN)
+				}
+				if int(lichCnt) != i%6 {
+					t.Errorf("frame %d lichCnt = %d, want %d", i, lichCnt, i%6)
+				}
+				if !bytes.Equal(lich[:5], lsfBytes[lichCnt*5:lichCnt*5+5]) {
+					t.Errorf("frame %d lich = % x, want % x", i, lich[:5], lsfBytes[lichCnt*5:lichCnt*5+5])
+				}
+				if !bytes.Equal(data, payloads[i][:]) {
+					t.Errorf("frame %d payload = % x, want % x", i, data, payloads[i])
+				}
+			}
+		})
+	}
+}
+
+func TestStreamEncoder_FrameNumberWrap(t *testing.T) {
+	lsf := testStreamLSF(t)
+	e := NewStreamEncoder(lsf)
+	d := NewDecoder(nil)
+	var payload [StreamPayloadLen]byte
+	for _, want := range []uint16{0x7FFE, 0x7FFF, 0x0000, 0x0001 | LastFrameFlag} {
+		var syms []Symbol
+		var err error
+		if want == 0x7FFE {
+			syms, err = e.EncodeFrame(want, payload)
+		} else {
+			syms, err = e.NextFrame(payload, want&LastFrameFlag != 0)
+		}
+		if err != nil {
+			t.Fatalf("StreamEncoder frame %04x error = %v", want, err)
+		}
+		_, _, fn, _, _ := d.decodeStreamFrame(syms[SymbolsPerSyncword:])
+		if fn != want {
+			t.Errorf("fn = %04x, want %04x", fn, want)
+		}
+	}
+}
+
+func TestStreamEncoder_Decoder(t *testing.T) {
+	lsf := testStreamLSF(t)
+	payloads := testPayloads(12)
+	syms, err := NewStreamEncoder(lsf).Encode(payloads)
+	if err != nil {
+		t.Fatalf("StreamEncoder.Encode() error = %v", err)
+	}
+	var got [][]byte
+	var fns []uint16
+	d := NewDecoder(nil)
+	d.DecodeSymbols(&DummyModem{In: symbolReader(t, syms)}, func(e Event) {
+		f, ok := e.(StreamFrameEvent)
+		if !ok {
+			return
+		}
+		if f.LSF.Src.Callsign() != "N0CALL" || f.LSF.Dst.Callsign() != "N1ADJ" {
+			t.Errorf("decoded LSF %v", f.LSF)
+		}
+		got = append(got, bytes.Clone(f.Payload))
+		fns = append(fns, f.FrameNumber)
+	})
+	if len(got) != len(payloads) {
+		t.Fatalf("decoded %d frames, want %d", len(got), len(payloads))
+	}
+	for i := range got {
+		if !bytes.Equal(got[i], payloads[i][:]) {
+			t.Errorf("frame %d payload = % x, want % x", i, got[i], payloads[i])
+		}
+		if fns[i]&frameNumberMask != uint16(i) {
+			t.Errorf("frame %d fn = %04x", i, fns[i])
+		}
+	}
+}
+
+func TestStreamEncoder_Text(t *testing.T) {
+	const text = "Portland, Maine - mobile on I-295"
+	lsf := gog.Must(NewLSF("@ALL", "N0CALL", LSFTypeStream, LSFDataTypeVoice, LSFEncryptionTypeNone, 0, 0))
+	e := NewStreamEncoder(lsf)
+	err := e.SetText(text)
+	if err != nil {
+		t.Fatalf("StreamEncoder.SetText() error = %v", err)
+	}
+	// Three blocks take three superframes, then they repeat
+	syms, err := e.Encode(testPayloads(6 * 5))
+	if err != nil {
+		t.Fatalf("StreamEncoder.Encode() error = %v", err)
+	}
+	tests := []struct {
+		name string
+		skip int
+	}{
+		{"from start", 0},
+		// Joining late, the LSF is rebuilt from LICH chunks
+		{"late entry", 4 * SymbolsPerFrame},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			frames := 0
+			d := NewDecoder(nil)
+			d.DecodeSymbols(&DummyModem{In: symbolReader(t, syms[tt.skip:])}, func(e Event) {
+				switch e := e.(type) {
+				case StreamFrameEvent:
+					frames++
+				case TextEvent:
+					got = append(got, e.Text)
+				}
+			})
+			if frames == 0 {
+				t.Errorf("no frames decoded")
+			}
+			if len(got) != 1 || got[0] != text {
+				t.Errorf("TextEvents got %q, want [%q]", got, text)
+			}
+		})
+	}
+
+	enc := NewStreamEncoder(lsf)
+	enc.SetAESKey(make([]byte, 16), testNonce)
+	if enc.SetText(text) == nil {
+		t.Errorf("StreamEncoder.SetText() accepted encrypted stream")
+	}
+}
+
+func BenchmarkDecoder_StreamFrame(b *testing.B) {
+	lsf := testStreamLSF(b)
+	syms := gog.Must(NewStreamEncoder(lsf).EncodeFrame(1, testPayloads(1)[0]))
+	pld := syms[SymbolsPerSyncword:]
+	d := NewDecoder(nil)
+	b.ReportAllocs()
+	for b.Loop() {
+		d.decodeStreamFrame(pld)
+	}
+}
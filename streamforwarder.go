@@ -0,0 +1,164 @@
+package m17
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// DefaultStreamTimeout is how long a StreamForwarder waits for the next frame
+// before ending a stream.
+const DefaultStreamTimeout = 500 * time.Millisecond
+
+// A frame number this far ahead of the last one is taken to be behind it, so
+// the stream restarted
+const maxFrameGap = 0x4000
+
+// Codec2 3200 bps encoding of 20 ms of silence
+var codec2Silence = []byte{0x01, 0x00, 0x09, 0x43, 0x9C, 0xE4, 0x21, 0x08}
+
+// StreamForwarder sends streams received over RF to the network, making sure
+// each one ends with a frame carrying the LastFrameFlag. Radios often don't
+// set it, so when a stream ends by EOT, lost sync, a timeout, a restart or a
+// new stream, a final frame is sent in its place. The signature frames of a
+// signed stream are forwarded as part of it. It is safe for concurrent use.
+type StreamForwarder struct {
+	// Timeout ends a stream if no frame arrives for this long
+	Timeout time.Duration
+
+	send func(lsf LSF, sid uint16, fn uint16, payload []byte) error
+
+	mu        sync.Mutex
+	active    bool
+	lsf       LSF
+	sid       uint16
+	fn        uint16
+	lastFrame time.Time
+	timer     *time.Timer
+	// set once the signature frames of a signed stream have started
+	signature bool
+}
+
+// NewStreamForwarder creates a StreamForwarder that sends frames with send,
+// usually Relay.SendStream.
+func NewStreamForwarder(send func(lsf LSF, sid uint16, fn uint16, payload []byte) error) *StreamForwarder {
+	return &StreamForwarder{
+		Timeout: DefaultStreamTimeout,
+		send:    send,
+	}
+}
+
+// HandleEvent handles a Decoder event, forwarding stream frames and ending
+// streams. Other events are ignored.
+func (f *StreamForwarder) HandleEvent(e Event) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch e := e.(type) {
+	case LSFEvent:
+		if e.CRCValid && e.StreamID != 0 && f.active {
+			log.Printf("[DEBUG] Stream %x replaced by %x before last frame", f.sid, e.StreamID)
+			return f.end()
+		}
+	case StreamFrameEvent:
+		return f.frame(e)
+	case StreamEndEvent, EOTEvent:
+		return f.end()
+	case SyncLostEvent:
+		if e.SyncType == StreamSync {
+			return f.end()
+		}
+	}
+	return nil
+}
+
+// Close ends the active stream, if any.
+func (f *StreamForwarder) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.end()
+}
+
+func (f *StreamForwarder) frame(e StreamFrameEvent) error {
+	fn := e.FrameNumber & frameNumberMask
+	if f.active {
+		switch gap := (fn - f.fn) & frameNumberMask; {
+		case e.StreamID != f.sid:
+			log.Printf("[DEBUG] Stream %x replaced by %x before last frame", f.sid, e.StreamID)
+			if err := f.end(); err != nil {
+				return err
+			}
+		case gap == 0 && e.FrameNumber&LastFrameFlag == 0:
+			// Already sent
+			return nil
+		case e.Signature:
+			// The signature frames' numbers jump ahead of the payload frames
+			// they follow
+		case gap > maxFrameGap:
+			log.Printf("[DEBUG] Stream %x restarted at fn %04x after %04x", f.sid, fn, f.fn)
+			if err := f.end(); err != nil {
+				return err
+			}
+		case gap > 1:
+			log.Printf("[DEBUG] Stream %x missed %d frames", f.sid, gap-1)
+		}
+	}
+	err := f.send(*e.LSF, e.StreamID, e.FrameNumber, e.Payload)
+	if e.FrameNumber&LastFrameFlag != 0 {
+		f.stop()
+		return err
+	}
+	f.active = true
+	f.lsf = *e.LSF
+	f.sid = e.StreamID
+	f.fn = fn
+	f.signature = e.Signature
+	f.lastFrame = time.Now()
+	if f.timer == nil {
+		f.timer = time.AfterFunc(f.Timeout, f.timeout)
+	} else {
+		f.timer.Reset(f.Timeout)
+	}
+	return err
+}
+
+// End the active stream, sending a last frame in place of the one that wasn't
+// received
+func (f *StreamForwarder) end() error {
+	if !f.active {
+		return nil
+	}
+	f.stop()
+	fn := (f.fn+1)&frameNumberMask | LastFrameFlag
+	payload := make([]byte, StreamPayloadLen)
+	switch {
+	case f.signature:
+		// Part of the signature was lost, so end with its last frame
+		fn = signatureFN(signatureFrames - 1)
+	case f.lsf.DataType() == LSFDataTypeVoice:
+		copy(payload, codec2Silence)
+		copy(payload[len(codec2Silence):], codec2Silence)
+	}
+	log.Printf("[DEBUG] Ending stream %x with fn %04x", f.sid, fn)
+	return f.send(f.lsf, f.sid, fn, payload)
+}
+
+func (f *StreamForwarder) stop() {
+	f.active = false
+	if f.timer != nil {
+		f.timer.Stop()
+	}
+}
+
+func (f *StreamForwarder) timeout() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	// The timer may have fired just as a frame arrived
+	if !f.active || time.Since(f.lastFrame) < f.Timeout {
+		return
+	}
+	log.Printf("[DEBUG] Stream %x timed out", f.sid)
+	err := f.end()
+	if err != nil {
+		log.Printf("[ERROR] Error ending stream %x: %v", f.sid, err)
+	}
+}
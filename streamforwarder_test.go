@@ -0,0 +1,179 @@
+package m17
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/icza/gog"
+)
+
+type sentFrames struct {
+	mu       sync.Mutex
+	frames   []string
+	fns      []uint16
+	payloads [][]byte
+	lsf      LSF
+}
+
+func (s *sentFrames) send(lsf LSF, sid uint16, fn uint16, payload []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.frames = append(s.frames, fmt.Sprintf("%x:%04x", sid, fn))
+	s.fns = append(s.fns, fn)
+	// The Decoder reuses its payload buffer
+	s.payloads = append(s.payloads, bytes.Clone(payload))
+	s.lsf = lsf
+	return nil
+}
+
+func (s *sentFrames) get() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.frames
+}
+
+func TestStreamForwarder(t *testing.T) {
+	lsf := testStreamLSF(t)
+	frame := func(sid, fn uint16) Event {
+		return StreamFrameEvent{LSF: &lsf, StreamID: sid, FrameNumber: fn, Payload: make([]byte, StreamPayloadLen)}
+	}
+	signed := testStreamLSF(t)
+	signed.SetSigned(true)
+	signedFrame := func(fn uint16) Event {
+		return StreamFrameEvent{LSF: &signed, StreamID: 1, FrameNumber: fn, Payload: make([]byte, StreamPayloadLen), Signature: isSignatureFrame(fn)}
+	}
+	tests := []struct {
+		name   string
+		events []Event
+		want   []string
+	}{
+		{"last frame received", []Event{frame(1, 0), frame(1, 1), frame(1, 0x8002), StreamEndEvent{}, EOTEvent{}}, []string{"1:0000", "1:0001", "1:8002"}},
+		{"EOT", []Event{frame(1, 0), frame(1, 1), StreamEndEvent{}, EOTEvent{SyncType: StreamSync}}, []string{"1:0000", "1:0001", "1:8002"}},
+		{"sync lost", []Event{frame(1, 0), frame(1, 1), SyncLostEvent{SyncType: StreamSync}}, []string{"1:0000", "1:0001", "1:8002"}},
+		{"missed frames", []Event{frame(1, 0), frame(1, 3), EOTEvent{}}, []string{"1:0000", "1:0003", "1:8004"}},
+		{"frame number wraparound", []Event{frame(1, 0x7FFE), frame(1, 0x7FFF), frame(1, 0), EOTEvent{}}, []string{"1:7ffe", "1:7fff", "1:0000", "1:8001"}},
+		{"ends at wraparound", []Event{frame(1, 0x7FFF), EOTEvent{}}, []string{"1:7fff", "1:8000"}},
+		{"restarted", []Event{frame(1, 5), frame(1, 6), frame(1, 0), EOTEvent{}}, []string{"1:0005", "1:0006", "1:8007", "1:0000", "1:8001"}},
+		{"new LSF", []Event{frame(1, 0), frame(1, 1), LSFEvent{LSF: &lsf, CRCValid: true, StreamID: 2}, frame(2, 0), EOTEvent{}}, []string{"1:0000", "1:0001", "1:8002", "2:0000", "2:8001"}},
+		{"new stream ID", []Event{frame(1, 0), frame(1, 1), frame(2, 0), frame(2, 1), EOTEvent{}}, []string{"1:0000", "1:0001", "1:8002", "2:0000", "2:0001", "2:8002"}},
+		{"signed", []Event{signedFrame(0), signedFrame(1), signedFrame(0x7FFC), signedFrame(0x7FFD), signedFrame(0x7FFE), signedFrame(0xFFFF), EOTEvent{}}, []string{"1:0000", "1:0001", "1:7ffc", "1:7ffd", "1:7ffe", "1:ffff"}},
+		{"signature lost", []Event{signedFrame(0), signedFrame(0x7FFC), EOTEvent{}}, []string{"1:0000", "1:7ffc", "1:ffff"}},
+		{"signature missing", []Event{signedFrame(0), signedFrame(1), EOTEvent{}}, []string{"1:0000", "1:0001", "1:8002"}},
+		{"duplicate frame", []Event{frame(1, 0), frame(1, 0), EOTEvent{}}, []string{"1:0000", "1:8001"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var s sentFrames
+			f := NewStreamForwarder(s.send)
+			for _, e := range tt.events {
+				if err := f.HandleEvent(e); err != nil {
+					t.Fatalf("StreamForwarder.HandleEvent() error = %v", err)
+				}
+			}
+			f.Close()
+			if got := s.get(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("sent %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStreamForwarder_Timeout(t *testing.T) {
+	lsf := testStreamLSF(t)
+	var s sentFrames
+	f := NewStreamForwarder(s.send)
+	f.Timeout = 10 * time.Millisecond
+	f.HandleEvent(StreamFrameEvent{LSF: &lsf, StreamID: 1, FrameNumber: 0, Payload: make([]byte, StreamPayloadLen)})
+	deadline := time.Now().Add(time.Second)
+	for len(s.get()) < 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	want := []string{"1:0000", "1:8001"}
+	if got := s.get(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("sent %v, want %v", got, want)
+	}
+	// The last frame is silence
+	if !bytes.Equal(s.payloads[1][:8], codec2Silence) || !bytes.Equal(s.payloads[1][8:], codec2Silence) {
+		t.Errorf("last frame payload = % x", s.payloads[1])
+	}
+	f.Close()
+	if got := s.get(); len(got) != 2 {
+		t.Errorf("sent %v after Close()", got)
+	}
+}
+
+func TestDecoder_StreamForwarder(t *testing.T) {
+	// A stream without the last frame flag, then another right after it
+	lsf := testStreamLSF(t)
+	e := NewStreamEncoder(lsf)
+	syms := gog.Must(e.Start())
+	for _, p := range testPayloads(3) {
+		syms = append(syms, gog.Must(e.NextFrame(p, false))...)
+	}
+	syms = append(syms, e.End()...)
+	syms = append(syms, gog.Must(NewStreamEncoder(lsf).Encode(testPayloads(2)))...)
+	var s sentFrames
+	f := NewStreamForwarder(s.send)
+	var sids []uint16
+	NewDecoder(nil).DecodeSymbols(&DummyModem{In: symbolReader(t, syms)}, func(e Event) {
+		if e, ok := e.(LSFEvent); ok {
+			sids = append(sids, e.StreamID)
+		}
+		if err := f.HandleEvent(e); err != nil {
+			t.Errorf("StreamForwarder.HandleEvent() error = %v", err)
+		}
+	})
+	if len(sids) != 2 || sids[0] == sids[1] {
+		t.Fatalf("stream IDs %04x, want two different ones", sids)
+	}
+	want := []string{
+		fmt.Sprintf("%x:0000", sids[0]), fmt.Sprintf("%x:0001", sids[0]), fmt.Sprintf("%x:0002", sids[0]), fmt.Sprintf("%x:8003", sids[0]),
+		fmt.Sprintf("%x:0000", sids[1]), fmt.Sprintf("%x:8001", sids[1]),
+	}
+	if got := s.get(); !reflect.DeepEqual(got, want) {
+		t.Errorf("sent %v, want %v", got, want)
+	}
+}
+
+func TestDecoder_StreamForwarder_Signed(t *testing.T) {
+	key := gog.Must(ecdsa.GenerateKey(elliptic.P256(), rand.Reader))
+	lsf := testStreamLSF(t)
+	syms := encodeSignedStream(t, lsf, key, testPayloads(3))
+	var s sentFrames
+	f := NewStreamForwarder(s.send)
+	var sid uint16
+	NewDecoder(nil).DecodeSymbols(&DummyModem{In: symbolReader(t, syms)}, func(e Event) {
+		if e, ok := e.(LSFEvent); ok {
+			sid = e.StreamID
+		}
+		if err := f.HandleEvent(e); err != nil {
+			t.Errorf("StreamForwarder.HandleEvent() error = %v", err)
+		}
+	})
+	var want []string
+	for _, fn := range []uint16{0, 1, 2, 0x7FFC, 0x7FFD, 0x7FFE, 0xFFFF} {
+		want = append(want, fmt.Sprintf("%x:%04x", sid, fn))
+	}
+	if got := s.get(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("sent %v, want %v", got, want)
+	}
+	// A receiver on the network can check the signature
+	var r signatureReceiver
+	for i, fn := range s.fns {
+		r.addFrame(fn, s.payloads[i])
+	}
+	signers := NewSignerRegistry()
+	if err := signers.Add(lsf.Originator(), &key.PublicKey); err != nil {
+		t.Fatalf("SignerRegistry.Add() error = %v", err)
+	}
+	if got := r.verify(&s.lsf, signers); got.Status != SignatureValid {
+		t.Errorf("forwarded stream signature %v, want %v", got, SignatureValid)
+	}
+}
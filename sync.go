@@ -0,0 +1,195 @@
+package m17
+
+import "math"
+
+// SyncThresholds are the minimum normalized correlations, from 0 to 1, at
+// which each kind of syncword is detected. Raising them means fewer false
+// alarms on noise but more missed frames from weak signals.
+type SyncThresholds struct {
+	// LSF preamble and syncword, which start a transmission
+	LSF float32
+	// Stream, packet and BERT syncwords, confirmed by the syncword or EOT
+	// marker that follows the frame also matching this well
+	Frame float32
+	// Stream, packet and BERT syncwords on their own, as before a lost frame
+	// or a missed EOT marker. They're only accepted once the decoder is synced
+	// to their kind of frame.
+	LoneFrame float32
+	// EOT marker
+	EOT float32
+}
+
+// DefaultSyncThresholds are used for any SyncThresholds left at zero.
+var DefaultSyncThresholds = SyncThresholds{LSF: 0.9, Frame: 0.92, LoneFrame: 0.97, EOT: 0.9}
+
+func (t SyncThresholds) withDefaults() SyncThresholds {
+	if t.LSF == 0 {
+		t.LSF = DefaultSyncThresholds.LSF
+	}
+	if t.Frame == 0 {
+		t.Frame = DefaultSyncThresholds.Frame
+	}
+	if t.LoneFrame == 0 {
+		t.LoneFrame = DefaultSyncThresholds.LoneFrame
+	}
+	if t.EOT == 0 {
+		t.EOT = DefaultSyncThresholds.EOT
+	}
+	return t
+}
+
+const (
+	// Symbols compared when looking for sync: the syncword, preceded by
+	// the LSF preamble or the end of the previous frame
+	syncWindow = 2 * SymbolsPerSyncword
+	// Weight of each frame's syncword in the symbol level estimate
+	levelAlpha = 0.5
+	// and in the offset estimate, which is noisier but changes more slowly
+	offsetAlpha = 0.1
+	// Standard errors the offset estimate must be from zero before the
+	// samples are corrected for it
+	offsetSignificance = 4
+)
+
+// Two EOT patterns, to match a whole sync window
+var eotPattern = func() []float64 {
+	p := make([]float64, syncWindow)
+	for i := range p {
+		p[i] = float64(EOTSymbols[i%len(EOTSymbols)])
+	}
+	return p
+}()
+
+// syncMatch describes how well recent samples match a sync pattern.
+type syncMatch struct {
+	typ uint16
+	// normalized correlation
+	corr float32
+	// symbol level relative to nominal, so 1 when the outer symbols are ±3
+	level float32
+	// offset of the samples in symbol units, from a carrier frequency offset
+	offset float32
+	// normalized correlation of the syncword of the next frame, or the EOT
+	// marker after the last one
+	next float32
+}
+
+// How well m places a frame, to choose among neighbouring samples. Two
+// syncwords place it better than one, so a frame confirmed by what follows it
+// is placed by the lower of the two correlations.
+func (m syncMatch) placement(confirmed bool) float32 {
+	if confirmed {
+		return min(m.corr, m.next)
+	}
+	return m.corr
+}
+
+// Match the samples x against pattern p, fitting x to level*p + offset by
+// least squares. If centered is set, the correlation is of the deviations
+// from the means, so an unknown carrier frequency offset doesn't hide a
+// match. That leaves a short syncword one fewer sample to tell a match from
+// noise, so otherwise it's taken about zero.
+func matchPattern(typ uint16, x, p []float64, centered bool) syncMatch {
+	var sx, sp, xx, pp, xp float64
+	for i := range x {
+		sx += x[i]
+		sp += p[i]
+		xx += x[i] * x[i]
+		pp += p[i] * p[i]
+		xp += x[i] * p[i]
+	}
+	n := float64(len(x))
+	cxx := xx - sx*sx/n
+	cpp := pp - sp*sp/n
+	cxp := xp - sx*sp/n
+	if cxx <= 0 || cpp <= 0 {
+		return syncMatch{typ: typ}
+	}
+	level := cxp / cpp
+	m := syncMatch{
+		typ:    typ,
+		corr:   float32(xp / math.Sqrt(xx*pp)),
+		level:  float32(level),
+		offset: float32((sx - level*sp) / n),
+	}
+	if centered {
+		m.corr = float32(cxp / math.Sqrt(cxx*cpp))
+	}
+	return m
+}
+
+// Match the syncword of a frame against x, and the syncword of the next frame,
+// or the EOT marker after the last one, against next.
+func matchFrame(typ uint16, x, next, p, eot []float64, centered bool) syncMatch {
+	m := matchPattern(typ, x, p, centered)
+	m.next = max(matchPattern(typ, next, p, centered).corr, matchPattern(typ, next, eot, false).corr)
+	return m
+}
+
+// Correlate recent samples with the sync patterns, returning the best match.
+// Packet, stream and BERT matches also report how well the syncword of the
+// following frame, or the EOT marker after the last one, matches.
+//
+// The samples are taken to be offset by dc. An LSF starts a transmission, so
+// its offset is always fitted, but once the decoder is tracking the offset of
+// a transmission, frame syncwords are matched about it. The EOT marker is
+// nearly all one symbol, so it's never centered.
+func syncCorrelation(symbols []Symbol, offset int, dc float32, tracking bool) syncMatch {
+	var x, next [syncWindow]float64
+	for i := range syncWindow {
+		x[i] = float64(symbols[offset+i*5] - Symbol(dc))
+		next[i] = float64(symbols[offset+(SymbolsPerFrame+i)*5] - Symbol(dc))
+	}
+	h := SymbolsPerSyncword
+	best := matchPattern(LSFSync, x[:], ExtLSFSyncSymbols, true)
+	for _, m := range []syncMatch{
+		matchFrame(PacketSync, x[:h], next[:h], PacketSyncSymbols, eotPattern[:h], !tracking),
+		matchFrame(BERTSync, x[h:], next[h:], BERTSyncSymbols, eotPattern[h:], !tracking),
+		matchPattern(EOTMarker, x[:], eotPattern, false),
+		matchFrame(StreamSync, x[h:], next[h:], StreamSyncSymbols, eotPattern[h:], !tracking),
+	} {
+		if m.corr > best.corr {
+			best = m
+		}
+	}
+	best.offset += dc
+	return best
+}
+
+// nextSyncword reports whether a packet or a stream syncword best matches the
+// samples starting within n samples of the start of symbols.
+func nextSyncword(symbols []Symbol, n int) uint16 {
+	var best syncMatch
+	x := make([]float64, SymbolsPerSyncword)
+	for offset := range n {
+		for i := range x {
+			x[i] = float64(symbols[offset+i*5])
+		}
+		for _, m := range []syncMatch{
+			matchPattern(PacketSync, x, PacketSyncSymbols, true),
+			matchPattern(StreamSync, x, StreamSyncSymbols, true),
+		} {
+			if m.corr > best.corr {
+				best = m
+			}
+		}
+	}
+	if best.typ == 0 {
+		return PacketSync
+	}
+	return best.typ
+}
+
+// bestSync returns the match at the start of symbols, unless a different kind
+// of sync matches better within the next symbol, so that a partial match just
+// before a syncword isn't taken for another kind. dc and tracking are as for
+// syncCorrelation.
+func bestSync(symbols []Symbol, dc float32, tracking bool) syncMatch {
+	m := syncCorrelation(symbols, 0, dc, tracking)
+	for i := range decoderSamplesPerSymbol - 1 {
+		if c := syncCorrelation(symbols, i+1, dc, tracking); c.typ != m.typ && c.corr > m.corr {
+			return syncMatch{}
+		}
+	}
+	return m
+}
@@ -0,0 +1,282 @@
+package m17
+
+import (
+	"encoding/binary"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/icza/gog"
+)
+
+// readCapture reads a file of little endian float32 symbols from the gateway's
+// test data
+func readCapture(t *testing.T, name string) []Symbol {
+	b, err := os.ReadFile(filepath.Join("cmd", "m17-gateway", "testdata", name))
+	if err != nil {
+		t.Fatalf("failed to read capture: %v", err)
+	}
+	syms := make([]Symbol, len(b)/4)
+	for i := range syms {
+		syms[i] = Symbol(math.Float32frombits(binary.LittleEndian.Uint32(b[4*i:])))
+	}
+	return syms
+}
+
+// distort scales syms by gain and adds Gaussian noise with standard deviation
+// sigma
+func distort(syms []Symbol, gain, sigma float64, rnd *rand.Rand) []Symbol {
+	out := make([]Symbol, len(syms))
+	for i, s := range syms {
+		out[i] = Symbol(gain*float64(s) + sigma*rnd.NormFloat64())
+	}
+	return out
+}
+
+func TestSyncCorrelation(t *testing.T) {
+	lsf := testStreamLSF(t)
+	syms := gog.Must(NewStreamEncoder(lsf).Encode(testPayloads(2)))
+	// The LSF syncword follows the preamble
+	start := SymbolsPerFrame - SymbolsPerSyncword
+	for _, gain := range []float64{0.3, 0.5, 1, 1.5, 2} {
+		samples := make([]Symbol, 0, 5*len(syms))
+		for _, s := range syms[start:] {
+			for range 5 {
+				samples = append(samples, Symbol(gain)*s)
+			}
+		}
+		m := syncCorrelation(samples, 0, 0, false)
+		if m.typ != LSFSync || m.corr < 0.999 || math.Abs(float64(m.level)-gain) > 0.001 {
+			t.Errorf("gain %.1f: syncCorrelation() = %+v, want LSFSync with level %.1f", gain, m, gain)
+		}
+	}
+}
+
+func TestSyncCorrelation_Offset(t *testing.T) {
+	lsf := testStreamLSF(t)
+	syms := gog.Must(NewStreamEncoder(lsf).Encode(testPayloads(2)))
+	start := SymbolsPerFrame - SymbolsPerSyncword
+	for _, offset := range []float64{-3, -1, 0.5, 2} {
+		samples := make([]Symbol, 0, 5*len(syms))
+		for _, s := range syms[start:] {
+			for range 5 {
+				samples = append(samples, 0.8*s+Symbol(offset))
+			}
+		}
+		m := syncCorrelation(samples, 0, 0, false)
+		if m.typ != LSFSync || m.corr < 0.999 || math.Abs(float64(m.level)-0.8) > 0.001 || math.Abs(float64(m.offset)-offset) > 0.001 {
+			t.Errorf("offset %.1f: syncCorrelation() = %+v, want LSFSync with level 0.8", offset, m)
+		}
+	}
+}
+
+// offsetSymbols adds an offset to syms that moves from start to end
+func offsetSymbols(syms []Symbol, start, end float64) []Symbol {
+	out := make([]Symbol, len(syms))
+	for i, s := range syms {
+		out[i] = s + Symbol(start+(end-start)*float64(i)/float64(len(syms)))
+	}
+	return out
+}
+
+func TestDecoder_FrequencyOffset(t *testing.T) {
+	lsf := testStreamLSF(t)
+	syms := gog.Must(NewStreamEncoder(lsf).Encode(testPayloads(50)))
+	tests := []struct {
+		name string
+		gain float64
+		// offset in symbol units at the start and end of the stream
+		start, end float64
+	}{
+		{"none", 1, 0, 0},
+		{"1.2 kHz high", 1, 1.5, 1.5},
+		{"2 kHz low, under-deviated", 0.6, -2.5, -2.5},
+		{"drifting 400 Hz", 0.8, -0.25, 0.25},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rnd := rand.New(rand.NewSource(1))
+			in := offsetSymbols(distort(syms, tt.gain, 0.2, rnd), tt.start, tt.end)
+			frames := 0
+			var last Quality
+			NewDecoder(nil).DecodeSymbols(&DummyModem{In: symbolReader(t, in)}, func(e Event) {
+				switch e := e.(type) {
+				case LSFEvent:
+					if math.Abs(float64(e.FrequencyOffset)-tt.start*symbolDeviation) > 50 {
+						t.Errorf("LSF frequency offset %.0f Hz, want %.0f", e.FrequencyOffset, tt.start*symbolDeviation)
+					}
+				case StreamFrameEvent:
+					frames++
+					last = e.Quality
+				}
+			})
+			if frames != 50 {
+				t.Errorf("decoded %d of 50 frames", frames)
+			}
+			// The estimate lags a drifting offset a little
+			if math.Abs(float64(last.FrequencyOffset)-tt.end*symbolDeviation) > 100 {
+				t.Errorf("last frame frequency offset %.0f Hz, want %.0f", last.FrequencyOffset, tt.end*symbolDeviation)
+			}
+			if math.Abs(float64(last.Deviation())-tt.gain*2400) > 100 {
+				t.Errorf("last frame deviation %.0f Hz, want %.0f", last.Deviation(), tt.gain*2400)
+			}
+		})
+	}
+}
+
+func TestDecoder_Correction(t *testing.T) {
+	tests := []struct {
+		offset, offsetError float32
+		want                float32
+	}{
+		{0, 0, 0},
+		{0.05, 0.02, 0},
+		{-0.05, 0.02, 0},
+		{0.1, 0.02, 0.1},
+		{-1.5, 0.03, -1.5},
+	}
+	for _, tt := range tests {
+		d := &Decoder{offset: tt.offset, offsetError: tt.offsetError}
+		if got := d.correction(); got != tt.want {
+			t.Errorf("correction() with offset %v ± %v = %v, want %v", tt.offset, tt.offsetError, got, tt.want)
+		}
+	}
+}
+
+func TestDecoder_NoisyCaptures(t *testing.T) {
+	captures := []string{"short-nonoise.flt", "short-noise2.flt", "medium.flt", "medium-noise2.flt"}
+	const trials = 4
+	tests := []struct {
+		name  string
+		gain  float64
+		sigma float64
+	}{
+		{"as captured", 1, 0},
+		{"under-deviated", 0.5, 0},
+		{"over-deviated", 1.5, 0},
+		{"under-deviated, noisy", 0.5, 0.1},
+		{"over-deviated, noisy", 1.5, 0.3},
+	}
+	for _, name := range captures {
+		syms := readCapture(t, name)
+		for _, tt := range tests {
+			t.Run(name+" "+tt.name, func(t *testing.T) {
+				rnd := rand.New(rand.NewSource(1))
+				packets := 0
+				for range trials {
+					d := NewDecoder(nil)
+					d.DecodeSymbols(&DummyModem{In: symbolReader(t, distort(syms, tt.gain, tt.sigma, rnd))}, func(e Event) {
+						if _, ok := e.(PacketEvent); ok {
+							packets++
+						}
+					})
+				}
+				if packets != trials {
+					t.Errorf("decoded %d of %d packets", packets, trials)
+				}
+			})
+		}
+	}
+}
+
+func TestDecoder_FalseAlarms(t *testing.T) {
+	tests := []struct {
+		name       string
+		thresholds SyncThresholds
+		// whether any syncs are expected
+		alarms bool
+	}{
+		{"default", SyncThresholds{}, false},
+		{"strict", SyncThresholds{LSF: 0.95, Frame: 0.95, EOT: 0.95}, false},
+		{"loose", SyncThresholds{LSF: 0.6, Frame: 0.6, EOT: 0.6}, true},
+	}
+	rnd := rand.New(rand.NewSource(1))
+	noise := distort(make([]Symbol, 50000), 0, 2, rnd)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := NewDecoder(nil)
+			d.SyncThresholds = tt.thresholds
+			syncs := 0
+			d.DecodeSymbols(&DummyModem{In: symbolReader(t, noise)}, func(e Event) {
+				switch e := e.(type) {
+				case LSFEvent:
+					if e.CRCValid {
+						t.Errorf("valid LSF decoded from noise: %v", e.LSF)
+					}
+					syncs++
+				case StreamFrameEvent, PacketEvent, PacketCRCErrorEvent, BERTEvent, EOTEvent:
+					syncs++
+				}
+			})
+			if (syncs > 0) != tt.alarms {
+				t.Errorf("%d syncs detected in noise, want any: %v", syncs, tt.alarms)
+			}
+		})
+	}
+}
+
+func TestDecoder_UnconfirmedFrames(t *testing.T) {
+	lsf := testStreamLSF(t)
+	payloads := testPayloads(5)
+	e := NewStreamEncoder(lsf)
+	syms := gog.Must(e.Start())
+	var frames [][]Symbol
+	for i, p := range payloads {
+		frames = append(frames, gog.Must(e.NextFrame(p, i == len(payloads)-1)))
+	}
+	eot := e.End()
+	rnd := rand.New(rand.NewSource(1))
+	// Noise in place of a frame or the EOT marker
+	noise := func(n int) []Symbol {
+		return distort(make([]Symbol, n), 0, 2, rnd)
+	}
+	tests := []struct {
+		name string
+		lost int
+		eot  bool
+		// frame numbers decoded
+		want []uint16
+	}{
+		{"complete", -1, true, []uint16{0, 1, 2, 3, 0x8004}},
+		{"missing EOT", -1, false, []uint16{0, 1, 2, 3, 0x8004}},
+		{"lost middle frame", 2, true, []uint16{0, 1, 3, 0x8004}},
+		{"lost frame, missing EOT", 2, false, []uint16{0, 1, 3, 0x8004}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in := append([]Symbol{}, syms...)
+			for i, f := range frames {
+				if i == tt.lost {
+					f = noise(len(f))
+				}
+				in = append(in, f...)
+			}
+			if tt.eot {
+				in = append(in, eot...)
+			} else {
+				in = append(in, noise(len(eot))...)
+			}
+			// Silence to flush the decoder
+			in = append(in, make([]Symbol, symbolBufSize/decoderSamplesPerSymbol+SymbolsPerFrame)...)
+			var got []uint16
+			ends := 0
+			NewDecoder(nil).DecodeSymbols(&DummyModem{In: symbolReader(t, in)}, func(e Event) {
+				switch e := e.(type) {
+				case StreamFrameEvent:
+					got = append(got, e.FrameNumber)
+				case StreamEndEvent:
+					ends++
+				}
+			})
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("decoded frames %04x, want %04x", got, tt.want)
+			}
+			if ends != 1 {
+				t.Errorf("%d StreamEndEvents, want 1", ends)
+			}
+		})
+	}
+}
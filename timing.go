@@ -0,0 +1,150 @@
+package m17
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+const (
+	// The Decoder works with this many samples per symbol
+	decoderSamplesPerSymbol = 5
+	decoderSampleRate       = decoderSamplesPerSymbol * SymbolRate
+	// Timing loop gains, as fractions of a symbol period
+	timingGainP = 0.02
+	timingGainI = 0.0002
+	// The symbol clock may differ from nominal by up to this fraction
+	maxClockError = 0.01
+	// Averaging factor for the signal power used to normalize the timing error
+	timingPowerAlpha = 0.01
+)
+
+// TimingRecovery resamples demodulated samples at any rate to the 5 samples
+// per symbol the Decoder works with. A Gardner timing error detector keeps
+// every 5th output sample on a symbol center, tracking the difference
+// between the transmitter's symbol clock and ours.
+type TimingRecovery struct {
+	// nominal and current input samples per symbol
+	sps    float64
+	period float64
+	// input samples not yet consumed, and the time of the next symbol center,
+	// in samples from the start of buf
+	buf []Symbol
+	t   float64
+	// last symbol center sample
+	prev float64
+	// average power of the symbol center samples
+	power float64
+}
+
+// NewTimingRecovery creates a TimingRecovery for input with samplesPerSymbol
+// samples per symbol, which needn't be a whole number.
+func NewTimingRecovery(samplesPerSymbol float64) (*TimingRecovery, error) {
+	if samplesPerSymbol < 2 {
+		return nil, fmt.Errorf("timing recovery needs at least 2 samples per symbol, got %f", samplesPerSymbol)
+	}
+	return &TimingRecovery{
+		sps:    samplesPerSymbol,
+		period: samplesPerSymbol,
+		// leave room for the first midpoint
+		t: samplesPerSymbol,
+	}, nil
+}
+
+// Process adds input samples and appends the output samples that can be
+// generated from them to out.
+func (r *TimingRecovery) Process(out []Symbol, in []Symbol) []Symbol {
+	r.buf = append(r.buf, in...)
+	step := r.period / decoderSamplesPerSymbol
+	// The last output sample is 2 steps past the center and needs 2 input
+	// samples after it to interpolate
+	for r.t+2*step+2 < float64(len(r.buf)) {
+		for j := -2; j <= 2; j++ {
+			out = append(out, Symbol(r.interpolate(r.t+float64(j)*step)))
+		}
+		cur := r.interpolate(r.t)
+		mid := r.interpolate(r.t - r.period/2)
+		r.power += timingPowerAlpha * (cur*cur - r.power)
+		var e float64
+		if r.power > 1e-6 {
+			// Positive when sampling late
+			e = (cur - r.prev) * mid / r.power
+			e = max(-1, min(1, e))
+		}
+		r.prev = cur
+		r.period -= timingGainI * r.sps * e
+		r.period = max(r.sps*(1-maxClockError), min(r.sps*(1+maxClockError), r.period))
+		r.t += r.period - timingGainP*r.sps*e
+		step = r.period / decoderSamplesPerSymbol
+	}
+	// Drop the samples we're done with, keeping enough for the next midpoint
+	if drop := int(r.t-r.period) - 2; drop > 0 {
+		r.buf = append(r.buf[:0], r.buf[drop:]...)
+		r.t -= float64(drop)
+	}
+	return out
+}
+
+// Cubic (Catmull-Rom) interpolation of the input at time t
+func (r *TimingRecovery) interpolate(t float64) float64 {
+	i := int(math.Floor(t))
+	mu := t - float64(i)
+	at := func(k int) float64 {
+		k = max(0, min(len(r.buf)-1, k))
+		return float64(r.buf[k])
+	}
+	y0, y1, y2, y3 := at(i-1), at(i), at(i+1), at(i+2)
+	a := -0.5*y0 + 1.5*y1 - 1.5*y2 + 0.5*y3
+	b := y0 - 2.5*y1 + 2*y2 - 0.5*y3
+	c := -0.5*y0 + 0.5*y2
+	return ((a*mu+b)*mu+c)*mu + y1
+}
+
+// timingReader applies TimingRecovery to the little endian float32 samples
+// read from in.
+type timingReader struct {
+	in  io.Reader
+	tr  *TimingRecovery
+	raw []byte
+	// buffers for reading and converting input, reused by Read
+	buf     []byte
+	symbols []Symbol
+	// output samples not yet read
+	out []Symbol
+	err error
+}
+
+func newTimingReader(in io.Reader, samplesPerSymbol float64) (*timingReader, error) {
+	tr, err := NewTimingRecovery(samplesPerSymbol)
+	if err != nil {
+		return nil, err
+	}
+	return &timingReader{in: in, tr: tr}, nil
+}
+
+func (r *timingReader) Read(p []byte) (int, error) {
+	want := len(p) / 4
+	for len(r.out) < want && r.err == nil {
+		r.buf = resize(r.buf, 4*want)
+		n, err := r.in.Read(r.buf)
+		r.raw = append(r.raw, r.buf[:n]...)
+		r.err = err
+		r.symbols = resize(r.symbols, len(r.raw)/4)
+		for i := range r.symbols {
+			r.symbols[i] = Symbol(math.Float32frombits(binary.LittleEndian.Uint32(r.raw[4*i:])))
+		}
+		// Keep any partial sample at the start of raw, so it doesn't grow
+		r.raw = r.raw[:copy(r.raw, r.raw[4*len(r.symbols):])]
+		r.out = r.tr.Process(r.out, r.symbols)
+	}
+	n := min(want, len(r.out))
+	for i, s := range r.out[:n] {
+		binary.LittleEndian.PutUint32(p[4*i:], math.Float32bits(float32(s)))
+	}
+	r.out = r.out[:copy(r.out, r.out[n:])]
+	if n == 0 {
+		return 0, r.err
+	}
+	return 4 * n, nil
+}
@@ -0,0 +1,161 @@
+package m17
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/icza/gog"
+)
+
+// Raised cosine pulse, alpha 0.5, x in symbols
+func raisedCosine(x float64) float64 {
+	const alpha = 0.5
+	if math.Abs(2*alpha*x) == 1 {
+		return math.Pi / 4 * math.Sin(math.Pi/(2*alpha)) / (math.Pi / (2 * alpha))
+	}
+	sinc := 1.0
+	if x != 0 {
+		sinc = math.Sin(math.Pi*x) / (math.Pi * x)
+	}
+	return sinc * math.Cos(math.Pi*alpha*x) / (1 - 4*alpha*alpha*x*x)
+}
+
+// shapeSymbols generates the waveform for syms, sampled sps times per symbol
+// starting offset symbols in
+func shapeSymbols(syms []Symbol, sps float64, offset float64) []Symbol {
+	const span = 8
+	out := make([]Symbol, int(float64(len(syms))*sps))
+	for n := range out {
+		x := float64(n)/sps + offset
+		var y float64
+		for k := max(0, int(x)-span); k < min(len(syms), int(x)+span+1); k++ {
+			y += float64(syms[k]) * raisedCosine(x-float64(k))
+		}
+		out[n] = Symbol(y)
+	}
+	return out
+}
+
+// sampleReader returns the samples followed by silence
+func sampleReader(t *testing.T, samples []Symbol) io.Reader {
+	var buf bytes.Buffer
+	err := binary.Write(&buf, binary.LittleEndian, samples)
+	if err != nil {
+		t.Fatalf("failed to write samples: %v", err)
+	}
+	buf.Write(make([]byte, 4*4*symbolBufSize))
+	return &buf
+}
+
+func TestTimingRecovery(t *testing.T) {
+	tests := []struct {
+		name string
+		sps  float64
+		// actual rate of the input
+		rate float64
+	}{
+		{"24 kHz", 5, 5},
+		{"48 kHz", 10, 10},
+		{"44.1 kHz", 44100.0 / 4800, 44100.0 / 4800},
+		{"24 kHz, slow clock", 5, 5 * 1.0005},
+		{"48 kHz, fast clock", 10, 10 * 0.9995},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rnd := rand.New(rand.NewSource(1))
+			syms := AppendPreamble(nil, lsfPreamble)
+			for range 5000 {
+				syms = append(syms, SymbolList[rnd.Intn(4)])
+			}
+			samples := shapeSymbols(syms, tt.rate, 0.3)
+			tr := gog.Must(NewTimingRecovery(tt.sps))
+			var out []Symbol
+			// Feed it in uneven blocks
+			for i := 0; i < len(samples); i += 97 {
+				out = tr.Process(out, samples[i:min(i+97, len(samples))])
+			}
+			// Every 5th output sample is a symbol center
+			var centers []Symbol
+			for i := 2; i < len(out); i += 5 {
+				centers = append(centers, out[i])
+			}
+			// Compare the second half, once the loop has settled, allowing
+			// for the output starting a few symbols ahead or behind
+			start := len(centers) / 2
+			n := len(centers) - start - 10
+			best := n
+			for shift := -10; shift <= 10; shift++ {
+				errs := 0
+				for i := start; i < start+n; i++ {
+					if math.Abs(float64(centers[i]-syms[i+shift])) > 0.5 {
+						errs++
+					}
+				}
+				best = min(best, errs)
+			}
+			if best > 0 {
+				t.Errorf("%d of %d symbols wrong", best, n)
+			}
+		})
+	}
+}
+
+func TestDecoder_TimingRecovery(t *testing.T) {
+	data := make([]byte, 800)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	// A 33 frame packet
+	p := gog.Must(NewPacket("N1ADJ", "N0CALL", PacketTypeSMS, data))
+	syms := gog.Must(p.Encode())
+	tests := []struct {
+		name string
+		sps  float64
+		rate float64
+	}{
+		{"24 kHz", 0, 5},
+		{"48 kHz", 10, 10},
+		{"44.1 kHz", 44100.0 / 4800, 44100.0 / 4800},
+		{"24 kHz, slow clock", 0, 5 * 1.002},
+		{"24 kHz, fast clock", 0, 5 * 0.998},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := NewDecoder(nil)
+			d.SamplesPerSymbol = tt.sps
+			var got []byte
+			d.DecodeSymbols(sampleReader(t, shapeSymbols(syms, tt.rate, 0.4)), func(e Event) {
+				switch e := e.(type) {
+				case PacketEvent:
+					got = e.Payload
+				case PacketCRCErrorEvent:
+					t.Errorf("packet CRC error")
+				}
+			})
+			if !bytes.Equal(got, p.PayloadBytes()) {
+				t.Errorf("decoded packet of %d bytes, want %d", len(got), len(p.PayloadBytes()))
+			}
+		})
+	}
+}
+
+// zeroReader is an endless source of zero samples
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+func BenchmarkTimingReader(b *testing.B) {
+	r := gog.Must(newTimingReader(zeroReader{}, 10))
+	buf := make([]byte, 4*symbolBufSize)
+	b.ReportAllocs()
+	for b.Loop() {
+		r.Read(buf)
+	}
+}
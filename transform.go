@@ -1,7 +1,6 @@
 package m17
 
 import (
-	"container/ring"
 	"fmt"
 	"math"
 
@@ -25,335 +24,335 @@ const (
 
 var transmitGain = float32(math.Sqrt(5))
 
-// alpha=0.5, span=8, sps=10, gain=sqrt(sps)
-// var rrcTaps10 = []float32{
-// 	-0.003195702904062,
-// 	-0.002930279157647,
-// 	-0.001940667871554,
-// 	-0.000356087678024,
-// 	0.001547011339078,
-// 	0.003389554791180,
-// 	0.004761898604226,
-// 	0.005310860846139,
-// 	0.004824746306020,
-// 	0.003297923526849,
-// 	0.000958710871219,
-// 	-0.001749908029792,
-// 	-0.004238694106631,
-// 	-0.005881783042102,
-// 	-0.006150256456781,
-// 	-0.004745376707652,
-// 	-0.001704189656474,
-// 	0.002547854551540,
-// 	0.007215575568845,
-// 	0.011231038205364,
-// 	0.013421952197061,
-// 	0.012730475385624,
-// 	0.008449554307304,
-// 	0.000436744366018,
-// 	-0.010735380379192,
-// 	-0.023726883538258,
-// 	-0.036498030780605,
-// 	-0.046500883189991,
-// 	-0.050979050576000,
-// 	-0.047340680079891,
-// 	-0.033554880492652,
-// 	-0.008513823955726,
-// 	0.027696543159614,
-// 	0.073664520037517,
-// 	0.126689053778116,
-// 	0.182990955139334,
-// 	0.238080025892860,
-// 	0.287235637987092,
-// 	0.326040247765297,
-// 	0.350895727088113,
-// 	0.359452932027608,
-// 	0.350895727088113,
-// 	0.326040247765297,
-// 	0.287235637987092,
-// 	0.238080025892860,
-// 	0.182990955139334,
-// 	0.126689053778116,
-// 	0.073664520037517,
-// 	0.027696543159614,
-// 	-0.008513823955726,
-// 	-0.033554880492652,
-// 	-0.047340680079891,
-// 	-0.050979050576000,
-// 	-0.046500883189991,
-// 	-0.036498030780605,
-// 	-0.023726883538258,
-// 	-0.010735380379192,
-// 	0.000436744366018,
-// 	0.008449554307304,
-// 	0.012730475385624,
-// 	0.013421952197061,
-// 	0.011231038205364,
-// 	0.007215575568845,
-// 	0.002547854551540,
-// 	-0.001704189656474,
-// 	-0.004745376707652,
-// 	-0.006150256456781,
-// 	-0.005881783042102,
-// 	-0.004238694106631,
-// 	-0.001749908029792,
-// 	0.000958710871219,
-// 	0.003297923526849,
-// 	0.004824746306020,
-// 	0.005310860846139,
-// 	0.004761898604226,
-// 	0.003389554791180,
-// 	0.001547011339078,
-// 	-0.000356087678024,
-// 	-0.001940667871554,
-// 	-0.002930279157647,
-// 	-0.003195702904062,
-// }
-
-// alpha=0.5, span=8, sps=5, gain=sqrt(sps)
-var rrcTaps5 = []float32{
-	-0.004519384154389,
-	-0.002744505321971,
-	0.002187793653660,
-	0.006734308458208,
-	0.006823188093192,
-	0.001355815246317,
-	-0.005994389201970,
-	-0.008697733303330,
-	-0.002410076268276,
-	0.010204314627992,
-	0.018981413448435,
-	0.011949415510291,
-	-0.015182045838927,
-	-0.051615756197679,
-	-0.072094910038768,
-	-0.047453533621088,
-	0.039168634270669,
-	0.179164496628150,
-	0.336694345124862,
-	0.461088271869920,
-	0.508340710642860,
-	0.461088271869920,
-	0.336694345124862,
-	0.179164496628150,
-	0.039168634270669,
-	-0.047453533621088,
-	-0.072094910038768,
-	-0.051615756197679,
-	-0.015182045838927,
-	0.011949415510291,
-	0.018981413448435,
-	0.010204314627992,
-	-0.002410076268276,
-	-0.008697733303330,
-	-0.005994389201970,
-	0.001355815246317,
-	0.006823188093192,
-	0.006734308458208,
-	0.002187793653660,
-	-0.002744505321971,
-	-0.004519384154389,
+// M17's pulse shaping filter: root-raised-cosine with rolloff 0.5, spanning
+// 8 symbols
+const (
+	rrcAlpha = 0.5
+	rrcSpan  = 8
+)
+
+const (
+	// SymbolRate is M17's symbol rate, in symbols per second
+	SymbolRate = 4800
+	// Frequency deviation in Hz for a symbol of 1, so the outer symbols
+	// are ±2.4 kHz
+	symbolDeviation = 800
+)
+
+// RRC taps for the CC1200 modem's 5 samples per symbol
+var rrcTaps5 = m17RRCTaps(5)
+
+// RRCTaps designs a root-raised-cosine filter with rolloff alpha, spanning
+// span symbols, with samplesPerSymbol taps per symbol. With gain
+// sqrt(samplesPerSymbol) the taps have unit energy.
+func RRCTaps(alpha float64, span int, samplesPerSymbol int, gain float64) ([]float32, error) {
+	if alpha <= 0 || alpha > 1 {
+		return nil, fmt.Errorf("rolloff must be between 0 and 1, got %f", alpha)
+	}
+	if span < 1 || samplesPerSymbol < 1 {
+		return nil, fmt.Errorf("span and samples per symbol must be positive, got %d and %d", span, samplesPerSymbol)
+	}
+	taps := make([]float32, span*samplesPerSymbol+1)
+	for i := range taps {
+		t := float64(i-span*samplesPerSymbol/2) / float64(samplesPerSymbol)
+		taps[i] = float32(gain / float64(samplesPerSymbol) * rrc(alpha, t))
+	}
+	return taps, nil
+}
+
+// Return the taps of M17's RRC filter at samplesPerSymbol
+func m17RRCTaps(samplesPerSymbol int) []float32 {
+	taps, err := RRCTaps(rrcAlpha, rrcSpan, samplesPerSymbol, math.Sqrt(float64(samplesPerSymbol)))
+	if err != nil {
+		panic(err)
+	}
+	return taps
+}
+
+// Root-raised-cosine impulse response with rolloff alpha at t symbols
+func rrc(alpha, t float64) float64 {
+	switch {
+	case t == 0:
+		return 1 - alpha + 4*alpha/math.Pi
+	case math.Abs(math.Abs(4*alpha*t)-1) < 1e-9:
+		return alpha / math.Sqrt2 * ((1+2/math.Pi)*math.Sin(math.Pi/(4*alpha)) + (1-2/math.Pi)*math.Cos(math.Pi/(4*alpha)))
+	}
+	return (math.Sin(math.Pi*t*(1-alpha)) + 4*alpha*t*math.Cos(math.Pi*t*(1+alpha))) /
+		(math.Pi * t * (1 - (4*alpha*t)*(4*alpha*t)))
 }
 
 type Number interface {
 	constraints.Integer | constraints.Float
 }
 
-// Generic transformation
-type Transform[I any, O any] struct {
-	sink      chan I
-	source    chan O
-	transform func(I) []O
+// Filter processes a block of samples, appending its output to out and
+// returning it. Filters keep whatever state they need between blocks, so a
+// stream can be split into blocks of any size.
+type Filter[I any, O any] interface {
+	Process(out []O, in []I) []O
 }
 
-func NewTransform[I any, O any](sink chan I, transform func(I) []O, sourceSize int) Transform[I, O] {
-	ret := Transform[I, O]{
-		sink:      sink,
-		source:    make(chan O, sourceSize),
-		transform: transform,
-	}
-	go ret.handle()
-	return ret
+// Chain composes two filters into one that passes the output of f to g.
+func Chain[A any, B any, C any](f Filter[A, B], g Filter[B, C]) Filter[A, C] {
+	return &chain[A, B, C]{f: f, g: g}
 }
 
-func (t *Transform[I, O]) Source() chan O {
-	return t.source
+type chain[A any, B any, C any] struct {
+	f   Filter[A, B]
+	g   Filter[B, C]
+	buf []B
 }
 
-func (t *Transform[I, O]) handle() {
-	for {
-		sample, ok := <-t.sink
-		if !ok {
-			break
-		}
-		for _, s := range t.transform(sample) {
-			t.source <- s
-		}
-	}
-	close(t.source)
+func (c *chain[A, B, C]) Process(out []C, in []A) []C {
+	c.buf = c.f.Process(c.buf[:0], in)
+	return c.g.Process(out, c.buf)
 }
 
 // Filter DC from int8 samples by subtracting a moving average
 type DCFilter struct {
-	Transform[int8, int8]
 	averageN  int
 	movingAvg int8
 }
 
-func NewDCFilter(sink chan int8, averageN int) (DCFilter, error) {
-	ret := DCFilter{
-		averageN: averageN,
-	}
+func NewDCFilter(averageN int) (*DCFilter, error) {
 	if averageN < 1 {
-		return ret, fmt.Errorf("averageN must be greater than zero")
+		return nil, fmt.Errorf("averageN must be greater than zero")
 	}
-	ret.Transform = NewTransform(sink, ret.dcFilter, 0)
-	return ret, nil
+	return &DCFilter{averageN: averageN}, nil
 }
-func (t *DCFilter) dcFilter(sample int8) []int8 {
-	t.movingAvg = int8((int(t.movingAvg)*(t.averageN-1) + int(sample)) / t.averageN)
-	// log.Printf("[DEBUG] movingAvg: %d, sample: %d, ret: %d", t.movingAvg, sample, sample-t.movingAvg)
-	return []int8{sample - t.movingAvg}
+
+func (t *DCFilter) Process(out []int8, in []int8) []int8 {
+	for _, sample := range in {
+		t.movingAvg = int8((int(t.movingAvg)*(t.averageN-1) + int(sample)) / t.averageN)
+		// log.Printf("[DEBUG] movingAvg: %d, sample: %d, ret: %d", t.movingAvg, sample, sample-t.movingAvg)
+		out = append(out, sample-t.movingAvg)
+	}
+	return out
 }
 
 // scale samples by a factor
 type Scaler[T Number] struct {
-	Transform[T, T]
 	factor T
 }
 
-func NewScaler[T Number](sink chan T, factor T) Scaler[T] {
-	ret := Scaler[T]{
-		factor: factor,
-	}
-	ret.Transform = NewTransform(sink, ret.scale, 0)
-	return ret
+func NewScaler[T Number](factor T) *Scaler[T] {
+	return &Scaler[T]{factor: factor}
 }
-func (t *Scaler[T]) scale(sample T) []T {
-	return []T{sample * t.factor}
+
+func (t *Scaler[T]) Process(out []T, in []T) []T {
+	for _, sample := range in {
+		out = append(out, sample*t.factor)
+	}
+	return out
 }
 
-// Transform int8 samples to float32 symbols by RRC filtering them
-type SampleToSymbol struct { // Make this generic in the future?
-	Transform[int8, float32]
-	fltBuff      *ring.Ring //length of this has to match RRC filter's length
-	rrcTaps      []float32
-	scalingCoeff float32
+// Finite impulse response filter
+type fir struct {
+	taps []float32
+	// the last len(taps) samples, stored twice so they are always contiguous
+	// starting at pos
+	hist []float32
+	pos  int
 }
 
-func NewSampleToSymbol(sink chan int8, rrcTaps []float32, scalingCoeff float32) SampleToSymbol {
-	ret := SampleToSymbol{
-		fltBuff:      ring.New(len(rrcTaps)),
-		rrcTaps:      rrcTaps,
-		scalingCoeff: scalingCoeff,
+func newFIR(taps []float32) fir {
+	return fir{
+		taps: taps,
+		hist: make([]float32, 2*len(taps)),
 	}
-	for range rrcTaps {
-		ret.fltBuff.Value = float32(0)
-		ret.fltBuff = ret.fltBuff.Next()
+}
+
+// Add a sample and return the filter output
+func (f *fir) next(sample float32) float32 {
+	f.push(sample)
+	return f.output(f.taps)
+}
+
+// Add a sample to the history
+func (f *fir) push(sample float32) {
+	n := len(f.taps)
+	f.hist[f.pos] = sample
+	f.hist[f.pos+n] = sample
+	f.pos = (f.pos + 1) % n
+}
+
+// Return the output for taps, which must be as long as the filter's own
+func (f *fir) output(taps []float32) float32 {
+	hist := f.hist[f.pos : f.pos+len(taps)]
+	var acc float32
+	for i, tap := range taps {
+		acc += tap * hist[i]
 	}
-	ret.Transform = NewTransform(sink, ret.transform, 0)
-	return ret
+	return acc
 }
 
-func (t *SampleToSymbol) Source() chan float32 {
-	return t.source
+// Transform int8 samples to float32 symbols by RRC filtering them
+type SampleToSymbol struct {
+	fir          fir
+	scalingCoeff float32
 }
 
-func (t *SampleToSymbol) transform(sample int8) []float32 {
-	var symbol float32
-	t.fltBuff.Value = float32(sample)
-	t.fltBuff = t.fltBuff.Next()
+// NewSampleToSymbol returns a SampleToSymbol that matched-filters samples with
+// rrcTaps, such as those from RRCTaps, and scales them by scalingCoeff.
+func NewSampleToSymbol(rrcTaps []float32, scalingCoeff float32) *SampleToSymbol {
+	return &SampleToSymbol{
+		fir:          newFIR(rrcTaps),
+		scalingCoeff: scalingCoeff,
+	}
+}
 
-	i := 0
-	t.fltBuff.Do(func(p any) {
-		f := p.(float32)
-		symbol += t.rrcTaps[i] * f
-		// log.Printf("[DEBUG] i: %d, f: %f, symbol: %f", i, f, symbol)
-		i++
-	})
-	symbol *= t.scalingCoeff
-	return []float32{symbol}
+func (t *SampleToSymbol) Process(out []float32, in []int8) []float32 {
+	for _, sample := range in {
+		out = append(out, t.fir.next(float32(sample))*t.scalingCoeff)
+	}
+	return out
 }
 
 // Transform float32 symbols to int8 samples
 type SymbolToSample struct {
-	// Transform[float32, int8]
-	last             *ring.Ring //length of this has to match RRC filter's length
-	rrcTaps          []float32
+	fir              fir
 	scalingCoeff     float32
 	phaseInvert      bool
 	samplesPerSymbol int
 }
 
-func NewSymbolToSample(rrcTaps []float32, scalingCoeff float32, phaseInvert bool, samplesPerSymbol int) SymbolToSample {
-	ret := SymbolToSample{
-		last:             ring.New(len(rrcTaps)),
-		rrcTaps:          rrcTaps,
+// NewSymbolToSample returns a SymbolToSample that upsamples symbols to
+// samplesPerSymbol and shapes them with rrcTaps, such as those from RRCTaps.
+func NewSymbolToSample(rrcTaps []float32, scalingCoeff float32, phaseInvert bool, samplesPerSymbol int) *SymbolToSample {
+	return &SymbolToSample{
+		fir:              newFIR(rrcTaps),
 		scalingCoeff:     scalingCoeff,
 		phaseInvert:      phaseInvert,
 		samplesPerSymbol: samplesPerSymbol,
 	}
-	for range rrcTaps {
-		ret.last.Value = float32(0)
-		ret.last = ret.last.Next()
-	}
-	// ret.Transform = NewTransform(sink, ret.transform, 0)
-	return ret
 }
 
-func (t *SymbolToSample) Transform(symbols []Symbol) []byte {
-	ret := make([]byte, len(symbols)*t.samplesPerSymbol)
-	for i, symbol := range symbols {
+func (t *SymbolToSample) Process(out []byte, in []Symbol) []byte {
+	for _, symbol := range in {
 		for j := 0; j < t.samplesPerSymbol; j++ {
+			var sample float32
 			if j == 0 {
+				sample = float32(symbol)
 				if t.phaseInvert {
-					t.last.Value = -float32(symbol)
-				} else {
-					t.last.Value = float32(symbol)
+					sample = -sample
 				}
-			} else {
-				t.last.Value = float32(0)
 			}
-			t.last = t.last.Next()
-			var acc float32
-			k := 0
-			t.last.Do(func(p any) {
-				f := p.(float32)
-				acc += t.rrcTaps[k] * f
-				k++
-			})
-			ret[i*t.samplesPerSymbol+j] = byte(acc * t.scalingCoeff)
+			out = append(out, byte(t.fir.next(sample)*t.scalingCoeff))
 		}
 	}
-	return ret
+	return out
+}
+
+// FIRFilter filters float32 samples with the given taps and scales them.
+type FIRFilter struct {
+	fir   fir
+	scale float32
+}
+
+func NewFIRFilter(taps []float32, scale float32) *FIRFilter {
+	return &FIRFilter{
+		fir:   newFIR(taps),
+		scale: scale,
+	}
+}
+
+func (t *FIRFilter) Process(out []float32, in []float32) []float32 {
+	for _, sample := range in {
+		out = append(out, t.fir.next(sample)*t.scale)
+	}
+	return out
+}
+
+// PulseShaper upsamples symbols to samplesPerSymbol and shapes them with RRC
+// taps, like SymbolToSample but producing float32 samples.
+type PulseShaper struct {
+	fir              fir
+	scale            float32
+	samplesPerSymbol int
+}
+
+func NewPulseShaper(rrcTaps []float32, scale float32, samplesPerSymbol int) *PulseShaper {
+	return &PulseShaper{
+		fir:              newFIR(rrcTaps),
+		scale:            scale,
+		samplesPerSymbol: samplesPerSymbol,
+	}
+}
+
+func (t *PulseShaper) Process(out []float32, in []Symbol) []float32 {
+	for _, symbol := range in {
+		out = append(out, t.fir.next(float32(symbol))*t.scale)
+		for range t.samplesPerSymbol - 1 {
+			out = append(out, t.fir.next(0)*t.scale)
+		}
+	}
+	return out
+}
+
+// NewRXFilter returns a filter that turns demodulated samples at sampleRate
+// into the 5 samples per symbol the Decoder reads, resampling them if need be
+// and applying the RRC matched filter. Samples are expected in symbol units,
+// so that the outer symbols are around ±3.
+func NewRXFilter(sampleRate int) (Filter[float32, float32], error) {
+	matched := NewFIRFilter(rrcTaps5, 1/transmitGain)
+	if sampleRate == decoderSampleRate {
+		return matched, nil
+	}
+	r, err := NewResampler[float32](sampleRate, decoderSampleRate)
+	if err != nil {
+		return nil, err
+	}
+	return Chain[float32, float32, float32](r, matched), nil
+}
+
+// Most samples per symbol NewTXFilter shapes directly. The RRC filter grows
+// with the rate, so higher rates are shaped at 5 samples per symbol and
+// resampled, which costs a few taps per sample.
+const maxShapedSamplesPerSymbol = 10
+
+// NewTXFilter returns a filter that shapes symbols into samples at sampleRate,
+// in symbol units. Multiples of SymbolRate up to 10 samples per symbol are
+// shaped directly, other rates are shaped at 5 samples per symbol and
+// resampled.
+func NewTXFilter(sampleRate int) (Filter[Symbol, float32], error) {
+	if sampleRate < 1 {
+		return nil, fmt.Errorf("sample rate must be positive, got %d", sampleRate)
+	}
+	if sampleRate%SymbolRate == 0 && sampleRate/SymbolRate <= maxShapedSamplesPerSymbol {
+		sps := sampleRate / SymbolRate
+		return NewPulseShaper(m17RRCTaps(sps), float32(math.Sqrt(float64(sps))), sps), nil
+	}
+	r, err := NewResampler[float32](decoderSampleRate, sampleRate)
+	if err != nil {
+		return nil, err
+	}
+	return Chain[Symbol, float32, float32](NewPulseShaper(rrcTaps5, transmitGain, decoderSamplesPerSymbol), r), nil
 }
 
 // Downsample a stream by returning one out of each N values
 type Downsampler[T any] struct {
-	Transform[T, T]
 	factor int
 	offset int
 	count  int
 }
 
-func NewDownsampler[T any](sink chan T, factor int, offset int) (Downsampler[T], error) {
-	ret := Downsampler[T]{
-		factor: factor,
-		offset: offset,
-	}
+func NewDownsampler[T any](factor int, offset int) (*Downsampler[T], error) {
 	if offset < 0 || offset >= factor {
-		return ret, fmt.Errorf("offset must be between 0 and %d", factor)
+		return nil, fmt.Errorf("offset must be between 0 and %d", factor)
 	}
-	ret.Transform = NewTransform(sink, ret.downsample, 0)
-	return ret, nil
+	return &Downsampler[T]{
+		factor: factor,
+		offset: offset,
+	}, nil
 }
 
-func (t *Downsampler[T]) downsample(sample T) []T {
-	ret := []T{}
-	if t.count%t.factor == t.offset {
-		ret = []T{sample}
-		t.count = t.offset
+func (t *Downsampler[T]) Process(out []T, in []T) []T {
+	for _, sample := range in {
+		if t.count%t.factor == t.offset {
+			out = append(out, sample)
+			t.count = t.offset
+		}
+		t.count++
 	}
-	t.count++
-	return ret
+	return out
 }